@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	errors "git.sequentialread.com/forest/pkg-errors"
+)
+
+const auditLogFileName = "powdet-audit.jsonl"
+
+// entries waiting to be written, when the writer falls behind further entries are dropped rather than slowing requests down
+const auditLogQueueSize = 10000
+
+// auditLogger appends JSON lines to audit_log/powdet-audit.jsonl from a single goroutine.
+// Once the file reaches the size limit it is renamed to powdet-audit-<time>.jsonl and only the newest rotated files are kept.
+// Only token prefixes are ever logged, never full tokens or nonces.
+type auditLogger struct {
+	entries   chan map[string]interface{}
+	directory string
+	maxBytes  int64
+	maxFiles  int
+	file      *os.File
+	size      int64
+}
+
+// auditLog is nil when audit_log is not configured, logging to it is then a no-op
+var auditLog *auditLogger
+
+func startAuditLog(directory string, maxBytes int64, maxFiles int) (*auditLogger, error) {
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, errors.Wrapf(err, "can't create the audit_log directory %s", directory)
+	}
+	logger := &auditLogger{
+		entries:   make(chan map[string]interface{}, auditLogQueueSize),
+		directory: directory,
+		maxBytes:  maxBytes,
+		maxFiles:  maxFiles,
+	}
+	if err := logger.open(); err != nil {
+		return nil, err
+	}
+	go logger.run()
+	return logger, nil
+}
+
+// record queues an audit entry without ever blocking the caller.
+func (logger *auditLogger) record(event string, fields map[string]interface{}) {
+	if logger == nil {
+		return
+	}
+	fields["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	fields["event"] = event
+	select {
+	case logger.entries <- fields:
+	default:
+		metrics.add("audit_log_dropped", 1)
+	}
+}
+
+func (logger *auditLogger) run() {
+	for entry := range logger.entries {
+		entryBytes, err := json.Marshal(entry)
+		if err != nil {
+			log.Printf("audit log: json marshal failed: %v", err)
+			continue
+		}
+		entryBytes = append(entryBytes, '\n')
+		if logger.size > 0 && logger.size+int64(len(entryBytes)) > logger.maxBytes {
+			if err := logger.rotate(); err != nil {
+				log.Printf("audit log: rotation failed: %v", err)
+			}
+		}
+		if logger.file == nil {
+			metrics.add("audit_log_dropped", 1)
+			continue
+		}
+		n, err := logger.file.Write(entryBytes)
+		logger.size += int64(n)
+		if err != nil {
+			log.Printf("audit log: write failed: %v", err)
+			metrics.add("audit_log_dropped", 1)
+		}
+	}
+}
+
+func (logger *auditLogger) open() error {
+	filePath := filepath.Join(logger.directory, auditLogFileName)
+	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "can't open the audit log %s", filePath)
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.Wrapf(err, "can't stat the audit log %s", filePath)
+	}
+	logger.file = file
+	logger.size = fileInfo.Size()
+	return nil
+}
+
+func (logger *auditLogger) rotate() error {
+	logger.file.Close()
+	logger.file = nil
+
+	rotatedName := fmt.Sprintf("powdet-audit-%s.jsonl", time.Now().UTC().Format("20060102T150405.000000000"))
+	err := os.Rename(filepath.Join(logger.directory, auditLogFileName), filepath.Join(logger.directory, rotatedName))
+	if err != nil {
+		log.Printf("audit log: rename failed: %v", err)
+	}
+	logger.removeOldFiles()
+	return logger.open()
+}
+
+// removeOldFiles keeps the newest maxFiles rotated files, their names sort by rotation time.
+func (logger *auditLogger) removeOldFiles() {
+	rotatedFiles, err := filepath.Glob(filepath.Join(logger.directory, "powdet-audit-*.jsonl"))
+	if err != nil {
+		log.Printf("audit log: listing rotated files failed: %v", err)
+		return
+	}
+	sort.Strings(rotatedFiles)
+	for len(rotatedFiles) > logger.maxFiles {
+		if err := os.Remove(rotatedFiles[0]); err != nil && !os.IsNotExist(err) {
+			log.Printf("audit log: removing %s failed: %v", rotatedFiles[0], err)
+		}
+		rotatedFiles = rotatedFiles[1:]
+	}
+}
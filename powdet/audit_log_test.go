@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestAuditLogger opens an audit logger without starting its writer goroutine,
+// the test calls drainTestAuditLogger to write the queued entries.
+func newTestAuditLogger(t *testing.T, directory string, maxBytes int64, maxFiles, queueSize int) *auditLogger {
+	t.Helper()
+	logger := &auditLogger{
+		entries:   make(chan map[string]interface{}, queueSize),
+		directory: directory,
+		maxBytes:  maxBytes,
+		maxFiles:  maxFiles,
+	}
+	if err := logger.open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { logger.file.Close() })
+	return logger
+}
+
+func drainTestAuditLogger(logger *auditLogger) {
+	close(logger.entries)
+	logger.run()
+}
+
+// readTestAuditLog parses every line of an audit log file.
+func readTestAuditLog(t *testing.T, path string) []map[string]interface{} {
+	t.Helper()
+	fileBytes, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSpace(string(fileBytes)), "\n") {
+		if line == "" {
+			continue
+		}
+		entry := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("audit log line %q is not json: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestAuditLogRecordsEvents(t *testing.T) {
+	setupTest(t, "")
+	auditDirectory := t.TempDir()
+	auditLog = newTestAuditLogger(t, auditDirectory, 1024*1024, 10, 100)
+
+	token := createTestToken(t, "a")
+	challenges := getTestChallenges(t, token, "difficultyLevel=1")
+	nonce := solveTestChallenge(t, challenges[0])
+	verifyChallenge(token, challenges[0], nonce, "")
+	if _, err := revokeToken(token, "test"); err != nil {
+		t.Fatal(err)
+	}
+	drainTestAuditLogger(auditLog)
+
+	auditLogPath := filepath.Join(auditDirectory, auditLogFileName)
+	entries := readTestAuditLog(t, auditLogPath)
+	testCases := []struct {
+		event      string
+		wantFields map[string]interface{}
+	}{
+		{event: "token_create", wantFields: map[string]interface{}{"name": "a"}},
+		{event: "challenge_batch", wantFields: map[string]interface{}{"batchId": float64(1), "count": float64(5), "difficultyLevel": float64(1), "clientIP": "192.0.2.1"}},
+		{event: "verify", wantFields: map[string]interface{}{"result": "ok"}},
+		{event: "token_revoke", wantFields: map[string]interface{}{"actor": "test"}},
+	}
+	if len(entries) != len(testCases) {
+		t.Fatalf("the audit log holds %d entries, want %d: %v", len(entries), len(testCases), entries)
+	}
+	for i, testCase := range testCases {
+		entry := entries[i]
+		if entry["event"] != testCase.event || entry["tokenPrefix"] != shortTokenPrefix(token) || entry["time"] == nil {
+			t.Errorf("entry %d is %v, want event %s for token prefix %s", i, entry, testCase.event, shortTokenPrefix(token))
+		}
+		for name, want := range testCase.wantFields {
+			if entry[name] != want {
+				t.Errorf("entry %d has %s = %v, want %v", i, name, entry[name], want)
+			}
+		}
+	}
+
+	auditLogBytes, _ := os.ReadFile(auditLogPath)
+	for _, secret := range []string{token, nonce, challenges[0]} {
+		if strings.Contains(string(auditLogBytes), secret) {
+			t.Errorf("the audit log contains %s", secret)
+		}
+	}
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	resetMetrics()
+	auditDirectory := t.TempDir()
+	const maxBytes = 300
+	logger := newTestAuditLogger(t, auditDirectory, maxBytes, 2, 100)
+	for i := 0; i < 30; i++ {
+		logger.record("verify", map[string]interface{}{"tokenPrefix": "abcdef", "result": "ok", "latencyMs": i})
+	}
+	drainTestAuditLogger(logger)
+
+	rotatedFiles, err := filepath.Glob(filepath.Join(auditDirectory, "powdet-audit-*.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotatedFiles) != 2 {
+		t.Errorf("%d rotated files were kept, want audit_log_max_files (2)", len(rotatedFiles))
+	}
+	for _, path := range append(rotatedFiles, filepath.Join(auditDirectory, auditLogFileName)) {
+		fileInfo, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fileInfo.Size() > maxBytes {
+			t.Errorf("%s is %d bytes, above the %d byte limit", filepath.Base(path), fileInfo.Size(), maxBytes)
+		}
+		readTestAuditLog(t, path)
+	}
+
+	// the newest entries are the ones that are kept
+	current := readTestAuditLog(t, filepath.Join(auditDirectory, auditLogFileName))
+	if latencyMs := current[len(current)-1]["latencyMs"]; latencyMs != float64(29) {
+		t.Errorf("the last entry has latencyMs %v, want 29", latencyMs)
+	}
+	if dropped := metricValue("audit_log_dropped"); dropped != 0 {
+		t.Errorf("audit_log_dropped is %d after rotating, want 0", dropped)
+	}
+}
+
+func TestAuditLogDropsWhenFull(t *testing.T) {
+	resetMetrics()
+	logger := newTestAuditLogger(t, t.TempDir(), 1024*1024, 10, 3)
+	for i := 0; i < 10; i++ {
+		logger.record("verify", map[string]interface{}{"result": "ok"})
+	}
+	if dropped := metricValue("audit_log_dropped"); dropped != 7 {
+		t.Errorf("audit_log_dropped is %d with a queue of 3 and 10 entries, want 7", dropped)
+	}
+	drainTestAuditLogger(logger)
+	if entries := readTestAuditLog(t, filepath.Join(logger.directory, auditLogFileName)); len(entries) != 3 {
+		t.Errorf("%d entries were written, want the 3 that fit in the queue", len(entries))
+	}
+}
+
+func TestAuditLogDisabledWritesNothing(t *testing.T) {
+	setupTest(t, "")
+	if auditLog != nil {
+		t.Fatal("the audit log is running without audit_log being configured")
+	}
+	token := createTestToken(t, "a")
+	challenges := getTestChallenges(t, token, "difficultyLevel=1")
+	verifyChallenge(token, challenges[0], solveTestChallenge(t, challenges[0]), "")
+	revokeToken(token, "test")
+
+	err := filepath.Walk(appDirectory, func(path string, fileInfo os.FileInfo, err error) error {
+		if err == nil && strings.HasPrefix(fileInfo.Name(), "powdet-audit") {
+			t.Errorf("%s was written without audit_log being configured", path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dropped := metricValue("audit_log_dropped"); dropped != 0 {
+		t.Errorf("audit_log_dropped is %d, want 0", dropped)
+	}
+}
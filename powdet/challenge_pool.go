@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"log"
+	"time"
+
+	errors "git.sequentialread.com/forest/pkg-errors"
+)
+
+// preimagePool keeps random challenge preimages ready so /GetChallenges doesn't have to read crypto/rand
+// once per challenge on the request path. Only the preimage is pre-generated: difficulty, algorithm and binding
+// are request specific and are filled in when the challenge is served, which is also when it gets registered
+// under the requesting token.
+type preimagePool struct {
+	preimages   chan string
+	lengthBytes int
+}
+
+var challengePreimagePool *preimagePool
+
+func newPreimagePool(size, lengthBytes int) *preimagePool {
+	pool := &preimagePool{preimages: make(chan string, size), lengthBytes: lengthBytes}
+	go pool.fill()
+	return pool
+}
+
+// fill runs forever, it blocks whenever the pool is full.
+func (pool *preimagePool) fill() {
+	// read randomness in chunks, a single large read is much cheaper than many small ones
+	randomBytes := make([]byte, pool.lengthBytes*256)
+	for {
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			log.Printf("preimage pool: read random bytes failed: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		for i := 0; i < len(randomBytes); i += pool.lengthBytes {
+			pool.preimages <- base64.StdEncoding.EncodeToString(randomBytes[i : i+pool.lengthBytes])
+		}
+	}
+}
+
+// take returns count preimages of lengthBytes each, falling back to generating them synchronously when the pool runs dry.
+// A nil pool (pregen_pool_size 0) always generates synchronously, and so does a pool of the wrong length
+// (preimage_length_bytes was changed by a reload).
+func (pool *preimagePool) take(count, lengthBytes int) ([]string, error) {
+	preimages := make([]string, 0, count)
+	if pool != nil && pool.lengthBytes == lengthBytes {
+	drain:
+		for len(preimages) < count {
+			select {
+			case preimage := <-pool.preimages:
+				preimages = append(preimages, preimage)
+			default:
+				break drain
+			}
+		}
+		metrics.add("preimage_pool_served", int64(len(preimages)))
+		if len(preimages) < count {
+			metrics.add("preimage_pool_fallback", int64(count-len(preimages)))
+		}
+	}
+
+	if len(preimages) < count {
+		randomBytes := make([]byte, lengthBytes*(count-len(preimages)))
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "read random bytes failed")
+		}
+		for i := 0; i < len(randomBytes); i += lengthBytes {
+			preimages = append(preimages, base64.StdEncoding.EncodeToString(randomBytes[i:i+lengthBytes]))
+		}
+	}
+	return preimages, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+)
+
+// newTestPreimagePool returns a pool holding exactly the given preimages, without the background filler.
+func newTestPreimagePool(lengthBytes int, preimages ...string) *preimagePool {
+	pool := &preimagePool{preimages: make(chan string, len(preimages)), lengthBytes: lengthBytes}
+	for _, preimage := range preimages {
+		pool.preimages <- preimage
+	}
+	return pool
+}
+
+func TestPreimagePoolServedAndFallback(t *testing.T) {
+	pooled := []string{
+		base64.StdEncoding.EncodeToString([]byte("pooled-1")),
+		base64.StdEncoding.EncodeToString([]byte("pooled-2")),
+		base64.StdEncoding.EncodeToString([]byte("pooled-3")),
+	}
+	testCases := []struct {
+		name         string
+		configJSON   string
+		pool         *preimagePool
+		wantPooled   int
+		wantServed   int64
+		wantFallback int64
+	}{
+		{name: "no pool", pool: nil},
+		{name: "pool runs dry", pool: newTestPreimagePool(8, pooled...), wantPooled: 3, wantServed: 3, wantFallback: 2},
+		{
+			name:       "pool of another preimage length",
+			configJSON: `{"preimage_length_bytes": 16}`,
+			pool:       newTestPreimagePool(8, pooled...),
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			setupTest(t, testCase.configJSON)
+			challengePreimagePool = testCase.pool
+			currentConfig, _ := currentConfiguration()
+			token := createTestToken(t, "a")
+			challenges := getTestChallenges(t, token, "difficultyLevel=1")
+
+			if served := metricValue("preimage_pool_served"); served != testCase.wantServed {
+				t.Errorf("preimage_pool_served is %d, want %d", served, testCase.wantServed)
+			}
+			if fallback := metricValue("preimage_pool_fallback"); fallback != testCase.wantFallback {
+				t.Errorf("preimage_pool_fallback is %d, want %d", fallback, testCase.wantFallback)
+			}
+
+			// pool-served and synchronously generated challenges are registered and verify the same way
+			fromPool := 0
+			for _, challengeBase64 := range challenges {
+				challenge := decodeTestChallenge(t, challengeBase64)
+				preimageBytes, _ := base64.StdEncoding.DecodeString(challenge.Preimage)
+				if len(preimageBytes) != currentConfig.PreimageLengthBytes {
+					t.Errorf("the preimage has %d bytes, want %d", len(preimageBytes), currentConfig.PreimageLengthBytes)
+				}
+				for _, preimage := range pooled {
+					if challenge.Preimage == preimage {
+						fromPool++
+					}
+				}
+				nonce := solveTestChallenge(t, challengeBase64)
+				response := serveTestRequest(newTestRequest("POST", "/Verify?challenge="+challengeBase64+"&nonce="+nonce, token, ""))
+				if response.Code != 200 {
+					t.Errorf("/Verify returned %d: %s", response.Code, response.Body.String())
+				}
+			}
+			if fromPool != testCase.wantPooled {
+				t.Errorf("%d challenges use a pooled preimage, want %d", fromPool, testCase.wantPooled)
+			}
+		})
+	}
+}
+
+// BenchmarkGetChallengesPool compares /GetChallenges latency with and without a preimage pool.
+func BenchmarkGetChallengesPool(b *testing.B) {
+	for _, poolSize := range []int{0, 100000} {
+		b.Run(fmt.Sprintf("pregen_pool_size=%d", poolSize), func(b *testing.B) {
+			setupTest(b, `{"batch_size": 1000}`)
+			if poolSize > 0 {
+				challengePreimagePool = newPreimagePool(poolSize, 8)
+			}
+			token := createTestToken(b, "a")
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				serveTestRequest(newTestRequest("POST", "/GetChallenges?difficultyLevel=1", token, ""))
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type ChallengeStoreConfig struct {
+	// "memory" (default), "bolt" or "redis" (uses the top level redis config)
+	Type string `json:"type"`
+	// database file used by the bolt store, only one process can open it at a time
+	Path string `json:"path"`
+	// how long the redis store keeps a challenge that is never verified, defaults to one hour.
+	// The memory and bolt stores only drop challenges after deprecate_after_batches newer batches.
+	TTLSeconds int `json:"ttl_seconds"`
+}
+
+type ChallengeStats struct {
+	Count             int `json:"count"`
+	CurrentGeneration int `json:"currentGeneration"`
+	OldestGeneration  int `json:"oldestGeneration"`
+}
+
+// ChallengeStore holds the outstanding challenges of every API token.
+// Each call to Put starts a new generation for the token and drops the generations that are too old.
+type ChallengeStore interface {
+	// Put stores a batch of challenges for token under a new generation and returns that generation.
+	// In the same step it removes the challenges of token that are more than deprecateAfterBatches generations old,
+	// so concurrent batches for one token can't interleave their generations and sweeps.
+	Put(token string, challengeBase64s []string, deprecateAfterBatches int) (int, error)
+	// Consume atomically checks for the challenge and deletes it, so each challenge can only be used once.
+	Consume(token, challengeBase64 string) (bool, error)
+	// SweepExpired removes the challenges of token that are more than deprecateAfterBatches generations old.
+	SweepExpired(token string, deprecateAfterBatches int) (int, error)
+	// CountByToken summarizes the outstanding challenges of every token.
+	CountByToken() (map[string]ChallengeStats, error)
+	// Owner finds the token challengeBase64 is outstanding under, to tell a challenge submitted with another token
+	// apart from an unknown or expired one. Stores keep a challenge -> token index for it, which Put, Consume,
+	// SweepExpired and Purge keep in step with the challenges, so it never holds more than the outstanding challenges.
+	Owner(challengeBase64 string) (token string, found bool, err error)
+	// Purge removes every challenge of token. found is false when the store knows nothing about token.
+	Purge(token string) (removed int, found bool, err error)
+	Close() error
+}
+
+func newChallengeStore(storeConfig ChallengeStoreConfig, redisConfig RedisConfig) (ChallengeStore, error) {
+	switch storeConfig.Type {
+	case "", "memory":
+		return newMemoryChallengeStore(), nil
+	case "bolt":
+		return newBoltChallengeStore(storeConfig.Path)
+	case "redis":
+		return newRedisChallengeStore(redisConfig, time.Duration(storeConfig.TTLSeconds)*time.Second)
+	default:
+		return nil, fmt.Errorf("unknown challenge_store type '%s', expected 'memory', 'bolt' or 'redis'", storeConfig.Type)
+	}
+}
+
+type memoryChallengeStore struct {
+	currentGeneration map[string]int
+	challenges        map[string]map[string]int
+	// challenge -> token it was issued to, for Owner
+	owners map[string]string
+	mu     sync.RWMutex
+}
+
+func newMemoryChallengeStore() *memoryChallengeStore {
+	return &memoryChallengeStore{
+		currentGeneration: map[string]int{},
+		challenges:        map[string]map[string]int{},
+		owners:            map[string]string{},
+	}
+}
+
+// removeOwner drops challengeBase64 from the owner index, unless it was since issued to another token.
+func (store *memoryChallengeStore) removeOwner(token, challengeBase64 string) {
+	if store.owners[challengeBase64] == token {
+		delete(store.owners, challengeBase64)
+	}
+}
+
+func (store *memoryChallengeStore) Put(token string, challengeBase64s []string, deprecateAfterBatches int) (int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if _, has := store.challenges[token]; !has {
+		store.challenges[token] = map[string]int{}
+	}
+	store.currentGeneration[token]++
+	generation := store.currentGeneration[token]
+	tokenChallenges := store.challenges[token]
+	for _, challengeBase64 := range challengeBase64s {
+		tokenChallenges[challengeBase64] = generation
+		store.owners[challengeBase64] = token
+	}
+	store.sweepExpired(token, deprecateAfterBatches)
+	return generation, nil
+}
+
+func (store *memoryChallengeStore) Consume(token, challengeBase64 string) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	tokenChallenges, hasAnyChallenges := store.challenges[token]
+	_, hasChallenge := tokenChallenges[challengeBase64]
+	if !hasAnyChallenges || !hasChallenge {
+		return false, nil
+	}
+	delete(tokenChallenges, challengeBase64)
+	store.removeOwner(token, challengeBase64)
+	return true, nil
+}
+
+func (store *memoryChallengeStore) SweepExpired(token string, deprecateAfterBatches int) (int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.sweepExpired(token, deprecateAfterBatches), nil
+}
+
+// sweepExpired does the work of SweepExpired, the caller holds store.mu.
+func (store *memoryChallengeStore) sweepExpired(token string, deprecateAfterBatches int) int {
+	currentGeneration := store.currentGeneration[token]
+	removed := 0
+	for k, generation := range store.challenges[token] {
+		if generation+deprecateAfterBatches < currentGeneration {
+			delete(store.challenges[token], k)
+			store.removeOwner(token, k)
+			removed++
+		}
+	}
+	return removed
+}
+
+func (store *memoryChallengeStore) Owner(challengeBase64 string) (string, bool, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	token, found := store.owners[challengeBase64]
+	return token, found, nil
+}
+
+func (store *memoryChallengeStore) CountByToken() (map[string]ChallengeStats, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	output := map[string]ChallengeStats{}
+	for token, tokenChallenges := range store.challenges {
+		stats := ChallengeStats{
+			Count:             len(tokenChallenges),
+			CurrentGeneration: store.currentGeneration[token],
+		}
+		for _, generation := range tokenChallenges {
+			if stats.OldestGeneration == 0 || generation < stats.OldestGeneration {
+				stats.OldestGeneration = generation
+			}
+		}
+		output[token] = stats
+	}
+	return output, nil
+}
+
+func (store *memoryChallengeStore) Purge(token string) (int, bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	tokenChallenges, has := store.challenges[token]
+	if !has {
+		return 0, false, nil
+	}
+	for challengeBase64 := range tokenChallenges {
+		store.removeOwner(token, challengeBase64)
+	}
+	delete(store.challenges, token)
+	delete(store.currentGeneration, token)
+	return len(tokenChallenges), true, nil
+}
+
+func (store *memoryChallengeStore) Close() error {
+	return nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/binary"
+	"time"
+
+	errors "git.sequentialread.com/forest/pkg-errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+var boltGenerationsBucket = []byte("generations")
+var boltChallengesBucket = []byte("challenges")
+var boltOwnersBucket = []byte("owners")
+
+// how long opening the bolt file waits for another process to release its lock
+var boltOpenTimeout = 5 * time.Second
+
+// boltChallengeStore keeps the challenges of one powdet instance in a bbolt file so they survive restarts.
+// Layout: generations/<token> = current generation, challenges/<token>/<challenge> = generation,
+// owners/<challenge> = token, the index Owner uses.
+type boltChallengeStore struct {
+	db *bolt.DB
+}
+
+func newBoltChallengeStore(path string) (*boltChallengeStore, error) {
+	if path == "" {
+		return nil, errors.New("challenge_store.path is required when challenge_store.type is 'bolt'")
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: boltOpenTimeout})
+	if err == bolt.ErrTimeout {
+		return nil, errors.Errorf("can't open bolt challenge store %s: another process holds its lock", path)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't open bolt challenge store %s", path)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltGenerationsBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(boltChallengesBucket); err != nil {
+			return err
+		}
+		if tx.Bucket(boltOwnersBucket) != nil {
+			return nil
+		}
+		// files written before the owners index existed get it built from the challenges they hold
+		owners, err := tx.CreateBucket(boltOwnersBucket)
+		if err != nil {
+			return err
+		}
+		challenges := tx.Bucket(boltChallengesBucket)
+		return challenges.ForEach(func(token, _ []byte) error {
+			tokenChallenges := challenges.Bucket(token)
+			if tokenChallenges == nil {
+				return nil
+			}
+			return tokenChallenges.ForEach(func(challengeBase64, _ []byte) error {
+				// bolt keeps the key and value until the commit, copy them out of the page they were read from
+				return owners.Put(append([]byte{}, challengeBase64...), append([]byte{}, token...))
+			})
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrapf(err, "can't create buckets in bolt challenge store %s", path)
+	}
+	return &boltChallengeStore{db: db}, nil
+}
+
+func encodeGeneration(generation int) []byte {
+	generationBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(generationBytes, uint64(generation))
+	return generationBytes
+}
+
+func decodeGeneration(generationBytes []byte) int {
+	if len(generationBytes) != 8 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(generationBytes))
+}
+
+// removeBoltOwner drops challengeBase64 from the owner index, unless it was since issued to another token.
+func removeBoltOwner(tx *bolt.Tx, token, challengeBase64 []byte) error {
+	owners := tx.Bucket(boltOwnersBucket)
+	if string(owners.Get(challengeBase64)) != string(token) {
+		return nil
+	}
+	return owners.Delete(challengeBase64)
+}
+
+func (store *boltChallengeStore) Put(token string, challengeBase64s []string, deprecateAfterBatches int) (int, error) {
+	generation := 0
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		generations := tx.Bucket(boltGenerationsBucket)
+		generation = decodeGeneration(generations.Get([]byte(token))) + 1
+		if err := generations.Put([]byte(token), encodeGeneration(generation)); err != nil {
+			return err
+		}
+		tokenChallenges, err := tx.Bucket(boltChallengesBucket).CreateBucketIfNotExists([]byte(token))
+		if err != nil {
+			return err
+		}
+		owners := tx.Bucket(boltOwnersBucket)
+		generationBytes := encodeGeneration(generation)
+		for _, challengeBase64 := range challengeBase64s {
+			if err := tokenChallenges.Put([]byte(challengeBase64), generationBytes); err != nil {
+				return err
+			}
+			if err := owners.Put([]byte(challengeBase64), []byte(token)); err != nil {
+				return err
+			}
+		}
+		_, err = sweepExpiredBolt(tx, token, deprecateAfterBatches)
+		return err
+	})
+	return generation, err
+}
+
+func (store *boltChallengeStore) Consume(token, challengeBase64 string) (bool, error) {
+	consumed := false
+	// bolt only allows one write transaction at a time, which makes this check-and-delete atomic
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		tokenChallenges := tx.Bucket(boltChallengesBucket).Bucket([]byte(token))
+		if tokenChallenges == nil || tokenChallenges.Get([]byte(challengeBase64)) == nil {
+			return nil
+		}
+		consumed = true
+		if err := tokenChallenges.Delete([]byte(challengeBase64)); err != nil {
+			return err
+		}
+		return removeBoltOwner(tx, []byte(token), []byte(challengeBase64))
+	})
+	return consumed, err
+}
+
+func (store *boltChallengeStore) SweepExpired(token string, deprecateAfterBatches int) (int, error) {
+	removed := 0
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		removed, err = sweepExpiredBolt(tx, token, deprecateAfterBatches)
+		return err
+	})
+	return removed, err
+}
+
+// sweepExpiredBolt does the work of SweepExpired inside the write transaction tx.
+func sweepExpiredBolt(tx *bolt.Tx, token string, deprecateAfterBatches int) (int, error) {
+	tokenChallenges := tx.Bucket(boltChallengesBucket).Bucket([]byte(token))
+	if tokenChallenges == nil {
+		return 0, nil
+	}
+	currentGeneration := decodeGeneration(tx.Bucket(boltGenerationsBucket).Get([]byte(token)))
+	// deleting while iterating a bolt cursor skips keys, so collect them first
+	toRemove := [][]byte{}
+	err := tokenChallenges.ForEach(func(k, v []byte) error {
+		if decodeGeneration(v)+deprecateAfterBatches < currentGeneration {
+			toRemove = append(toRemove, append([]byte{}, k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, k := range toRemove {
+		if err := tokenChallenges.Delete(k); err != nil {
+			return 0, err
+		}
+		if err := removeBoltOwner(tx, []byte(token), k); err != nil {
+			return 0, err
+		}
+	}
+	return len(toRemove), nil
+}
+
+func (store *boltChallengeStore) Owner(challengeBase64 string) (string, bool, error) {
+	owner, found := "", false
+	err := store.db.View(func(tx *bolt.Tx) error {
+		if token := tx.Bucket(boltOwnersBucket).Get([]byte(challengeBase64)); token != nil {
+			owner, found = string(token), true
+		}
+		return nil
+	})
+	return owner, found, err
+}
+
+func (store *boltChallengeStore) CountByToken() (map[string]ChallengeStats, error) {
+	output := map[string]ChallengeStats{}
+	err := store.db.View(func(tx *bolt.Tx) error {
+		generations := tx.Bucket(boltGenerationsBucket)
+		return tx.Bucket(boltChallengesBucket).ForEach(func(token, _ []byte) error {
+			tokenChallenges := tx.Bucket(boltChallengesBucket).Bucket(token)
+			if tokenChallenges == nil {
+				return nil
+			}
+			stats := ChallengeStats{CurrentGeneration: decodeGeneration(generations.Get(token))}
+			err := tokenChallenges.ForEach(func(_, v []byte) error {
+				generation := decodeGeneration(v)
+				stats.Count++
+				if stats.OldestGeneration == 0 || generation < stats.OldestGeneration {
+					stats.OldestGeneration = generation
+				}
+				return nil
+			})
+			output[string(token)] = stats
+			return err
+		})
+	})
+	return output, err
+}
+
+func (store *boltChallengeStore) Purge(token string) (int, bool, error) {
+	removed, found := 0, false
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		tokenChallenges := tx.Bucket(boltChallengesBucket).Bucket([]byte(token))
+		if tokenChallenges == nil {
+			return nil
+		}
+		found = true
+		removed = tokenChallenges.Stats().KeyN
+		err := tokenChallenges.ForEach(func(challengeBase64, _ []byte) error {
+			return removeBoltOwner(tx, []byte(token), challengeBase64)
+		})
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltChallengesBucket).DeleteBucket([]byte(token)); err != nil {
+			return err
+		}
+		return tx.Bucket(boltGenerationsBucket).Delete([]byte(token))
+	})
+	return removed, found, err
+}
+
+func (store *boltChallengeStore) Close() error {
+	return store.db.Close()
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestConcurrentGetChallengesAndVerify(t *testing.T) {
+	setupTest(t, `{"deprecate_after_batches": 1000}`)
+	token := createTestToken(t, "a")
+
+	const workers = 8
+	const batchesPerWorker = 5
+	var waitGroup sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for i := 0; i < batchesPerWorker; i++ {
+				challenges, err := requestTestChallenges(token, "difficultyLevel=1")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				nonce, err := solveChallenge(challenges[0])
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				response := serveTestRequest(newTestRequest("POST", "/Verify?challenge="+challenges[0]+"&nonce="+nonce, token, ""))
+				if response.Code != 200 {
+					t.Errorf("/Verify returned %d: %s", response.Code, response.Body.String())
+				}
+			}
+		}()
+	}
+	waitGroup.Wait()
+
+	if ok := metricValue("verify_ok"); ok != workers*batchesPerWorker {
+		t.Errorf("verify_ok is %d, want %d", ok, workers*batchesPerWorker)
+	}
+	countByToken, err := challengeStore.CountByToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ChallengeStats{Count: workers * batchesPerWorker * 4, CurrentGeneration: workers * batchesPerWorker, OldestGeneration: 1}
+	if countByToken[token] != want {
+		t.Errorf("the store holds %+v, want %+v", countByToken[token], want)
+	}
+}
+
+func TestConcurrentVerifyOfOneChallenge(t *testing.T) {
+	setupTest(t, "")
+	token := createTestToken(t, "a")
+	challenges := getTestChallenges(t, token, "difficultyLevel=1")
+	nonce := solveTestChallenge(t, challenges[0])
+
+	var waitGroup sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			verifyChallenge(token, challenges[0], nonce, "")
+		}()
+	}
+	waitGroup.Wait()
+
+	if ok := metricValue("verify_ok"); ok != 1 {
+		t.Errorf("the same challenge verified %d times, want once", ok)
+	}
+	if notFound := metricValue("verify_not_found"); notFound != 15 {
+		t.Errorf("verify_not_found is %d, want 15", notFound)
+	}
+}
+
+// deprecateAfterBatches for the Puts of tests that don't want anything swept
+const testKeepAllBatches = 1000
+
+// testChallengeStoreTypes opens an empty store of every type, so the same tests run against each of them.
+var testChallengeStoreTypes = []struct {
+	name string
+	open func(t *testing.T) ChallengeStore
+}{
+	{name: "memory", open: func(t *testing.T) ChallengeStore { return newMemoryChallengeStore() }},
+	{name: "bolt", open: func(t *testing.T) ChallengeStore {
+		store, err := newBoltChallengeStore(filepath.Join(t.TempDir(), "challenges.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.Close() })
+		return store
+	}},
+	{name: "redis", open: func(t *testing.T) ChallengeStore {
+		return newTestRedisChallengeStore(t, miniredis.RunT(t).Addr())
+	}},
+}
+
+func TestChallengeStores(t *testing.T) {
+	for _, storeType := range testChallengeStoreTypes {
+		t.Run(storeType.name, func(t *testing.T) { testChallengeStore(t, storeType.open(t)) })
+	}
+}
+
+// testChallengeStore runs an empty store through every method, it is shared with the redis integration test.
+func testChallengeStore(t *testing.T, store ChallengeStore) {
+	puts := []struct {
+		token          string
+		challenges     []string
+		wantGeneration int
+	}{
+		{token: "a", challenges: []string{"c1", "c2"}, wantGeneration: 1},
+		{token: "a", challenges: []string{"c3"}, wantGeneration: 2},
+		{token: "b", challenges: []string{"c4"}, wantGeneration: 1},
+	}
+	for _, put := range puts {
+		generation, err := store.Put(put.token, put.challenges, testKeepAllBatches)
+		if err != nil || generation != put.wantGeneration {
+			t.Fatalf("Put(%s, %v) = %d, %v, want generation %d", put.token, put.challenges, generation, err, put.wantGeneration)
+		}
+	}
+
+	consumes := []struct {
+		token     string
+		challenge string
+		want      bool
+	}{
+		{token: "b", challenge: "c1", want: false},
+		{token: "a", challenge: "c1", want: true},
+		{token: "a", challenge: "c1", want: false},
+		{token: "a", challenge: "missing", want: false},
+		{token: "missing", challenge: "c4", want: false},
+	}
+	for _, consume := range consumes {
+		consumed, err := store.Consume(consume.token, consume.challenge)
+		if err != nil || consumed != consume.want {
+			t.Errorf("Consume(%s, %s) = %t, %v, want %t", consume.token, consume.challenge, consumed, err, consume.want)
+		}
+	}
+
+	if owner, found, err := store.Owner("c2"); err != nil || !found || owner != "a" {
+		t.Errorf("Owner(c2) = %s, %t, %v, want a", owner, found, err)
+	}
+	if _, found, err := store.Owner("c1"); err != nil || found {
+		t.Errorf("Owner of a consumed challenge = %t, %v, want not found", found, err)
+	}
+
+	wantCounts := map[string]ChallengeStats{
+		"a": {Count: 2, CurrentGeneration: 2, OldestGeneration: 1},
+		"b": {Count: 1, CurrentGeneration: 1, OldestGeneration: 1},
+	}
+	if counts, err := store.CountByToken(); err != nil || !reflect.DeepEqual(counts, wantCounts) {
+		t.Errorf("CountByToken() = %+v, %v, want %+v", counts, err, wantCounts)
+	}
+
+	if removed, err := store.SweepExpired("a", 0); err != nil || removed != 1 {
+		t.Errorf("SweepExpired(a, 0) = %d, %v, want 1", removed, err)
+	}
+	if consumed, _ := store.Consume("a", "c2"); consumed {
+		t.Error("a swept challenge could still be consumed")
+	}
+	if _, found, err := store.Owner("c2"); err != nil || found {
+		t.Errorf("Owner of a swept challenge = %t, %v, want not found", found, err)
+	}
+
+	if removed, found, err := store.Purge("a"); err != nil || !found || removed != 1 {
+		t.Errorf("Purge(a) = %d, %t, %v, want 1, true", removed, found, err)
+	}
+	if _, found, err := store.Purge("a"); err != nil || found {
+		t.Errorf("second Purge(a) = %t, %v, want not found", found, err)
+	}
+	if consumed, _ := store.Consume("a", "c3"); consumed {
+		t.Error("a purged challenge could still be consumed")
+	}
+	if _, found, err := store.Owner("c3"); err != nil || found {
+		t.Errorf("Owner of a purged challenge = %t, %v, want not found", found, err)
+	}
+	if owner, found, err := store.Owner("c4"); err != nil || !found || owner != "b" {
+		t.Errorf("Owner(c4) after purging a = %s, %t, %v, want b", owner, found, err)
+	}
+	if consumed, _ := store.Consume("b", "c4"); !consumed {
+		t.Error("purging a also removed the challenges of b")
+	}
+
+	// Put sweeps the batches that fall out of deprecateAfterBatches itself
+	store.Put("c", []string{"c5"}, 0)
+	if generation, err := store.Put("c", []string{"c6"}, 0); err != nil || generation != 2 {
+		t.Errorf("Put(c, [c6], 0) = %d, %v, want generation 2", generation, err)
+	}
+	if _, found, err := store.Owner("c5"); err != nil || found {
+		t.Errorf("Owner of a challenge swept by Put = %t, %v, want not found", found, err)
+	}
+	if consumed, _ := store.Consume("c", "c5"); consumed {
+		t.Error("a challenge swept by Put could still be consumed")
+	}
+	if consumed, _ := store.Consume("c", "c6"); !consumed {
+		t.Error("Put swept the batch it just stored")
+	}
+}
+
+// Concurrent batches of one token must not leave an older batch behind the sweep,
+// whatever order their generations, writes and sweeps run in.
+func TestConcurrentPutsSweepConsistently(t *testing.T) {
+	for _, storeType := range testChallengeStoreTypes {
+		t.Run(storeType.name, func(t *testing.T) {
+			store := storeType.open(t)
+			const workers = 8
+			const batchesPerWorker = 10
+			const deprecateAfterBatches = 1
+			var mu sync.Mutex
+			batches := map[int][]string{}
+			var waitGroup sync.WaitGroup
+			for worker := 0; worker < workers; worker++ {
+				waitGroup.Add(1)
+				go func(worker int) {
+					defer waitGroup.Done()
+					for i := 0; i < batchesPerWorker; i++ {
+						batch := []string{fmt.Sprintf("w%d-b%d-x", worker, i), fmt.Sprintf("w%d-b%d-y", worker, i)}
+						generation, err := store.Put("a", batch, deprecateAfterBatches)
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						mu.Lock()
+						batches[generation] = batch
+						mu.Unlock()
+					}
+				}(worker)
+			}
+			waitGroup.Wait()
+
+			const lastGeneration = workers * batchesPerWorker
+			if len(batches) != lastGeneration {
+				t.Fatalf("%d batches got distinct generations, want %d", len(batches), lastGeneration)
+			}
+			want := ChallengeStats{Count: 4, CurrentGeneration: lastGeneration, OldestGeneration: lastGeneration - 1}
+			if counts, err := store.CountByToken(); err != nil || counts["a"] != want {
+				t.Errorf("CountByToken() = %+v, %v, want %+v", counts["a"], err, want)
+			}
+			for generation, batch := range batches {
+				wantConsumed := generation+deprecateAfterBatches >= lastGeneration
+				for _, challenge := range batch {
+					if consumed, err := store.Consume("a", challenge); err != nil || consumed != wantConsumed {
+						t.Errorf("Consume of %s from generation %d = %t, %v, want %t", challenge, generation, consumed, err, wantConsumed)
+					}
+				}
+			}
+		})
+	}
+}
+
+// the owner index must only hold outstanding challenges, whichever way they go away
+func TestMemoryChallengeStoreOwnerIndexIsBounded(t *testing.T) {
+	store := newMemoryChallengeStore()
+	for i := 0; i < 10; i++ {
+		batch := testChallengeBatch(100)
+		for j := range batch {
+			batch[j] += fmt.Sprintf("-batch-%d", i)
+		}
+		if _, err := store.Put("a", batch, 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Put("b", []string{"b1", "b2"}, testKeepAllBatches)
+	store.Consume("b", "b1")
+	// the last 3 batches of a and one challenge of b are outstanding
+	if len(store.owners) != 301 {
+		t.Errorf("the owner index holds %d challenges, want the 301 outstanding ones", len(store.owners))
+	}
+	store.Purge("a")
+	store.Consume("b", "b2")
+	if len(store.owners) != 0 {
+		t.Errorf("the owner index still holds %d challenges after all were purged or consumed", len(store.owners))
+	}
+}
+
+// bolt files written before the owner index existed get it built when they are opened
+func TestBoltChallengeStoreBuildsOwnerIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "challenges.db")
+	store, err := newBoltChallengeStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Put("a", []string{"c1"}, testKeepAllBatches); err != nil {
+		t.Fatal(err)
+	}
+	err = store.db.Update(func(tx *bolt.Tx) error { return tx.DeleteBucket(boltOwnersBucket) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store, err = newBoltChallengeStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if owner, found, err := store.Owner("c1"); err != nil || !found || owner != "a" {
+		t.Errorf("Owner(c1) after reopening = %s, %t, %v, want a", owner, found, err)
+	}
+}
+
+func TestBoltChallengeStoreSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "challenges.db")
+	store, err := newBoltChallengeStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Put("a", []string{"c1", "c2"}, testKeepAllBatches); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store, err = newBoltChallengeStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if consumed, err := store.Consume("a", "c1"); err != nil || !consumed {
+		t.Errorf("Consume after reopening = %t, %v, want true", consumed, err)
+	}
+	if generation, err := store.Put("a", []string{"c3"}, testKeepAllBatches); err != nil || generation != 2 {
+		t.Errorf("Put after reopening = %d, %v, want generation 2", generation, err)
+	}
+}
+
+// a second process opening the same bolt file has to fail instead of waiting forever
+func TestBoltChallengeStoreLockedFile(t *testing.T) {
+	oldTimeout := boltOpenTimeout
+	boltOpenTimeout = 100 * time.Millisecond
+	defer func() { boltOpenTimeout = oldTimeout }()
+
+	path := filepath.Join(t.TempDir(), "challenges.db")
+	store, err := newBoltChallengeStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	_, err = newBoltChallengeStore(path)
+	if err == nil || !strings.Contains(err.Error(), "another process holds its lock") {
+		t.Errorf("opening a locked bolt file returned %v, want a lock error", err)
+	}
+}
+
+func testChallengeBatch(size int) []string {
+	batch := make([]string, size)
+	for i := range batch {
+		batch[i] = fmt.Sprintf("challenge-%d", i)
+	}
+	return batch
+}
+
+// BenchmarkChallengeInsert compares storing a batch under one lock, which memoryChallengeStore.Put does,
+// with taking the lock once per challenge like /GetChallenges used to.
+func BenchmarkChallengeInsert(b *testing.B) {
+	batch := testChallengeBatch(1000)
+	b.Run("one lock per batch", func(b *testing.B) {
+		store := newMemoryChallengeStore()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				store.Put("token", batch, 10)
+			}
+		})
+	})
+	b.Run("one lock per challenge", func(b *testing.B) {
+		store := newMemoryChallengeStore()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				store.mu.Lock()
+				store.currentGeneration["token"]++
+				generation := store.currentGeneration["token"]
+				if _, has := store.challenges["token"]; !has {
+					store.challenges["token"] = map[string]int{}
+				}
+				store.mu.Unlock()
+				for _, challengeBase64 := range batch {
+					store.mu.Lock()
+					store.challenges["token"][challengeBase64] = generation
+					store.owners[challengeBase64] = "token"
+					store.mu.Unlock()
+				}
+				store.SweepExpired("token", 10)
+			}
+		})
+	})
+}
+
+func BenchmarkGetChallenges(b *testing.B) {
+	setupTest(b, `{"batch_size": 1000}`)
+	token := createTestToken(b, "a")
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			serveTestRequest(newTestRequest("POST", "/GetChallenges?difficultyLevel=1", token, ""))
+		}
+	})
+}
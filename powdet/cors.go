@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// corsAllowedOrigin returns the Access-Control-Allow-Origin value for origin, or "" if origin isn't allowed.
+func corsAllowedOrigin(currentConfig Config, origin string) string {
+	if origin == "" {
+		return ""
+	}
+	for _, allowedOrigin := range currentConfig.CORSAllowedOrigins {
+		if allowedOrigin == "*" {
+			return "*"
+		}
+		if strings.EqualFold(strings.TrimSuffix(allowedOrigin, "/"), origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// applyCORS sets the CORS headers for requests from an origin in cors_allowed_origins and answers preflight requests.
+// It returns true when the request was a preflight and has been fully handled.
+// Requests from other origins get no CORS headers at all, so the browser blocks them.
+func applyCORS(responseWriter http.ResponseWriter, request *http.Request, allowedMethods string) bool {
+	currentConfig, _ := currentConfiguration()
+	if len(currentConfig.CORSAllowedOrigins) == 0 {
+		return false
+	}
+
+	responseWriter.Header().Add("Vary", "Origin")
+	allowedOrigin := corsAllowedOrigin(currentConfig, request.Header.Get("Origin"))
+	if allowedOrigin == "" {
+		return false
+	}
+	responseWriter.Header().Set("Access-Control-Allow-Origin", allowedOrigin)
+	// loadConfiguration rejects cors_allow_credentials together with "*"
+	if currentConfig.CORSAllowCredentials {
+		responseWriter.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	if request.Method == http.MethodOptions && request.Header.Get("Access-Control-Request-Method") != "" {
+		responseWriter.Header().Set("Access-Control-Allow-Methods", allowedMethods+", OPTIONS")
+		responseWriter.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		responseWriter.Header().Set("Access-Control-Max-Age", "600")
+		responseWriter.WriteHeader(http.StatusNoContent)
+		return true
+	}
+	return false
+}
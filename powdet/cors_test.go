@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	testCases := []struct {
+		name            string
+		configJSON      string
+		method          string
+		path            string
+		origin          string
+		preflight       bool
+		wantStatus      int
+		wantAllowOrigin string
+		wantMethods     string
+	}{
+		{
+			name:        "static preflight",
+			configJSON:  `{"cors_allowed_origins": ["https://example.com"]}`,
+			method:      "OPTIONS",
+			path:        "/powdet/static/pow-bot-deterrent.js",
+			origin:      "https://example.com",
+			preflight:   true,
+			wantStatus:  http.StatusNoContent,
+			wantMethods: "GET, HEAD, OPTIONS", wantAllowOrigin: "https://example.com",
+		},
+		{
+			name:            "static GET from an allowed origin",
+			configJSON:      `{"cors_allowed_origins": ["https://example.com/"]}`,
+			method:          "GET",
+			path:            "/powdet/static/pow-bot-deterrent.js",
+			origin:          "https://EXAMPLE.com",
+			wantStatus:      http.StatusOK,
+			wantAllowOrigin: "https://EXAMPLE.com",
+		},
+		{
+			name:       "static GET from another origin",
+			configJSON: `{"cors_allowed_origins": ["https://example.com"]}`,
+			method:     "GET",
+			path:       "/powdet/static/pow-bot-deterrent.js",
+			origin:     "https://evil.example",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:            "wildcard origin",
+			configJSON:      `{"cors_allowed_origins": ["*"]}`,
+			method:          "GET",
+			path:            "/powdet/static/pow-bot-deterrent.js",
+			origin:          "https://anything.example",
+			wantStatus:      http.StatusOK,
+			wantAllowOrigin: "*",
+		},
+		{
+			name:        "API preflight with cors_api_endpoints",
+			configJSON:  `{"cors_allowed_origins": ["https://example.com"], "cors_api_endpoints": true}`,
+			method:      "OPTIONS",
+			path:        "/GetChallenges",
+			origin:      "https://example.com",
+			preflight:   true,
+			wantStatus:  http.StatusNoContent,
+			wantMethods: "POST, OPTIONS", wantAllowOrigin: "https://example.com",
+		},
+		{
+			name:       "API preflight from another origin",
+			configJSON: `{"cors_allowed_origins": ["https://example.com"], "cors_api_endpoints": true}`,
+			method:     "OPTIONS",
+			path:       "/Verify",
+			origin:     "https://evil.example",
+			preflight:  true,
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:       "API endpoints without cors_api_endpoints",
+			configJSON: `{"cors_allowed_origins": ["https://example.com"]}`,
+			method:     "OPTIONS",
+			path:       "/GetChallenges",
+			origin:     "https://example.com",
+			preflight:  true,
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			setupTest(t, testCase.configJSON)
+			request := newTestRequest(testCase.method, testCase.path, "", "")
+			request.Header.Set("Origin", testCase.origin)
+			if testCase.preflight {
+				request.Header.Set("Access-Control-Request-Method", "POST")
+			}
+			response := serveTestRequest(request)
+			if response.Code != testCase.wantStatus {
+				t.Fatalf("%s %s returned %d, want %d", testCase.method, testCase.path, response.Code, testCase.wantStatus)
+			}
+			if allowOrigin := response.Header().Get("Access-Control-Allow-Origin"); allowOrigin != testCase.wantAllowOrigin {
+				t.Errorf("Access-Control-Allow-Origin is %q, want %q", allowOrigin, testCase.wantAllowOrigin)
+			}
+			if testCase.wantAllowOrigin == "" {
+				for name := range response.Header() {
+					if strings.HasPrefix(name, "Access-Control-") {
+						t.Errorf("a request from a disallowed origin got the CORS header %s", name)
+					}
+				}
+				return
+			}
+			if methods := response.Header().Get("Access-Control-Allow-Methods"); methods != testCase.wantMethods {
+				t.Errorf("Access-Control-Allow-Methods is %q, want %q", methods, testCase.wantMethods)
+			}
+			if testCase.preflight && !strings.Contains(response.Header().Get("Access-Control-Allow-Headers"), "Authorization") {
+				t.Errorf("Access-Control-Allow-Headers %q doesn't allow Authorization", response.Header().Get("Access-Control-Allow-Headers"))
+			}
+		})
+	}
+}
+
+func TestCORSAllowCredentials(t *testing.T) {
+	setupTest(t, `{"cors_allowed_origins": ["https://example.com"], "cors_allow_credentials": true, "cors_api_endpoints": true}`)
+	token := createTestToken(t, "a")
+	request := newTestRequest("POST", "/GetChallenges?difficultyLevel=1", token, "")
+	request.Header.Set("Origin", "https://example.com")
+	response := serveTestRequest(request)
+	if response.Code != http.StatusOK {
+		t.Fatalf("/GetChallenges returned %d: %s", response.Code, response.Body.String())
+	}
+	if response.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Errorf("Access-Control-Allow-Credentials is %q, want true", response.Header().Get("Access-Control-Allow-Credentials"))
+	}
+	if response.Header().Get("Access-Control-Allow-Origin") != "https://example.com" {
+		t.Errorf("Access-Control-Allow-Origin is %q", response.Header().Get("Access-Control-Allow-Origin"))
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// registerDebugHandlers exposes pprof and runtime stats behind requireAdmin.
+// Importing net/http/pprof also registers its handlers on http.DefaultServeMux, which is why powdet serves serveMux instead.
+func registerDebugHandlers(requireAdmin func(http.ResponseWriter, *http.Request) bool) {
+	requireDebugEnabled := func(responseWriter http.ResponseWriter, request *http.Request) bool {
+		currentConfig, _ := currentConfiguration()
+		if !currentConfig.EnableDebugEndpoints {
+			http.NotFound(responseWriter, request)
+			return true
+		}
+		return false
+	}
+
+	pprofHandlers := map[string]http.HandlerFunc{
+		"/debug/pprof/":        pprof.Index,
+		"/debug/pprof/cmdline": pprof.Cmdline,
+		"/debug/pprof/profile": pprof.Profile,
+		"/debug/pprof/symbol":  pprof.Symbol,
+		"/debug/pprof/trace":   pprof.Trace,
+	}
+	for path, pprofHandler := range pprofHandlers {
+		pprofHandler := pprofHandler
+		if path == "/debug/pprof/profile" || path == "/debug/pprof/trace" {
+			pprofHandler = extendWriteDeadline(pprofHandler)
+		}
+		myHTTPHandleFunc(path, requireDebugEnabled, requireAdmin, func(responseWriter http.ResponseWriter, request *http.Request) bool {
+			pprofHandler(responseWriter, request)
+			return true
+		})
+	}
+
+	myHTTPHandleFunc("/debug/stats", requireDebugEnabled, requireAdmin, func(responseWriter http.ResponseWriter, request *http.Request) bool {
+		var memStats runtime.MemStats
+		runtime.ReadMemStats(&memStats)
+
+		challengeCount := 0
+		countByToken, err := challengeStore.CountByToken()
+		if err != nil {
+			log.Printf("failed to count the outstanding challenges: %v", err)
+		}
+		for _, stats := range countByToken {
+			challengeCount += stats.Count
+		}
+
+		tokenRecords, err := tokenStore.List()
+		if err != nil {
+			log.Printf("failed to list the API tokens: %v", err)
+		}
+		tokenCount := len(tokenRecords)
+
+		responseBytes, err := json.Marshal(map[string]interface{}{
+			"heapAllocBytes":  memStats.HeapAlloc,
+			"heapInuseBytes":  memStats.HeapInuse,
+			"heapObjects":     memStats.HeapObjects,
+			"sysBytes":        memStats.Sys,
+			"numGC":           memStats.NumGC,
+			"pauseTotalNs":    memStats.PauseTotalNs,
+			"goroutines":      runtime.NumGoroutine(),
+			"challengeCount":  challengeCount,
+			"tokenCount":      tokenCount,
+			"challengeTokens": len(countByToken),
+		})
+		if err != nil {
+			log.Printf("json marshal failed: %v", err)
+			http.Error(responseWriter, "500 internal server error", http.StatusInternalServerError)
+			return true
+		}
+
+		responseWriter.Header().Set("Content-Type", "application/json")
+		responseWriter.Write(responseBytes)
+		return true
+	})
+}
+
+// extendWriteDeadline lets profile and trace stream for ?seconds= even when that is longer than write_timeout_seconds.
+// pprof refuses durations past the server's WriteTimeout, so the handler doesn't get to see the server.
+func extendWriteDeadline(handler http.HandlerFunc) http.HandlerFunc {
+	return func(responseWriter http.ResponseWriter, request *http.Request) {
+		currentConfig, _ := currentConfiguration()
+		seconds, err := strconv.ParseFloat(request.FormValue("seconds"), 64)
+		if err != nil || seconds <= 0 {
+			// the longer of the pprof defaults, 30 for profile and 1 for trace
+			seconds = 30
+		}
+		writeTimeout := time.Duration(seconds*float64(time.Second)) + time.Duration(currentConfig.WriteTimeoutSeconds)*time.Second
+		err = http.NewResponseController(responseWriter).SetWriteDeadline(time.Now().Add(writeTimeout))
+		if err != nil && !errors.Is(err, http.ErrNotSupported) {
+			log.Printf("failed to extend the write deadline of %s: %v", request.URL.Path, err)
+		}
+		handler(responseWriter, request.WithContext(context.WithValue(request.Context(), http.ServerContextKey, nil)))
+	}
+}
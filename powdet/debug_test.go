@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDebugEndpoints(t *testing.T) {
+	paths := []string{"/debug/stats", "/debug/pprof/", "/debug/pprof/cmdline"}
+	testCases := []struct {
+		name       string
+		enabled    bool
+		bearer     string
+		wantStatus int
+	}{
+		{name: "disabled without a token", enabled: false, bearer: "", wantStatus: http.StatusNotFound},
+		{name: "disabled with the admin token", enabled: false, bearer: testAdminToken, wantStatus: http.StatusNotFound},
+		{name: "enabled without a token", enabled: true, bearer: "", wantStatus: http.StatusUnauthorized},
+		{name: "enabled with an API token", enabled: true, bearer: "api", wantStatus: http.StatusUnauthorized},
+		{name: "enabled with the admin token", enabled: true, bearer: testAdminToken, wantStatus: http.StatusOK},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			setupTest(t, fmt.Sprintf(`{"enable_debug_endpoints": %t}`, testCase.enabled))
+			bearer := testCase.bearer
+			if bearer == "api" {
+				bearer = createTestToken(t, "a")
+			}
+			for _, path := range paths {
+				response := serveTestRequest(newTestRequest("GET", path, bearer, ""))
+				if response.Code != testCase.wantStatus {
+					t.Errorf("GET %s returned %d, want %d", path, response.Code, testCase.wantStatus)
+				}
+			}
+		})
+	}
+}
+
+func TestDebugStats(t *testing.T) {
+	setupTest(t, `{"enable_debug_endpoints": true}`)
+	token := createTestToken(t, "a")
+	createTestToken(t, "b")
+	getTestChallenges(t, token, "difficultyLevel=1")
+
+	response := serveTestRequest(newTestRequest("GET", "/debug/stats", testAdminToken, ""))
+	if response.Code != http.StatusOK {
+		t.Fatalf("/debug/stats returned %d", response.Code)
+	}
+	stats := map[string]float64{}
+	if err := json.Unmarshal(response.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("/debug/stats returned invalid json: %v", err)
+	}
+	want := map[string]float64{"challengeCount": 5, "tokenCount": 2, "challengeTokens": 1}
+	for key, value := range want {
+		if stats[key] != value {
+			t.Errorf("%s is %v, want %v", key, stats[key], value)
+		}
+	}
+	if stats["goroutines"] < 1 || stats["heapAllocBytes"] <= 0 {
+		t.Errorf("/debug/stats is missing the runtime stats: %s", response.Body.String())
+	}
+}
+
+func TestDebugProfileOutlastsWriteTimeout(t *testing.T) {
+	setupTest(t, `{"enable_debug_endpoints": true, "write_timeout_seconds": 1}`)
+	currentConfig, _ := currentConfiguration()
+	server := httptest.NewUnstartedServer(serveMux)
+	server.Config = newHTTPServer(currentConfig, serveMux)
+	server.Start()
+	t.Cleanup(server.Close)
+
+	for _, path := range []string{"/debug/pprof/profile?seconds=1", "/debug/pprof/trace?seconds=1"} {
+		request, err := http.NewRequest("GET", server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("Authorization", "Bearer "+testAdminToken)
+		startedAt := time.Now()
+		response, err := server.Client().Do(request)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		body, err := io.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			t.Fatalf("reading %s failed after %s: %v", path, time.Since(startedAt), err)
+		}
+		if response.StatusCode != http.StatusOK || len(body) == 0 {
+			t.Errorf("GET %s returned %d with %d bytes, want 200 with the profile: %s", path, response.StatusCode, len(body), body)
+		}
+	}
+}
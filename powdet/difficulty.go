@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+)
+
+// upper bound for max_difficulty_level
+const maxDifficultyLevel = 128
+
+// difficultyTargetForLevel returns the hex string the compared end of the hash has to be less than or equal to:
+// the first level bits are 0 and the rest of the last byte is 1, e.g. level 14 is "0003".
+// Level 0 (or below) would give an empty target that every nonce satisfies, so it is an error.
+func difficultyTargetForLevel(level int) (string, error) {
+	if level < 1 || level > maxDifficultyLevel {
+		return "", fmt.Errorf("difficulty level %d must be between 1 and %d", level, maxDifficultyLevel)
+	}
+	targetBytes := make([]byte, (level+7)/8)
+	for j := 0; j < len(targetBytes); j++ {
+		targetByte := byte(0)
+		for k := 0; k < 8; k++ {
+			currentBitIndex := (j*8 + (7 - k))
+			if currentBitIndex+1 > level {
+				targetByte = targetByte | 1<<k
+			}
+		}
+		targetBytes[j] = targetByte
+	}
+	return hex.EncodeToString(targetBytes), nil
+}
+
+// validateDifficultyLevel checks level against min_difficulty_level and max_difficulty_level,
+// the error reads as the rest of a sentence starting with the parameter.
+func validateDifficultyLevel(currentConfig Config, level int) error {
+	if level < currentConfig.MinDifficultyLevel || level > currentConfig.MaxDifficultyLevel {
+		return fmt.Errorf(
+			"%d is out of range, it must be between %d and %d (inclusive)",
+			level, currentConfig.MinDifficultyLevel, currentConfig.MaxDifficultyLevel,
+		)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// difficulty stats are kept in one bucket per minute for at most this long
+const difficultyStatsMaxMinutes = 60
+
+// at most this many solve times are kept per level and minute for the median
+const difficultyStatsMaxSamples = 1000
+
+type difficultyLevelCounts struct {
+	issued       int64
+	verifiedOK   int64
+	verifiedFail int64
+	solveSeconds []float64
+}
+
+// DifficultyLevelStats is one entry of GET /Stats/Difficulty.
+type DifficultyLevelStats struct {
+	Issued       int64 `json:"issued"`
+	VerifiedOK   int64 `json:"verifiedOk"`
+	VerifiedFail int64 `json:"verifiedFail"`
+	// median time between issuance and a successful verification, null when there was none
+	MedianSolveSeconds *float64 `json:"medianSolveSeconds"`
+}
+
+// difficultyStatsRecorder aggregates issued and verified challenges per difficulty level, for the landing worker
+// to tune its difficulty with. It never changes the difficulty by itself.
+type difficultyStatsRecorder struct {
+	// unix minute -> difficulty level -> counts
+	minutes map[int64]map[int]*difficultyLevelCounts
+	mu      sync.Mutex
+}
+
+var difficultyStats = difficultyStatsRecorder{minutes: map[int64]map[int]*difficultyLevelCounts{}}
+
+// counts returns the counts of level in the current minute and drops minutes that are too old. The caller must hold mu.
+func (recorder *difficultyStatsRecorder) counts(now time.Time, level int) *difficultyLevelCounts {
+	minute := now.Unix() / 60
+	for oldMinute := range recorder.minutes {
+		if oldMinute <= minute-difficultyStatsMaxMinutes {
+			delete(recorder.minutes, oldMinute)
+		}
+	}
+	if _, has := recorder.minutes[minute]; !has {
+		recorder.minutes[minute] = map[int]*difficultyLevelCounts{}
+	}
+	if _, has := recorder.minutes[minute][level]; !has {
+		recorder.minutes[minute][level] = &difficultyLevelCounts{}
+	}
+	return recorder.minutes[minute][level]
+}
+
+func (recorder *difficultyStatsRecorder) recordIssued(level, count int) {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	recorder.counts(time.Now(), level).issued += int64(count)
+}
+
+// recordVerified counts a verification of a challenge issued at issuedAt (unix seconds, 0 when unknown).
+func (recorder *difficultyStatsRecorder) recordVerified(level int, ok bool, issuedAt int64) {
+	now := time.Now()
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	levelCounts := recorder.counts(now, level)
+	if !ok {
+		levelCounts.verifiedFail++
+		return
+	}
+	levelCounts.verifiedOK++
+	if issuedAt > 0 && len(levelCounts.solveSeconds) < difficultyStatsMaxSamples {
+		levelCounts.solveSeconds = append(levelCounts.solveSeconds, now.Sub(time.Unix(issuedAt, 0)).Seconds())
+	}
+}
+
+// snapshot sums up the last windowMinutes minutes per difficulty level.
+func (recorder *difficultyStatsRecorder) snapshot(windowMinutes int) map[int]DifficultyLevelStats {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+
+	currentMinute := time.Now().Unix() / 60
+	totals := map[int]*difficultyLevelCounts{}
+	for minute, levels := range recorder.minutes {
+		if minute <= currentMinute-int64(windowMinutes) {
+			continue
+		}
+		for level, levelCounts := range levels {
+			if _, has := totals[level]; !has {
+				totals[level] = &difficultyLevelCounts{}
+			}
+			totals[level].issued += levelCounts.issued
+			totals[level].verifiedOK += levelCounts.verifiedOK
+			totals[level].verifiedFail += levelCounts.verifiedFail
+			totals[level].solveSeconds = append(totals[level].solveSeconds, levelCounts.solveSeconds...)
+		}
+	}
+
+	output := map[int]DifficultyLevelStats{}
+	for level, levelCounts := range totals {
+		stats := DifficultyLevelStats{
+			Issued:       levelCounts.issued,
+			VerifiedOK:   levelCounts.verifiedOK,
+			VerifiedFail: levelCounts.verifiedFail,
+		}
+		if len(levelCounts.solveSeconds) > 0 {
+			median := medianOf(levelCounts.solveSeconds)
+			stats.MedianSolveSeconds = &median
+		}
+		output[level] = stats
+	}
+	return output
+}
+
+func medianOf(values []float64) float64 {
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
+
+// recommendedDifficultyLevel looks at the level with the most successful solves and moves it one step
+// towards the target solve time window. It returns 0 when there is nothing to go by.
+func recommendedDifficultyLevel(currentConfig Config, stats map[int]DifficultyLevelStats) int {
+	mostSolvedLevel, mostSolved := 0, int64(0)
+	for level, levelStats := range stats {
+		if levelStats.MedianSolveSeconds != nil && levelStats.VerifiedOK > mostSolved {
+			mostSolvedLevel, mostSolved = level, levelStats.VerifiedOK
+		}
+	}
+	if mostSolvedLevel == 0 {
+		return 0
+	}
+
+	recommended := mostSolvedLevel
+	medianSolveSeconds := *stats[mostSolvedLevel].MedianSolveSeconds
+	if medianSolveSeconds < currentConfig.TargetSolveSecondsMin {
+		recommended++
+	} else if medianSolveSeconds > currentConfig.TargetSolveSecondsMax {
+		recommended--
+	}
+	if recommended < currentConfig.MinDifficultyLevel {
+		recommended = currentConfig.MinDifficultyLevel
+	}
+	if recommended > currentConfig.MaxDifficultyLevel {
+		recommended = currentConfig.MaxDifficultyLevel
+	}
+	return recommended
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// seedDifficultyStats puts synthetic counts for level into the bucket minutesAgo minutes before now.
+func seedDifficultyStats(minutesAgo int64, level int, counts difficultyLevelCounts) {
+	difficultyStats.mu.Lock()
+	defer difficultyStats.mu.Unlock()
+	minute := time.Now().Unix()/60 - minutesAgo
+	if _, has := difficultyStats.minutes[minute]; !has {
+		difficultyStats.minutes[minute] = map[int]*difficultyLevelCounts{}
+	}
+	difficultyStats.minutes[minute][level] = &counts
+}
+
+func float64Pointer(value float64) *float64 {
+	return &value
+}
+
+func TestDifficultyStatsAggregation(t *testing.T) {
+	resetDifficultyStats()
+	defer resetDifficultyStats()
+	seedDifficultyStats(0, 4, difficultyLevelCounts{issued: 10, verifiedOK: 3, verifiedFail: 1, solveSeconds: []float64{1, 9, 2}})
+	seedDifficultyStats(5, 4, difficultyLevelCounts{issued: 5, verifiedOK: 1, solveSeconds: []float64{4}})
+	seedDifficultyStats(5, 6, difficultyLevelCounts{issued: 5, verifiedFail: 2})
+	seedDifficultyStats(20, 4, difficultyLevelCounts{issued: 100, verifiedOK: 2, solveSeconds: []float64{30, 40}})
+
+	testCases := []struct {
+		windowMinutes int
+		want          map[int]DifficultyLevelStats
+	}{
+		{windowMinutes: 1, want: map[int]DifficultyLevelStats{
+			4: {Issued: 10, VerifiedOK: 3, VerifiedFail: 1, MedianSolveSeconds: float64Pointer(2)},
+		}},
+		{windowMinutes: 15, want: map[int]DifficultyLevelStats{
+			// the median of 1, 2, 4 and 9
+			4: {Issued: 15, VerifiedOK: 4, VerifiedFail: 1, MedianSolveSeconds: float64Pointer(3)},
+			6: {Issued: 5, VerifiedFail: 2},
+		}},
+		{windowMinutes: 60, want: map[int]DifficultyLevelStats{
+			4: {Issued: 115, VerifiedOK: 6, VerifiedFail: 1, MedianSolveSeconds: float64Pointer(6.5)},
+			6: {Issued: 5, VerifiedFail: 2},
+		}},
+	}
+	for _, testCase := range testCases {
+		if got := difficultyStats.snapshot(testCase.windowMinutes); !reflect.DeepEqual(got, testCase.want) {
+			t.Errorf("snapshot(%d) = %s, want %s", testCase.windowMinutes, difficultyStatsString(got), difficultyStatsString(testCase.want))
+		}
+	}
+}
+
+func difficultyStatsString(stats map[int]DifficultyLevelStats) string {
+	statsJSON, _ := json.Marshal(stats)
+	return string(statsJSON)
+}
+
+func TestDifficultyStatsRecording(t *testing.T) {
+	resetDifficultyStats()
+	defer resetDifficultyStats()
+	difficultyStats.recordIssued(4, 5)
+	difficultyStats.recordVerified(4, true, time.Now().Add(-10*time.Second).Unix())
+	difficultyStats.recordVerified(4, false, time.Now().Unix())
+	// challenges from before issuance times were embedded count, but have no solve time
+	difficultyStats.recordVerified(4, true, 0)
+
+	stats := difficultyStats.snapshot(1)[4]
+	if stats.Issued != 5 || stats.VerifiedOK != 2 || stats.VerifiedFail != 1 {
+		t.Errorf("level 4 has %+v, want 5 issued, 2 ok, 1 failed", stats)
+	}
+	if stats.MedianSolveSeconds == nil || *stats.MedianSolveSeconds < 9 || *stats.MedianSolveSeconds > 12 {
+		t.Errorf("the median solve time is %v, want about 10 seconds", stats.MedianSolveSeconds)
+	}
+}
+
+func TestDifficultyStatsDropsOldMinutes(t *testing.T) {
+	resetDifficultyStats()
+	defer resetDifficultyStats()
+	seedDifficultyStats(difficultyStatsMaxMinutes, 4, difficultyLevelCounts{issued: 1})
+	seedDifficultyStats(difficultyStatsMaxMinutes-1, 4, difficultyLevelCounts{issued: 1})
+	difficultyStats.recordIssued(4, 1)
+	if minutes := len(difficultyStats.minutes); minutes != 2 {
+		t.Errorf("%d minutes are kept, want the 2 within %d minutes", minutes, difficultyStatsMaxMinutes)
+	}
+}
+
+func TestMedianOf(t *testing.T) {
+	testCases := []struct {
+		values []float64
+		want   float64
+	}{
+		{values: []float64{5}, want: 5},
+		{values: []float64{3, 1, 2}, want: 2},
+		{values: []float64{4, 1, 3, 2}, want: 2.5},
+	}
+	for _, testCase := range testCases {
+		if got := medianOf(testCase.values); got != testCase.want {
+			t.Errorf("medianOf(%v) = %g, want %g", testCase.values, got, testCase.want)
+		}
+	}
+}
+
+func TestRecommendedDifficultyLevel(t *testing.T) {
+	config := Config{TargetSolveSecondsMin: 2, TargetSolveSecondsMax: 5, MinDifficultyLevel: 1, MaxDifficultyLevel: 8}
+	testCases := []struct {
+		name  string
+		stats map[int]DifficultyLevelStats
+		want  int
+	}{
+		{name: "no stats", stats: map[int]DifficultyLevelStats{}, want: 0},
+		{name: "no solves", stats: map[int]DifficultyLevelStats{4: {Issued: 10, VerifiedFail: 3}}, want: 0},
+		{name: "too fast", stats: map[int]DifficultyLevelStats{4: {VerifiedOK: 10, MedianSolveSeconds: float64Pointer(1)}}, want: 5},
+		{name: "too slow", stats: map[int]DifficultyLevelStats{4: {VerifiedOK: 10, MedianSolveSeconds: float64Pointer(8)}}, want: 3},
+		{name: "within the window", stats: map[int]DifficultyLevelStats{4: {VerifiedOK: 10, MedianSolveSeconds: float64Pointer(3)}}, want: 4},
+		{name: "follows the most solved level", stats: map[int]DifficultyLevelStats{
+			4: {VerifiedOK: 10, MedianSolveSeconds: float64Pointer(1)},
+			6: {VerifiedOK: 2, MedianSolveSeconds: float64Pointer(8)},
+		}, want: 5},
+		{name: "clamped to max_difficulty_level", stats: map[int]DifficultyLevelStats{8: {VerifiedOK: 10, MedianSolveSeconds: float64Pointer(1)}}, want: 8},
+		{name: "clamped to min_difficulty_level", stats: map[int]DifficultyLevelStats{1: {VerifiedOK: 10, MedianSolveSeconds: float64Pointer(8)}}, want: 1},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if got := recommendedDifficultyLevel(config, testCase.stats); got != testCase.want {
+				t.Errorf("recommendedDifficultyLevel() = %d, want %d", got, testCase.want)
+			}
+		})
+	}
+}
+
+func TestStatsDifficultyEndpoint(t *testing.T) {
+	setupTest(t, `{"target_solve_seconds_min": 30, "target_solve_seconds_max": 60}`)
+	token := createTestToken(t, "a")
+	challenges := getTestChallenges(t, token, "difficultyLevel=2")
+	nonce := solveTestChallenge(t, challenges[0])
+	if outcome := verifyChallenge(token, challenges[0], nonce, ""); outcome != verifyOK {
+		t.Fatalf("verify returned %s", outcome)
+	}
+	verifyChallenge(token, challenges[1], "00000000", "")
+
+	testCases := []struct {
+		query      string
+		adminToken string
+		wantStatus int
+	}{
+		{query: "", adminToken: testAdminToken, wantStatus: http.StatusOK},
+		{query: "?minutes=60", adminToken: testAdminToken, wantStatus: http.StatusOK},
+		{query: "?minutes=0", adminToken: testAdminToken, wantStatus: http.StatusBadRequest},
+		{query: "?minutes=61", adminToken: testAdminToken, wantStatus: http.StatusBadRequest},
+		{query: "?minutes=abc", adminToken: testAdminToken, wantStatus: http.StatusBadRequest},
+		{query: "", adminToken: token, wantStatus: http.StatusUnauthorized},
+	}
+	for _, testCase := range testCases {
+		response := serveTestRequest(newTestRequest("GET", "/Stats/Difficulty"+testCase.query, testCase.adminToken, ""))
+		if response.Code != testCase.wantStatus {
+			t.Errorf("/Stats/Difficulty%s returned %d, want %d", testCase.query, response.Code, testCase.wantStatus)
+		}
+	}
+
+	response := serveTestRequest(newTestRequest("GET", "/Stats/Difficulty", testAdminToken, ""))
+	var output struct {
+		WindowMinutes    int                             `json:"windowMinutes"`
+		Levels           map[string]DifficultyLevelStats `json:"levels"`
+		RecommendedLevel int                             `json:"recommendedLevel"`
+	}
+	if err := json.Unmarshal(response.Body.Bytes(), &output); err != nil {
+		t.Fatalf("/Stats/Difficulty returned invalid json: %v", err)
+	}
+	levelStats := output.Levels["2"]
+	if output.WindowMinutes != 15 || levelStats.Issued != 5 || levelStats.VerifiedOK != 1 || levelStats.VerifiedFail != 1 {
+		t.Errorf("/Stats/Difficulty returned %s", response.Body.String())
+	}
+	// the challenge was solved right away, far below the 30 second target
+	if output.RecommendedLevel != 3 {
+		t.Errorf("recommendedLevel is %d, want 3", output.RecommendedLevel)
+	}
+}
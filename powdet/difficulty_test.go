@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDifficultyTargetForLevel(t *testing.T) {
+	testCases := []struct {
+		level      int
+		wantTarget string
+		wantError  bool
+	}{
+		{level: -1, wantError: true},
+		{level: 0, wantError: true},
+		{level: 1, wantTarget: "7f"},
+		{level: 2, wantTarget: "3f"},
+		{level: 7, wantTarget: "01"},
+		{level: 8, wantTarget: "00"},
+		{level: 9, wantTarget: "007f"},
+		{level: 14, wantTarget: "0003"},
+		{level: 16, wantTarget: "0000"},
+		{level: 17, wantTarget: "00007f"},
+		{level: 63, wantTarget: "0000000000000001"},
+		{level: 64, wantTarget: "0000000000000000"},
+		{level: maxDifficultyLevel, wantTarget: strings.Repeat("00", maxDifficultyLevel/8)},
+		{level: maxDifficultyLevel + 1, wantError: true},
+	}
+	for _, testCase := range testCases {
+		target, err := difficultyTargetForLevel(testCase.level)
+		if (err != nil) != testCase.wantError || target != testCase.wantTarget {
+			t.Errorf("difficultyTargetForLevel(%d) = %q, %v, want %q (error: %t)", testCase.level, target, err, testCase.wantTarget, testCase.wantError)
+		}
+	}
+}
+
+// every level from 1 to 64 against the target worked out arithmetically: level leading zero bits
+// followed by ones, i.e. 2^(bits - level) - 1 over the smallest whole number of bytes
+func TestDifficultyTargetForEveryLevel(t *testing.T) {
+	for level := 1; level <= 64; level++ {
+		targetBytes := (level + 7) / 8
+		wantValue := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), uint(targetBytes*8-level)), big.NewInt(1))
+		wantTarget := fmt.Sprintf("%0*x", targetBytes*2, wantValue)
+		target, err := difficultyTargetForLevel(level)
+		if err != nil || target != wantTarget {
+			t.Errorf("difficultyTargetForLevel(%d) = %q, %v, want %q", level, target, err, wantTarget)
+		}
+	}
+}
+
+func TestPowdetDifficultyEndpoint(t *testing.T) {
+	setupTest(t, `{"min_difficulty_level": 2, "max_difficulty_level": 20}`)
+	testCases := []struct {
+		query      string
+		wantStatus int
+		wantTarget string
+	}{
+		{query: "level=2", wantStatus: http.StatusOK, wantTarget: "3f"},
+		{query: "level=14", wantStatus: http.StatusOK, wantTarget: "0003"},
+		{query: "level=20", wantStatus: http.StatusOK, wantTarget: "00000f"},
+		{query: "level=1", wantStatus: http.StatusBadRequest},
+		{query: "level=21", wantStatus: http.StatusBadRequest},
+		{query: "level=abc", wantStatus: http.StatusBadRequest},
+		{query: "", wantStatus: http.StatusBadRequest},
+	}
+	token := createTestToken(t, "a")
+	for _, testCase := range testCases {
+		t.Run(testCase.query, func(t *testing.T) {
+			response := serveTestRequest(newTestRequest("GET", "/powdet/difficulty?"+testCase.query, "", ""))
+			if response.Code != testCase.wantStatus {
+				t.Fatalf("/powdet/difficulty?%s returned %d, want %d: %s", testCase.query, response.Code, testCase.wantStatus, response.Body.String())
+			}
+			// the same levels are accepted by /GetChallenges
+			getChallengesQuery := strings.Replace(testCase.query, "level=", "difficultyLevel=", 1)
+			getChallengesResponse := serveTestRequest(newTestRequest("POST", "/GetChallenges?"+getChallengesQuery, token, ""))
+			if (getChallengesResponse.Code == http.StatusOK) != (testCase.wantStatus == http.StatusOK) {
+				t.Errorf("/GetChallenges?%s returned %d, but /powdet/difficulty returned %d", getChallengesQuery, getChallengesResponse.Code, response.Code)
+			}
+			if testCase.wantStatus != http.StatusOK {
+				return
+			}
+
+			if response.Header().Get("Cache-Control") != "public, max-age=3600" {
+				t.Errorf("Cache-Control is %q", response.Header().Get("Cache-Control"))
+			}
+			var output struct {
+				Level                  int     `json:"level"`
+				Target                 string  `json:"target"`
+				ApproxExpectedAttempts float64 `json:"approxExpectedAttempts"`
+			}
+			if err := json.Unmarshal(response.Body.Bytes(), &output); err != nil {
+				t.Fatalf("/powdet/difficulty returned invalid json: %v", err)
+			}
+			level := 0
+			fmt.Sscanf(testCase.query, "level=%d", &level)
+			if output.Level != level || output.Target != testCase.wantTarget || output.ApproxExpectedAttempts != math.Pow(2, float64(level)) {
+				t.Errorf("/powdet/difficulty?%s returned %+v, want target %s and 2^%d attempts", testCase.query, output, testCase.wantTarget, level)
+			}
+			// the issued challenges carry the same target
+			challenges := getTestChallenges(t, token, getChallengesQuery)
+			if difficulty := decodeTestChallenge(t, challenges[0]).Difficulty; difficulty != output.Target {
+				t.Errorf("challenges at level %d have difficulty %s, /powdet/difficulty says %s", level, difficulty, output.Target)
+			}
+		})
+	}
+}
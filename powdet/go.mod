@@ -1,9 +1,19 @@
 module git.sequentialread.com/forest/pow-bot-deterrent
 
-go 1.16
+go 1.22
 
 require (
 	git.sequentialread.com/forest/config-lite v0.0.0-20220225195944-164dc71bce04
 	git.sequentialread.com/forest/pkg-errors v0.9.2
+	github.com/alicebob/miniredis/v2 v2.37.0
+	github.com/redis/go-redis/v9 v9.7.3
+	go.etcd.io/bbolt v1.3.11
 	golang.org/x/crypto v0.0.0-20210220033148-5ea612d1eb83
 )
+
+require (
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
+	golang.org/x/sys v0.7.0 // indirect
+)
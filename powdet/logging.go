@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var logLevel = new(slog.LevelVar)
+
+func parseLogLevel(logLevelString string) (slog.Level, error) {
+	var level slog.Level
+	if logLevelString == "" {
+		return slog.LevelInfo, nil
+	}
+	err := level.UnmarshalText([]byte(logLevelString))
+	if err != nil {
+		return slog.LevelInfo, fmt.Errorf("log_level '%s' is invalid, expected debug, info, warn or error", logLevelString)
+	}
+	return level, nil
+}
+
+// logs go here, tests swap it out to look at them
+var logOutput io.Writer = os.Stderr
+
+// configureLogging routes both slog and the standard log package through one handler.
+// log.Printf is only used for failures, so it logs at error level and log_level warn or error never hides it.
+func configureLogging(logLevelString, logFormat string) {
+	level, err := parseLogLevel(logLevelString)
+	if err != nil {
+		log.Println(err)
+	}
+	logLevel.Set(level)
+
+	handlerOptions := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	if logFormat == "json" {
+		handler = slog.NewJSONHandler(logOutput, handlerOptions)
+	} else {
+		handler = slog.NewTextHandler(logOutput, handlerOptions)
+	}
+	slog.SetDefault(slog.New(handler))
+	slog.SetLogLoggerLevel(slog.LevelError)
+}
+
+type statusRecordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (responseWriter *statusRecordingResponseWriter) WriteHeader(status int) {
+	responseWriter.status = status
+	responseWriter.ResponseWriter.WriteHeader(status)
+}
+
+func (responseWriter *statusRecordingResponseWriter) Write(bytes []byte) (int, error) {
+	if responseWriter.status == 0 {
+		responseWriter.status = http.StatusOK
+	}
+	return responseWriter.ResponseWriter.Write(bytes)
+}
+
+// Unwrap lets http.ResponseController reach the connection, for deadlines and flushing.
+func (responseWriter *statusRecordingResponseWriter) Unwrap() http.ResponseWriter {
+	return responseWriter.ResponseWriter
+}
+
+// withAccessLog logs method, path, status and duration of every request at info level.
+// Only API tokens get a prefix logged, the admin token never shows up in the logs.
+func withAccessLog(handler http.HandlerFunc) http.HandlerFunc {
+	return func(responseWriter http.ResponseWriter, request *http.Request) {
+		startedAt := time.Now()
+		recorder := &statusRecordingResponseWriter{ResponseWriter: responseWriter}
+
+		handler(recorder, request)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		attributes := []any{
+			"method", request.Method,
+			"path", request.URL.Path,
+			"status", recorder.status,
+			"durationMs", time.Since(startedAt).Milliseconds(),
+		}
+		token := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+		if hexTokenRegexp.MatchString(token) {
+			attributes = append(attributes, "tokenPrefix", token[:8])
+		}
+		slog.Info("request", attributes...)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+)
+
+// captureLogs sends the logs of the rest of the test to the returned buffer
+func captureLogs(t *testing.T, logLevelString, logFormat string) *bytes.Buffer {
+	t.Helper()
+	buffer := &bytes.Buffer{}
+	logOutput = buffer
+	t.Cleanup(func() {
+		logOutput = os.Stderr
+		configureLogging("warn", "")
+	})
+	configureLogging(logLevelString, logFormat)
+	return buffer
+}
+
+func TestLogLevels(t *testing.T) {
+	testCases := []struct {
+		logLevel  string
+		wantDebug bool
+		wantInfo  bool
+		wantWarn  bool
+	}{
+		{logLevel: "debug", wantDebug: true, wantInfo: true, wantWarn: true},
+		{logLevel: "info", wantInfo: true, wantWarn: true},
+		{logLevel: "warn", wantWarn: true},
+		{logLevel: "error"},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.logLevel, func(t *testing.T) {
+			logs := captureLogs(t, testCase.logLevel, "")
+			slog.Debug("a debug line")
+			slog.Info("an info line")
+			slog.Warn("a warn line")
+			log.Printf("an error from log.Printf")
+
+			logged := logs.String()
+			if strings.Contains(logged, "a debug line") != testCase.wantDebug {
+				t.Errorf("debug line logged: %t, want %t", !testCase.wantDebug, testCase.wantDebug)
+			}
+			if strings.Contains(logged, "an info line") != testCase.wantInfo {
+				t.Errorf("info line logged: %t, want %t", !testCase.wantInfo, testCase.wantInfo)
+			}
+			if strings.Contains(logged, "a warn line") != testCase.wantWarn {
+				t.Errorf("warn line logged: %t, want %t", !testCase.wantWarn, testCase.wantWarn)
+			}
+			// log.Printf is used for failures, no log_level may hide it
+			if !strings.Contains(logged, "level=ERROR msg=\"an error from log.Printf\"") {
+				t.Errorf("the log.Printf error is missing at log_level %s: %q", testCase.logLevel, logged)
+			}
+		})
+	}
+}
+
+func TestVerifyHashComparisonOnlyAtDebug(t *testing.T) {
+	testCases := []struct {
+		logLevel string
+		want     bool
+	}{
+		{logLevel: "info", want: false},
+		{logLevel: "debug", want: true},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.logLevel, func(t *testing.T) {
+			setupTest(t, "")
+			token := createTestToken(t, "a")
+			challenges := getTestChallenges(t, token, "difficultyLevel=1")
+			nonce := solveTestChallenge(t, challenges[0])
+
+			logs := captureLogs(t, testCase.logLevel, "")
+			response := serveTestRequest(newTestRequest("POST", "/Verify?challenge="+challenges[0]+"&nonce="+nonce, token, ""))
+			if response.Code != 200 {
+				t.Fatalf("/Verify returned %d: %s", response.Code, response.Body.String())
+			}
+			if logged := strings.Contains(logs.String(), "verify hash comparison"); logged != testCase.want {
+				t.Errorf("hash comparison logged at %s: %t, want %t", testCase.logLevel, logged, testCase.want)
+			}
+			if !strings.Contains(logs.String(), `msg=request method=POST path=/Verify status=200`) {
+				t.Errorf("the access log line is missing: %q", logs.String())
+			}
+		})
+	}
+}
+
+func TestJSONLogFormat(t *testing.T) {
+	logs := captureLogs(t, "error", "json")
+	log.Printf("failed to do something")
+	if !strings.Contains(logs.String(), `"level":"ERROR","msg":"failed to do something"`) {
+		t.Errorf("log_format json wrote %q", logs.String())
+	}
+}
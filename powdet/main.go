@@ -1,41 +1,126 @@
 package main
 
 import (
-	"crypto/rand"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"log/slog"
 	"math"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
-	"path"
+	"os/signal"
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	configlite "git.sequentialread.com/forest/config-lite"
 	errors "git.sequentialread.com/forest/pkg-errors"
-	"golang.org/x/crypto/argon2"
 )
 
 type Config struct {
 	ListenPort            int `json:"listen_port"`
 	BatchSize             int `json:"batch_size"`
 	DeprecateAfterBatches int `json:"deprecate_after_batches"`
+	// how many challenge preimages are pre-generated in the background, 0 (default) generates them per request
+	PregenPoolSize int `json:"pregen_pool_size"`
+
+	// solve and verify one challenge at min_difficulty_level before accepting requests, see --self-test
+	SelfTestOnStart       bool `json:"self_test_on_start"`
+	SelfTestBudgetSeconds int  `json:"self_test_budget_seconds"`
 
 	Argon2MemoryKiB   int `json:"argon2_memory_kib"`
 	Argon2Iterations  int `json:"argon2_iterations"`
 	Argon2Parallelism int `json:"argon2_parallelism"`
 
 	AdminAPIToken string `json:"admin_api_token"`
+	// additional admin tokens, so a new one can be rolled out to clients before the old one is removed
+	AdminAPITokens []string `json:"admin_api_tokens"`
+
+	// size of the nonce in bytes clients must submit, embedded in every challenge as nlen
+	NonceLengthBytes int `json:"nonce_length_bytes"`
+	// size of the random challenge preimage in bytes, embedded as plen
+	PreimageLengthBytes int `json:"preimage_length_bytes"`
+	// "tail" (default) checks the difficulty against the trailing hex of the hash, "head" against the leading hex, embedded as dpos
+	DifficultyPosition string `json:"difficulty_position"`
+
+	MinDifficultyLevel int `json:"min_difficulty_level"`
+	MaxDifficultyLevel int `json:"max_difficulty_level"`
+	// raised while under attack: lower requested levels are clamped up to this instead of rejected, 0 disables it
+	MinDifficultyLevelEnforced int `json:"min_difficulty_level_enforced"`
+
+	// when both are set, /Stats/Difficulty recommends a level whose median solve time falls between them
+	TargetSolveSecondsMin float64 `json:"target_solve_seconds_min"`
+	TargetSolveSecondsMax float64 `json:"target_solve_seconds_max"`
+
+	VerifyBatchMaxSize   int `json:"verify_batch_max_size"`
+	Argon2MaxConcurrency int `json:"argon2_max_concurrency"`
+
+	// proof of work algorithms clients may request via ?algorithm=, defaults to ["argon2id"]
+	AllowedAlgorithms []string `json:"allowed_algorithms"`
+
+	// optional cheaper/heavier argon2 parameters per difficulty level range, the first tier with maxLevel >= difficultyLevel wins
+	Argon2Tiers []Argon2Tier `json:"argon2_tiers"`
+
+	ChallengeStore ChallengeStoreConfig `json:"challenge_store"`
+
+	ReadTimeoutSeconds  int   `json:"read_timeout_seconds"`
+	WriteTimeoutSeconds int   `json:"write_timeout_seconds"`
+	IdleTimeoutSeconds  int   `json:"idle_timeout_seconds"`
+	MaxHeaderBytes      int   `json:"max_header_bytes"`
+	MaxRequestBodyBytes int64 `json:"max_request_body_bytes"`
+
+	// additionally break verify_* and challenge_batches down by token prefix in GET /Metrics
+	MetricsPerToken bool `json:"metrics_per_token"`
+
+	// when true, /GetChallenges requires ?bind=<client fingerprint> and /Verify must repeat it
+	RequireBinding bool `json:"require_binding"`
+
+	// exposes /debug/pprof/ and /debug/stats to admins when true
+	EnableDebugEndpoints bool `json:"enable_debug_endpoints"`
+
+	// debug, info (default), warn or error
+	LogLevel string `json:"log_level"`
+	// "text" (default) or "json"
+	LogFormat string `json:"log_format"`
+
+	// optional on-disk override for the embedded static assets, useful during development
+	StaticDir string `json:"static_dir"`
+	// serve the static assets under the old /pow-bot-deterrent-static/ path too, defaults to true.
+	// When false, that path answers 410 Gone.
+	LegacyStaticEnabled *bool `json:"legacy_static_enabled"`
+
+	// origins (e.g. "https://landing.example.com") allowed to load the static assets from another origin, "*" allows any
+	CORSAllowedOrigins []string `json:"cors_allowed_origins"`
+	// also send CORS headers for /GetChallenges, /Verify and /VerifyBatch
+	CORSAPIEndpoints     bool `json:"cors_api_endpoints"`
+	CORSAllowCredentials bool `json:"cors_allow_credentials"`
+
+	// "json" (default) keeps all tokens in one atomically replaced file with an audit log, "folder" keeps one file per token,
+	// "redis" shares them between replicas
+	TokenStore string `json:"token_store"`
+	// used by challenge_store type "redis" and token_store "redis"
+	Redis RedisConfig `json:"redis"`
+
+	// directory for the JSONL audit trail of token changes, challenge batches and verifications, disabled when empty
+	AuditLog         string `json:"audit_log"`
+	AuditLogMaxBytes int64  `json:"audit_log_max_bytes"`
+	// how many rotated audit log files are kept
+	AuditLogMaxFiles int `json:"audit_log_max_files"`
 }
 
 // Argon2id parameters embedded in the challenge JSON
@@ -46,34 +131,115 @@ type Argon2Parameters struct {
 	KeyLength   int `json:"klen"` // Output length (bytes)
 }
 
+type Argon2Tier struct {
+	MaxLevel    int `json:"maxLevel"`
+	MemoryKiB   int `json:"memoryKiB"`
+	Iterations  int `json:"iterations"`
+	Parallelism int `json:"parallelism"`
+	KeyLength   int `json:"keyLength"`
+}
+
+const (
+	algorithmArgon2id = "argon2id"
+	algorithmSHA256   = "sha256"
+)
+
+const (
+	difficultyPositionTail = "tail"
+	difficultyPositionHead = "head"
+)
+
 type Challenge struct {
 	Argon2Parameters
 	Preimage        string `json:"i"`
 	Difficulty      string `json:"d"`
 	DifficultyLevel int    `json:"dl"`
+	// "argon2id" or "sha256", challenges without it are argon2id
+	Algorithm string `json:"a,omitempty"`
+	// hash of the ?bind= value given to /GetChallenges, /Verify must be called with the same value
+	Binding string `json:"b,omitempty"`
+	// exact nonce size in bytes the client has to submit
+	NonceLength int `json:"nlen,omitempty"`
+	// preimage size in bytes, challenges without it have an 8 byte preimage
+	PreimageLength int `json:"plen,omitempty"`
+	// which end of the hash is compared against the difficulty, challenges without it are "tail"
+	DifficultyPosition string `json:"dpos,omitempty"`
+	// unix time the challenge was issued, for the solve times in /Stats/Difficulty
+	IssuedAt int64 `json:"it,omitempty"`
+}
+
+// ChallengeBatchEnvelope is the /GetChallenges response with ?format=envelope, it repeats what every challenge
+// in the batch has in common so the landing worker doesn't have to decode one to find out.
+type ChallengeBatchEnvelope struct {
+	Challenges []string `json:"challenges"`
+	// nil for sha256 challenges
+	Params          *Argon2Parameters `json:"params"`
+	DifficultyLevel int               `json:"difficultyLevel"`
+	Algorithm       string            `json:"algorithm"`
+	// the per-token batch generation, the batch stops verifying once deprecatesAfterBatches newer batches were issued
+	BatchID                int    `json:"batchId"`
+	DeprecatesAfterBatches int    `json:"deprecatesAfterBatches"`
+	IssuedAt               string `json:"issuedAt"`
 }
 
 var config Config
+var configVersion string
+var configMu sync.RWMutex
 var appDirectory string
 var argon2Parameters Argon2Parameters
-var currentChallengesGeneration = map[string]int{}
-var challenges = map[string]map[string]int{}
-var challengesMu sync.RWMutex
-var apiTokensFolder string
-
-type tokenCache struct {
-	tokens map[string]struct{}
-	mu     sync.RWMutex
-}
+var challengeStore ChallengeStore
+var startTime = time.Now()
+
+// ready is set once the configuration and API tokens have been loaded and the listener is bound,
+// and cleared again when the server shuts down
+var ready atomic.Bool
 
-var apiTokensCache = tokenCache{tokens: map[string]struct{}{}}
+// how long in-flight requests get to finish after SIGINT or SIGTERM
+const shutdownTimeout = 10 * time.Second
+
+// all routes are registered here rather than on http.DefaultServeMux, so nothing gets exposed just by importing a package
+var serveMux = http.NewServeMux()
 
 func main() {
 
 	var err error
 
-	apiTokensFolder := readConfiguration()
+	selfTest := flag.Bool("self-test", false, "solve and verify one challenge with the configured parameters, then exit")
+	flag.Parse()
+
+	if *selfTest {
+		runSelfTestCommand()
+		os.Exit(0)
+	}
+	readConfiguration()
+	startupConfig, startupArgon2Parameters := currentConfiguration()
+	if startupConfig.SelfTestOnStart {
+		selfTestOrFail(startupConfig, startupArgon2Parameters)
+	}
+	handleReloadSignals()
+	registerHandlers()
+
+	server := newHTTPServer(startupConfig, serveMux)
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		log.Fatalf("can't listen on port %d: %v", startupConfig.ListenPort, err)
+	}
+	shutdownDone := handleShutdownSignals(server)
+	slog.Info("💥  PoW! Bot Deterrent server listening", "port", startupConfig.ListenPort)
+
+	err = serve(server, listener)
+	if err != http.ErrServerClosed {
+		// if got this far it means server crashed!
+		panic(err)
+	}
+	<-shutdownDone
+	if err := challengeStore.Close(); err != nil {
+		log.Printf("failed to close the challenge store: %v", err)
+	}
+}
 
+// registerHandlers adds every route to serveMux, it must only be called once.
+func registerHandlers() {
 	requireMethod := func(method string) func(http.ResponseWriter, *http.Request) bool {
 		return func(responseWriter http.ResponseWriter, request *http.Request) bool {
 			if request.Method != method {
@@ -85,8 +251,21 @@ func main() {
 		}
 	}
 
+	// allowCORS must come before requireMethod so that preflight OPTIONS requests get answered
+	allowCORS := func(method string) func(http.ResponseWriter, *http.Request) bool {
+		return func(responseWriter http.ResponseWriter, request *http.Request) bool {
+			currentConfig, _ := currentConfiguration()
+			if !currentConfig.CORSAPIEndpoints {
+				return false
+			}
+			return applyCORS(responseWriter, request, method)
+		}
+	}
+
 	requireAdmin := func(responseWriter http.ResponseWriter, request *http.Request) bool {
-		if request.Header.Get("Authorization") != fmt.Sprintf("Bearer %s", config.AdminAPIToken) {
+		currentConfig, _ := currentConfiguration()
+		authorizationHeader := request.Header.Get("Authorization")
+		if !strings.HasPrefix(authorizationHeader, "Bearer ") || !isAdminToken(currentConfig, strings.TrimPrefix(authorizationHeader, "Bearer ")) {
 			http.Error(responseWriter, "401 Unauthorized", http.StatusUnauthorized)
 			return true
 		}
@@ -104,44 +283,173 @@ func main() {
 			http.Error(responseWriter, "401 Unauthorized: Authorization Bearer token is required", http.StatusUnauthorized)
 			return true
 		}
-		if !regexp.MustCompile("^[0-9a-f]{32}$").MatchString(token) {
-			errorMsg := fmt.Sprintf("401 Unauthorized: Authorization Bearer token '%s' must be a 32 character hex string", token)
+		if err := validateTokenFormat(token); err != nil {
+			errorMsg := fmt.Sprintf("401 Unauthorized: Authorization Bearer token %v", err)
 			http.Error(responseWriter, errorMsg, http.StatusUnauthorized)
 			return true
 		}
-		if !tokenExists(token) {
-			errorMsg := fmt.Sprintf("401 Unauthorized: Authorization Bearer token '%s' was in the right format, but it was unrecognized", token)
+		exists, err := tokenExists(token)
+		if err != nil {
+			writeStoreError(responseWriter, err, "failed to look up API token")
+			return true
+		}
+		if !exists {
+			errorMsg := fmt.Sprintf("401 Unauthorized: Authorization Bearer token %s was in the right format, but it was unrecognized", truncatedToken(token))
 			http.Error(responseWriter, errorMsg, http.StatusUnauthorized)
 			return true
 		}
 		return false
 	}
 
-	myHTTPHandleFunc("/Tokens", requireMethod("GET"), requireAdmin, func(responseWriter http.ResponseWriter, request *http.Request) bool {
-		fileInfos, err := ioutil.ReadDir(apiTokensFolder)
+	// unauthenticated probes for load balancers / kubernetes, these must never expose secrets or argon2 parameters
+	myHTTPHandleFunc("/healthz", requireMethod("GET"), func(responseWriter http.ResponseWriter, request *http.Request) bool {
+		configMu.RLock()
+		currentConfigVersion := configVersion
+		configMu.RUnlock()
+
+		health := map[string]interface{}{
+			"status":        "ok",
+			"configVersion": currentConfigVersion,
+			"uptimeSeconds": int64(time.Since(startTime).Seconds()),
+			"appVersion":    buildVersion,
+			"instance":      instanceName(),
+		}
+		if tokensFolderUnavailable.Load() {
+			health["tokensFolderUnavailable"] = true
+		}
+		responseBytes, err := json.Marshal(health)
 		if err != nil {
-			log.Printf("failed to list the apiTokensFolder (%s): %v", apiTokensFolder, err)
+			log.Printf("json marshal failed: %v", err)
 			http.Error(responseWriter, "500 internal server error", http.StatusInternalServerError)
 			return true
 		}
 
-		output := []string{}
+		responseWriter.Header().Set("Content-Type", "application/json")
+		responseWriter.Write(responseBytes)
+		return true
+	})
 
-		for _, fileInfo := range fileInfos {
-			filenameSplit := strings.Split(fileInfo.Name(), "_")
-			if len(filenameSplit) == 2 {
-				filepath := path.Join(apiTokensFolder, fileInfo.Name())
-				content, err := ioutil.ReadFile(filepath)
-				if err != nil {
-					log.Printf("failed to read the token file (%s): %v", filepath, err)
-					http.Error(responseWriter, "500 internal server error", http.StatusInternalServerError)
-					return true
-				}
-				contentInt64, err := strconv.ParseInt(string(content), 10, 64)
-				timestampString := time.Unix(contentInt64, 0).UTC().Format(time.RFC3339)
-				output = append(output, fmt.Sprintf("%s,%s,%d,%s", filenameSplit[0], filenameSplit[1], contentInt64, timestampString))
+	myHTTPHandleFunc("/version", requireMethod("GET"), func(responseWriter http.ResponseWriter, request *http.Request) bool {
+		responseBytes, err := json.Marshal(currentBuildInfo())
+		if err != nil {
+			log.Printf("json marshal failed: %v", err)
+			http.Error(responseWriter, "500 internal server error", http.StatusInternalServerError)
+			return true
+		}
+
+		responseWriter.Header().Set("Content-Type", "application/json")
+		responseWriter.Write(responseBytes)
+		return true
+	})
+
+	// unauthenticated too, the argon2 parameters are public anyway since every challenge embeds them
+	myHTTPHandleFunc("/powdet/config", allowCORS("GET"), requireMethod("GET"), func(responseWriter http.ResponseWriter, request *http.Request) bool {
+		configMu.RLock()
+		currentConfig, currentArgon2Parameters, currentConfigVersion := config, argon2Parameters, configVersion
+		configMu.RUnlock()
+
+		responseBytes, err := json.Marshal(map[string]interface{}{
+			"argon2":              currentArgon2Parameters,
+			"nonceLengthBytes":    currentConfig.NonceLengthBytes,
+			"preimageLengthBytes": currentConfig.PreimageLengthBytes,
+			"difficultyPosition":  currentConfig.DifficultyPosition,
+			"algorithms":          currentConfig.AllowedAlgorithms,
+			"staticBase":          "/powdet/static/",
+			"configVersion":       currentConfigVersion,
+		})
+		if err != nil {
+			log.Printf("json marshal failed: %v", err)
+			http.Error(responseWriter, "500 internal server error", http.StatusInternalServerError)
+			return true
+		}
+
+		responseWriter.Header().Set("Content-Type", "application/json")
+		responseWriter.Header().Set("Cache-Control", "public, max-age=60")
+		responseWriter.Write(responseBytes)
+		return true
+	})
+
+	myHTTPHandleFunc("/powdet/difficulty", allowCORS("GET"), requireMethod("GET"), func(responseWriter http.ResponseWriter, request *http.Request) bool {
+		levelString := request.URL.Query().Get("level")
+		level, err := strconv.Atoi(levelString)
+		if err != nil {
+			errorMessage := fmt.Sprintf("400 url param ?level=%s value could not be converted to an integer", levelString)
+			http.Error(responseWriter, errorMessage, http.StatusBadRequest)
+			return true
+		}
+		currentConfig, _ := currentConfiguration()
+		if err := validateDifficultyLevel(currentConfig, level); err != nil {
+			http.Error(responseWriter, fmt.Sprintf("400 url param ?level=%v", err), http.StatusBadRequest)
+			return true
+		}
+		target, err := difficultyTargetForLevel(level)
+		if err != nil {
+			log.Printf("difficulty target for level %d failed: %v", level, err)
+			http.Error(responseWriter, "500 internal server error", http.StatusInternalServerError)
+			return true
+		}
+
+		responseBytes, err := json.Marshal(map[string]interface{}{
+			"level":                  level,
+			"target":                 target,
+			"approxExpectedAttempts": math.Pow(2, float64(level)),
+		})
+		if err != nil {
+			log.Printf("json marshal failed: %v", err)
+			http.Error(responseWriter, "500 internal server error", http.StatusInternalServerError)
+			return true
+		}
+
+		responseWriter.Header().Set("Content-Type", "application/json")
+		responseWriter.Header().Set("Cache-Control", "public, max-age=3600")
+		responseWriter.Write(responseBytes)
+		return true
+	})
+
+	myHTTPHandleFunc("/readyz", requireMethod("GET"), func(responseWriter http.ResponseWriter, request *http.Request) bool {
+		if !ready.Load() {
+			http.Error(responseWriter, "503 service unavailable: not ready yet", http.StatusServiceUnavailable)
+			return true
+		}
+		// a missing tokens folder doesn't count, the cached tokens keep working and /healthz reports it
+		responseWriter.Write([]byte("OK"))
+		return true
+	})
+
+	myHTTPHandleFunc("/Tokens", requireMethod("GET"), requireAdmin, func(responseWriter http.ResponseWriter, request *http.Request) bool {
+		records, err := tokenStore.List()
+		if err != nil {
+			writeStoreError(responseWriter, err, "failed to list the API tokens")
+			return true
+		}
+
+		// the csv format is consumed by scripts that split on a fixed number of columns, so the note is only in the json format
+		if strings.Contains(request.Header.Get("Accept"), "application/json") {
+			output := []map[string]string{}
+			for _, record := range records {
+				output = append(output, map[string]string{
+					"token":     record.Token,
+					"name":      record.Name,
+					"createdAt": time.Unix(record.CreatedAt, 0).UTC().Format(time.RFC3339),
+					"note":      record.Note,
+				})
+			}
+			responseBytes, err := json.Marshal(output)
+			if err != nil {
+				log.Printf("json marshal failed: %v", err)
+				http.Error(responseWriter, "500 internal server error", http.StatusInternalServerError)
+				return true
 			}
 
+			responseWriter.Header().Set("Content-Type", "application/json")
+			responseWriter.Write(responseBytes)
+			return true
+		}
+
+		output := []string{}
+		for _, record := range records {
+			timestampString := time.Unix(record.CreatedAt, 0).UTC().Format(time.RFC3339)
+			output = append(output, fmt.Sprintf("%s,%s,%d,%s", record.Token, record.Name, record.CreatedAt, timestampString))
 		}
 
 		responseWriter.Header().Set("Content-Type", "text/plain")
@@ -156,70 +464,263 @@ func main() {
 			http.Error(responseWriter, "400 Bad Request: url param ?name=<string> is required", http.StatusBadRequest)
 			return true
 		}
-		// we use underscore as a syntax character in the filename, so we have to remove it from the user-inputted name
-		name = strings.ReplaceAll(name, "_", "-")
-		// let's also remove any sort of funky or path-related characters
-		name = strings.ReplaceAll(name, "*", "")
-		name = strings.ReplaceAll(name, "?", "")
-		name = strings.ReplaceAll(name, "/", "-")
-		name = strings.ReplaceAll(name, "\\", "-")
-		name = strings.ReplaceAll(name, ".", "-")
+		name = sanitizeTokenName(name)
 
-		tokenBytes := make([]byte, 16)
-		rand.Read(tokenBytes)
+		record, err := createToken(name, request.URL.Query().Get("note"), requestActor(request))
+		if err != nil {
+			writeStoreError(responseWriter, err, "failed to create token")
+			return true
+		}
 
-		tokenHex := fmt.Sprintf("%x", tokenBytes)
-		ioutil.WriteFile(
-			path.Join(apiTokensFolder, fmt.Sprintf("%s_%s", tokenHex, name)),
-			[]byte(fmt.Sprintf("%d", time.Now().Unix())),
-			0644,
-		)
+		if !strings.Contains(request.Header.Get("Accept"), "application/json") {
+			fmt.Fprintf(responseWriter, "%s", record.Token)
+			return true
+		}
 
-		apiTokensCache.mu.Lock()
-		apiTokensCache.tokens[tokenHex] = struct{}{}
-		apiTokensCache.mu.Unlock()
+		responseBytes, err := json.Marshal(map[string]string{
+			"token":     record.Token,
+			"name":      record.Name,
+			"createdAt": time.Unix(record.CreatedAt, 0).UTC().Format(time.RFC3339),
+		})
+		if err != nil {
+			log.Printf("json marshal failed: %v", err)
+			http.Error(responseWriter, "500 internal server error", http.StatusInternalServerError)
+			return true
+		}
 
-		fmt.Fprintf(responseWriter, "%s", tokenHex)
+		responseWriter.Header().Set("Content-Type", "application/json")
+		responseWriter.Write(responseBytes)
 
 		return true
 	})
 
 	myHTTPHandleFunc("/Tokens/Revoke", requireMethod("POST"), requireAdmin, func(responseWriter http.ResponseWriter, request *http.Request) bool {
 		token := request.URL.Query().Get("token")
+		name := request.URL.Query().Get("name")
+		if (token == "") == (name == "") {
+			http.Error(responseWriter, "400 Bad Request: exactly one of the url params ?token=<string> or ?name=<string> is required", http.StatusBadRequest)
+			return true
+		}
+
+		if name != "" {
+			revoked, err := revokeTokensByName(sanitizeTokenName(name), requestActor(request))
+			if err != nil {
+				writeStoreError(responseWriter, err, "failed to revoke tokens by name")
+				return true
+			}
+			if len(revoked) == 0 {
+				errorMsg := fmt.Sprintf("404 Not Found: no token is named like url param ?name=%s", name)
+				http.Error(responseWriter, errorMsg, http.StatusNotFound)
+				return true
+			}
+
+			responseBytes, err := json.Marshal(map[string][]string{"revoked": revoked})
+			if err != nil {
+				log.Printf("json marshal failed: %v", err)
+				http.Error(responseWriter, "500 internal server error", http.StatusInternalServerError)
+				return true
+			}
+
+			responseWriter.Header().Set("Content-Type", "application/json")
+			responseWriter.Write(responseBytes)
+			return true
+		}
+
+		if err := validateTokenFormat(token); err != nil {
+			errorMsg := fmt.Sprintf("400 Bad Request: url param ?token=%v", err)
+			http.Error(responseWriter, errorMsg, http.StatusBadRequest)
+			return true
+		}
+
+		_, err := revokeToken(token, requestActor(request))
+		if err != nil {
+			writeStoreError(responseWriter, err, "failed to revoke token")
+			return true
+		}
+
+		responseWriter.Write([]byte("Revoked"))
+		return true
+	})
+
+	myHTTPHandleFunc("/Tokens/Rotate", requireMethod("POST"), requireAdmin, func(responseWriter http.ResponseWriter, request *http.Request) bool {
+		requestQuery := request.URL.Query()
+		token := requestQuery.Get("token")
 		if token == "" {
 			http.Error(responseWriter, "400 Bad Request: url param ?token=<string> is required", http.StatusBadRequest)
 			return true
 		}
-		if !regexp.MustCompile("^[0-9a-f]{32}$").MatchString(token) {
-			errorMsg := fmt.Sprintf("400 Bad Request: url param ?token=%s must be a 32 character hex string", token)
+		if err := validateTokenFormat(token); err != nil {
+			errorMsg := fmt.Sprintf("400 Bad Request: url param ?token=%v", err)
 			http.Error(responseWriter, errorMsg, http.StatusBadRequest)
 			return true
 		}
+		graceSeconds := 300
+		if graceSecondsString := requestQuery.Get("graceSeconds"); graceSecondsString != "" {
+			var err error
+			graceSeconds, err = strconv.Atoi(graceSecondsString)
+			if err != nil || graceSeconds < 0 {
+				errorMsg := fmt.Sprintf("400 Bad Request: url param ?graceSeconds=%s must be a non-negative integer", graceSecondsString)
+				http.Error(responseWriter, errorMsg, http.StatusBadRequest)
+				return true
+			}
+		}
+
+		record, found, err := tokenStore.Get(token)
+		if err != nil {
+			writeStoreError(responseWriter, err, "failed to rotate token")
+			return true
+		}
+		if !found || !record.valid() {
+			errorMsg := fmt.Sprintf("404 Not Found: url param ?token=%s is not a known token", truncatedToken(token))
+			http.Error(responseWriter, errorMsg, http.StatusNotFound)
+			return true
+		}
+		// a token in its grace period already has a replacement, rotating it again would create a second one
+		if record.ExpiresAt != 0 {
+			errorMsg := fmt.Sprintf(
+				"409 Conflict: token %s was already rotated and expires at %s",
+				truncatedToken(token), time.Unix(record.ExpiresAt, 0).UTC().Format(time.RFC3339),
+			)
+			http.Error(responseWriter, errorMsg, http.StatusConflict)
+			return true
+		}
+
+		// the new token is persisted first, so a failure here leaves the old token untouched
+		newRecord, err := createToken(record.Name, record.Note, requestActor(request))
+		if err != nil {
+			writeStoreError(responseWriter, err, "failed to rotate token")
+			return true
+		}
+		// outstanding challenges of the old token stay verifiable because the token itself stays valid during the grace period
+		expiresAt, err := expireToken(token, time.Duration(graceSeconds)*time.Second, requestActor(request))
+		if err != nil {
+			writeStoreError(responseWriter, err, "failed to rotate token")
+			return true
+		}
+
+		responseBytes, err := json.Marshal(map[string]string{
+			"token":         newRecord.Token,
+			"name":          newRecord.Name,
+			"oldToken":      token,
+			"oldTokenUntil": expiresAt.UTC().Format(time.RFC3339),
+		})
+		if err != nil {
+			log.Printf("json marshal failed: %v", err)
+			http.Error(responseWriter, "500 internal server error", http.StatusInternalServerError)
+			return true
+		}
+
+		responseWriter.Header().Set("Content-Type", "application/json")
+		responseWriter.Write(responseBytes)
+		return true
+	})
+
+	myHTTPHandleFunc("/Challenges", requireMethod("GET"), requireAdmin, func(responseWriter http.ResponseWriter, request *http.Request) bool {
+		output, err := challengeStore.CountByToken()
+		if err != nil {
+			writeStoreError(responseWriter, err, "failed to count the outstanding challenges")
+			return true
+		}
 
-		fileInfos, err := ioutil.ReadDir(apiTokensFolder)
+		responseBytes, err := json.Marshal(output)
 		if err != nil {
-			log.Printf("failed to list the apiTokensFolder (%s): %v", apiTokensFolder, err)
+			log.Printf("json marshal failed: %v", err)
 			http.Error(responseWriter, "500 internal server error", http.StatusInternalServerError)
 			return true
 		}
-		removed := false
-		for _, fileInfo := range fileInfos {
-			if strings.HasPrefix(fileInfo.Name(), token) {
-				os.Remove(path.Join(apiTokensFolder, fileInfo.Name()))
-				removed = true
+
+		responseWriter.Header().Set("Content-Type", "application/json")
+		responseWriter.Write(responseBytes)
+		return true
+	})
+
+	myHTTPHandleFunc("/Challenges/Purge", requireMethod("POST"), requireAdmin, func(responseWriter http.ResponseWriter, request *http.Request) bool {
+		token := request.URL.Query().Get("token")
+		if token == "" {
+			http.Error(responseWriter, "400 Bad Request: url param ?token=<string> is required", http.StatusBadRequest)
+			return true
+		}
+
+		purged, found, err := challengeStore.Purge(token)
+		if err != nil {
+			writeStoreError(responseWriter, err, fmt.Sprintf("failed to purge the challenges of token %s", shortTokenPrefix(token)))
+			return true
+		}
+		if !found {
+			errorMessage := fmt.Sprintf("404 no outstanding challenges were found for url param ?token=%s", truncatedToken(token))
+			http.Error(responseWriter, errorMessage, http.StatusNotFound)
+			return true
+		}
+
+		metrics.add("challenges_purged", int64(purged))
+
+		fmt.Fprintf(responseWriter, "Purged %d", purged)
+		return true
+	})
+
+	myHTTPHandleFunc("/Metrics", requireMethod("GET"), requireAdmin, func(responseWriter http.ResponseWriter, request *http.Request) bool {
+		output := map[string]interface{}{}
+		for name, count := range metrics.snapshot() {
+			output[name] = count
+		}
+		if perToken := metrics.snapshotPerToken(); len(perToken) > 0 {
+			output["perToken"] = perToken
+		}
+		if labeled := metrics.snapshotLabeled(); len(labeled) > 0 {
+			output["labeled"] = labeled
+		}
+		output["appVersion"] = buildVersion
+		output["instance"] = instanceName()
+
+		responseBytes, err := json.Marshal(output)
+		if err != nil {
+			log.Printf("json marshal failed: %v", err)
+			http.Error(responseWriter, "500 internal server error", http.StatusInternalServerError)
+			return true
+		}
+
+		responseWriter.Header().Set("Content-Type", "application/json")
+		responseWriter.Write(responseBytes)
+		return true
+	})
+
+	myHTTPHandleFunc("/Stats/Difficulty", requireMethod("GET"), requireAdmin, func(responseWriter http.ResponseWriter, request *http.Request) bool {
+		windowMinutes := 15
+		if minutesString := request.URL.Query().Get("minutes"); minutesString != "" {
+			var err error
+			windowMinutes, err = strconv.Atoi(minutesString)
+			if err != nil || windowMinutes < 1 || windowMinutes > difficultyStatsMaxMinutes {
+				errorMessage := fmt.Sprintf("400 url param ?minutes=%s must be an integer between 1 and %d", minutesString, difficultyStatsMaxMinutes)
+				http.Error(responseWriter, errorMessage, http.StatusBadRequest)
+				return true
 			}
 		}
-		if removed {
-			apiTokensCache.mu.Lock()
-			delete(apiTokensCache.tokens, token)
-			apiTokensCache.mu.Unlock()
+
+		currentConfig, _ := currentConfiguration()
+		levelStats := difficultyStats.snapshot(windowMinutes)
+		output := map[string]interface{}{
+			"windowMinutes": windowMinutes,
+			"levels":        levelStats,
+		}
+		if currentConfig.TargetSolveSecondsMin > 0 && currentConfig.TargetSolveSecondsMax > 0 {
+			if recommendedLevel := recommendedDifficultyLevel(currentConfig, levelStats); recommendedLevel != 0 {
+				output["recommendedLevel"] = recommendedLevel
+			}
 		}
 
-		responseWriter.Write([]byte("Revoked"))
+		responseBytes, err := json.Marshal(output)
+		if err != nil {
+			log.Printf("json marshal failed: %v", err)
+			http.Error(responseWriter, "500 internal server error", http.StatusInternalServerError)
+			return true
+		}
+
+		responseWriter.Header().Set("Content-Type", "application/json")
+		responseWriter.Write(responseBytes)
 		return true
 	})
 
-	myHTTPHandleFunc("/GetChallenges", requireMethod("POST"), requireToken, func(responseWriter http.ResponseWriter, request *http.Request) bool {
+	myHTTPHandleFunc("/GetChallenges", allowCORS("POST"), requireMethod("POST"), requireToken, func(responseWriter http.ResponseWriter, request *http.Request) bool {
 
 		// requireToken already validated the API Token, so we can just do this:
 		token := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
@@ -228,6 +729,7 @@ func main() {
 		difficultyLevelString := requestQuery.Get("difficultyLevel")
 		difficultyLevel, err := strconv.Atoi(difficultyLevelString)
 		if err != nil {
+			metrics.add("challenges_bad_request", 1)
 			errorMessage := fmt.Sprintf(
 				"400 url param ?difficultyLevel=%s value could not be converted to an integer",
 				difficultyLevelString,
@@ -236,51 +738,77 @@ func main() {
 			return true
 		}
 
-		challengesMu.Lock()
-		if _, has := currentChallengesGeneration[token]; !has {
-			currentChallengesGeneration[token] = 0
+		currentConfig, currentArgon2Parameters := currentConfiguration()
+
+		if err := validateDifficultyLevel(currentConfig, difficultyLevel); err != nil {
+			metrics.add("challenges_bad_request", 1)
+			http.Error(responseWriter, fmt.Sprintf("400 url param ?difficultyLevel=%v", err), http.StatusBadRequest)
+			return true
 		}
-		if _, has := challenges[token]; !has {
-			challenges[token] = map[string]int{}
+
+		// landing workers with a stale config may still ask for a level below the enforced floor
+		if difficultyLevel < currentConfig.MinDifficultyLevelEnforced {
+			metrics.add("challenges_clamped", 1)
+			difficultyLevel = currentConfig.MinDifficultyLevelEnforced
 		}
-		currentChallengesGeneration[token]++
-		tokenChallenges := challenges[token]
-		currentGeneration := currentChallengesGeneration[token]
-		challengesMu.Unlock()
 
-		toReturn := make([]string, config.BatchSize)
-		for i := 0; i < config.BatchSize; i++ {
-			preimageBytes := make([]byte, 8)
-			_, err := rand.Read(preimageBytes)
-			if err != nil {
-				log.Printf("read random bytes failed: %v", err)
-				http.Error(responseWriter, "500 internal server error", http.StatusInternalServerError)
-				return true
-			}
-			preimage := base64.StdEncoding.EncodeToString(preimageBytes)
-			difficultyBytes := make([]byte, int(math.Ceil(float64(difficultyLevel)/float64(8))))
-
-			for j := 0; j < len(difficultyBytes); j++ {
-				difficultyByte := byte(0)
-				for k := 0; k < 8; k++ {
-					currentBitIndex := (j*8 + (7 - k))
-					if currentBitIndex+1 > difficultyLevel {
-						difficultyByte = difficultyByte | 1<<k
-					}
-				}
-				difficultyBytes[j] = difficultyByte
-			}
+		algorithm := requestQuery.Get("algorithm")
+		if algorithm == "" {
+			algorithm = algorithmArgon2id
+		}
+		if !algorithmAllowed(currentConfig, algorithm) {
+			metrics.add("challenges_bad_request", 1)
+			errorMessage := fmt.Sprintf(
+				"400 url param ?algorithm=%s is not allowed, allowed algorithms are: %s",
+				algorithm, strings.Join(currentConfig.AllowedAlgorithms, ", "),
+			)
+			http.Error(responseWriter, errorMessage, http.StatusBadRequest)
+			return true
+		}
+
+		binding := ""
+		if bind := requestQuery.Get("bind"); bind != "" {
+			binding = hashBinding(bind)
+		} else if currentConfig.RequireBinding {
+			metrics.add("challenges_bad_request", 1)
+			http.Error(responseWriter, "400 url param ?bind=<string> is required because require_binding is enabled", http.StatusBadRequest)
+			return true
+		}
+
+		challengeArgon2Parameters := Argon2Parameters{}
+		if algorithm == algorithmArgon2id {
+			challengeArgon2Parameters = argon2ParametersForLevel(currentConfig, currentArgon2Parameters, difficultyLevel)
+		}
 
-			difficulty := hex.EncodeToString(difficultyBytes)
+		difficulty, err := difficultyTargetForLevel(difficultyLevel)
+		if err != nil {
+			log.Printf("difficulty target for level %d failed: %v", difficultyLevel, err)
+			http.Error(responseWriter, "500 internal server error", http.StatusInternalServerError)
+			return true
+		}
+
+		preimages, err := challengePreimagePool.take(currentConfig.BatchSize, currentConfig.PreimageLengthBytes)
+		if err != nil {
+			log.Printf("failed to get challenge preimages: %v", err)
+			http.Error(responseWriter, "500 internal server error", http.StatusInternalServerError)
+			return true
+		}
+
+		issuedAt := time.Now().Unix()
+		toReturn := make([]string, currentConfig.BatchSize)
+		for i, preimage := range preimages {
 			challenge := Challenge{
-				Preimage:        preimage,
-				Difficulty:      difficulty,
-				DifficultyLevel: difficultyLevel,
+				Preimage:           preimage,
+				Difficulty:         difficulty,
+				DifficultyLevel:    difficultyLevel,
+				Algorithm:          algorithm,
+				Binding:            binding,
+				NonceLength:        currentConfig.NonceLengthBytes,
+				PreimageLength:     currentConfig.PreimageLengthBytes,
+				DifficultyPosition: currentConfig.DifficultyPosition,
+				IssuedAt:           issuedAt,
 			}
-			challenge.MemoryKiB = argon2Parameters.MemoryKiB
-			challenge.Iterations = argon2Parameters.Iterations
-			challenge.Parallelism = argon2Parameters.Parallelism
-			challenge.KeyLength = argon2Parameters.KeyLength
+			challenge.Argon2Parameters = challengeArgon2Parameters
 
 			challengeBytes, err := json.Marshal(challenge)
 			if err != nil {
@@ -289,27 +817,44 @@ func main() {
 				return true
 			}
 
-			challengeBase64 := base64.StdEncoding.EncodeToString(challengeBytes)
-			challengesMu.Lock()
-			tokenChallenges[challengeBase64] = currentGeneration
-			challengesMu.Unlock()
-			toReturn[i] = challengeBase64
-		}
-		toRemove := []string{}
-		challengesMu.RLock()
-		for k, generation := range tokenChallenges {
-			if generation+config.DeprecateAfterBatches < currentGeneration {
-				toRemove = append(toRemove, k)
-			}
+			toReturn[i] = base64.StdEncoding.EncodeToString(challengeBytes)
 		}
-		challengesMu.RUnlock()
-		for _, k := range toRemove {
-			challengesMu.Lock()
-			delete(tokenChallenges, k)
-			challengesMu.Unlock()
+
+		batchID, err := challengeStore.Put(token, toReturn, currentConfig.DeprecateAfterBatches)
+		if err != nil {
+			writeStoreError(responseWriter, err, "failed to store challenges")
+			return true
+		}
+		metrics.addForToken("challenge_batches", token, 1)
+		difficultyStats.recordIssued(difficultyLevel, len(toReturn))
+		auditLog.record("challenge_batch", map[string]interface{}{
+			"tokenPrefix":     shortTokenPrefix(token),
+			"batchId":         batchID,
+			"count":           len(toReturn),
+			"difficultyLevel": difficultyLevel,
+			"algorithm":       algorithm,
+			"clientIP":        requestActor(request),
+		})
+
+		var response interface{} = toReturn
+		if requestQuery.Get("format") == "envelope" || strings.Contains(request.Header.Get("Accept"), "application/vnd.powdet.envelope+json") {
+			metrics.addForToken("challenge_batches_envelope", token, 1)
+			envelope := ChallengeBatchEnvelope{
+				Challenges:             toReturn,
+				DifficultyLevel:        difficultyLevel,
+				Algorithm:              algorithm,
+				BatchID:                batchID,
+				DeprecatesAfterBatches: currentConfig.DeprecateAfterBatches,
+				IssuedAt:               time.Unix(issuedAt, 0).UTC().Format(time.RFC3339),
+			}
+			if algorithm == algorithmArgon2id {
+				envelope.Params = &challengeArgon2Parameters
+			}
+			response = envelope
+			responseWriter.Header().Set("Content-Type", "application/json")
 		}
 
-		responseBytes, err := json.Marshal(toReturn)
+		responseBytes, err := json.Marshal(response)
 		if err != nil {
 			log.Printf("json marshal failed: %v", err)
 			http.Error(responseWriter, "500 internal server error", http.StatusInternalServerError)
@@ -321,7 +866,7 @@ func main() {
 		return true
 	})
 
-	myHTTPHandleFunc("/Verify", requireMethod("POST"), requireToken, func(responseWriter http.ResponseWriter, request *http.Request) bool {
+	myHTTPHandleFunc("/Verify", allowCORS("POST"), requireMethod("POST"), requireToken, func(responseWriter http.ResponseWriter, request *http.Request) bool {
 
 		// requireToken already validated the API Token, so we can just do this:
 		token := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
@@ -330,144 +875,123 @@ func main() {
 		challengeBase64 := requestQuery.Get("challenge")
 		nonceHex := requestQuery.Get("nonce")
 
-		challengesMu.Lock()
-		tokenChallenges, hasAnyChallenges := challenges[token]
-		_, hasChallenge := tokenChallenges[challengeBase64]
-		if !hasAnyChallenges || !hasChallenge {
-			challengesMu.Unlock()
+		switch verifyChallenge(token, challengeBase64, nonceHex, requestQuery.Get("bind")) {
+		case verifyNotFound:
 			errorMessage := fmt.Sprintf("404 challenge given by url param ?challenge=%s was not found", challengeBase64)
 			http.Error(responseWriter, errorMessage, http.StatusNotFound)
-			return true
-		}
-		delete(tokenChallenges, challengeBase64)
-		challengesMu.Unlock()
-
-		nonceBuffer := make([]byte, 8)
-		bytesWritten, err := hex.Decode(nonceBuffer, []byte(nonceHex))
-		if nonceHex == "" || err != nil {
+		case verifyBadNonce:
 			errorMessage := fmt.Sprintf("400 bad request: nonce given by url param ?nonce=%s could not be hex decoded", nonceHex)
 			http.Error(responseWriter, errorMessage, http.StatusBadRequest)
-			return true
+		case verifyBadNonceLength:
+			errorMessage := fmt.Sprintf(
+				"400 bad request: nonce given by url param ?nonce=%s must be exactly the number of bytes given by nlen in the challenge",
+				nonceHex,
+			)
+			http.Error(responseWriter, errorMessage, http.StatusBadRequest)
+		case verifyInsufficientDifficulty:
+			errorMessage := fmt.Sprintf(
+				"400 bad request: nonce given by url param ?nonce=%s did not result in a hash that meets the required difficulty",
+				nonceHex,
+			)
+			http.Error(responseWriter, errorMessage, http.StatusBadRequest)
+		case verifyBindMismatch:
+			http.Error(responseWriter, "403 forbidden: url param ?bind= does not match the challenge", http.StatusForbidden)
+		case verifyWrongToken:
+			http.Error(responseWriter, "403 forbidden: the challenge was issued to a different API token", http.StatusForbidden)
+		case verifyStoreUnavailable:
+			http.Error(responseWriter, "503 service unavailable: the challenge store is unreachable", http.StatusServiceUnavailable)
+		case verifyInternalError:
+			http.Error(responseWriter, "500 challenge couldn't be decoded", http.StatusInternalServerError)
+		default:
+			responseWriter.WriteHeader(200)
+			responseWriter.Write([]byte("OK"))
 		}
+		return true
+	})
 
-		nonceBytes := nonceBuffer[:bytesWritten]
+	myHTTPHandleFunc("/VerifyBatch", allowCORS("POST"), requireMethod("POST"), requireToken, func(responseWriter http.ResponseWriter, request *http.Request) bool {
 
-		challengeJSON, err := base64.StdEncoding.DecodeString(challengeBase64)
-		if err != nil {
-			log.Printf("challenge %s couldn't be parsed: %v\n", challengeBase64, err)
-			http.Error(responseWriter, "500 challenge couldn't be decoded", http.StatusInternalServerError)
+		// requireToken already validated the API Token, so we can just do this:
+		token := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+
+		type verifyBatchEntry struct {
+			Challenge string `json:"challenge"`
+			Nonce     string `json:"nonce"`
+			Bind      string `json:"bind"`
+		}
+		type verifyBatchResult struct {
+			OK     bool   `json:"ok"`
+			Reason string `json:"reason,omitempty"`
+		}
+
+		entries := []verifyBatchEntry{}
+		err := json.NewDecoder(request.Body).Decode(&entries)
+		if isRequestBodyTooLarge(err) {
+			currentConfig, _ := currentConfiguration()
+			errorMessage := fmt.Sprintf("413 request entity too large: the body must not exceed %d bytes", currentConfig.MaxRequestBodyBytes)
+			http.Error(responseWriter, errorMessage, http.StatusRequestEntityTooLarge)
 			return true
 		}
-		var challenge Challenge
-		err = json.Unmarshal([]byte(challengeJSON), &challenge)
 		if err != nil {
-			log.Printf("challenge %s (%s) couldn't be parsed: %v\n", string(challengeJSON), challengeBase64, err)
-			http.Error(responseWriter, "500 challenge couldn't be parsed", http.StatusInternalServerError)
+			errorMessage := fmt.Sprintf("400 bad request: body must be a JSON array of {\"challenge\",\"nonce\"} objects: %v", err)
+			http.Error(responseWriter, errorMessage, http.StatusBadRequest)
 			return true
 		}
-
-		preimageBytes := make([]byte, 8)
-		n, err := base64.StdEncoding.Decode(preimageBytes, []byte(challenge.Preimage))
-		if n != 8 || err != nil {
-			log.Printf("invalid preimage %s: %v\n", challenge.Preimage, err)
-			http.Error(responseWriter, "500 invalid preimage", http.StatusInternalServerError)
+		currentConfig, _ := currentConfiguration()
+		if len(entries) > currentConfig.VerifyBatchMaxSize {
+			errorMessage := fmt.Sprintf(
+				"400 bad request: batch of %d entries exceeds the maximum of %d",
+				len(entries), currentConfig.VerifyBatchMaxSize,
+			)
+			http.Error(responseWriter, errorMessage, http.StatusBadRequest)
 			return true
 		}
 
-		hash := argon2.IDKey(
-			nonceBytes,
-			preimageBytes,
-			uint32(challenge.Iterations),
-			uint32(challenge.MemoryKiB),
-			uint8(challenge.Parallelism),
-			uint32(challenge.KeyLength),
-		)
-
-		hashHex := hex.EncodeToString(hash)
-		endOfHash := hashHex[len(hashHex)-len(challenge.Difficulty):]
+		// a failed entry never aborts the batch, every entry gets its own result at the same index
+		results := make([]verifyBatchResult, len(entries))
+		var waitGroup sync.WaitGroup
+		for i, entry := range entries {
+			waitGroup.Add(1)
+			go func(i int, entry verifyBatchEntry) {
+				defer waitGroup.Done()
+				outcome := verifyChallenge(token, entry.Challenge, entry.Nonce, entry.Bind)
+				results[i] = verifyBatchResult{OK: outcome == verifyOK}
+				if outcome != verifyOK {
+					results[i].Reason = outcome.String()
+				}
+			}(i, entry)
+		}
+		waitGroup.Wait()
 
-		log.Printf("endOfHash: %s <= Difficulty: %s", endOfHash, challenge.Difficulty)
-		if endOfHash > challenge.Difficulty {
-			errorMessage := fmt.Sprintf(
-				"400 bad request: nonce given by url param ?nonce=%s did not result in a hash that meets the required difficulty",
-				nonceHex,
-			)
-			http.Error(responseWriter, errorMessage, http.StatusBadRequest)
+		responseBytes, err := json.Marshal(results)
+		if err != nil {
+			log.Printf("json marshal failed: %v", err)
+			http.Error(responseWriter, "500 internal server error", http.StatusInternalServerError)
 			return true
 		}
 
-		responseWriter.WriteHeader(200)
-		responseWriter.Write([]byte("OK"))
+		responseWriter.Header().Set("Content-Type", "application/json")
+		responseWriter.Write(responseBytes)
 		return true
 	})
 
-	// Static assets for the frontend worker (served under /powdet/static)
-	http.HandleFunc("/powdet/static/pow-bot-deterrent.css", func(responseWriter http.ResponseWriter, request *http.Request) {
-		bytez, _ := os.ReadFile("./static/pow-bot-deterrent.css")
-		responseWriter.Header().Set("Content-Type", "text/css")
-		responseWriter.Write(bytez)
-	})
-	http.HandleFunc("/powdet/static/pow-bot-deterrent.js", func(responseWriter http.ResponseWriter, request *http.Request) {
-		bytez, _ := os.ReadFile("./static/pow-bot-deterrent.js")
-		responseWriter.Header().Set("Content-Type", "application/javascript")
-		responseWriter.Write(bytez)
-	})
+	registerDebugHandlers(requireAdmin)
 
-	http.Handle("/powdet/static/", http.StripPrefix("/powdet/static/", http.FileServer(http.Dir("./static/"))))
+	// Static assets for the frontend worker (served under /powdet/static)
+	serveMux.Handle("/powdet/static/", staticHandler("/powdet/static/"))
 	// Backward compatibility for older paths
-	http.Handle("/pow-bot-deterrent-static/", http.StripPrefix("/pow-bot-deterrent-static/", http.FileServer(http.Dir("./static/"))))
-
-	log.Printf("💥  PoW! Bot Deterrent server listening on port %d", config.ListenPort)
-
-	err = http.ListenAndServe(fmt.Sprintf(":%d", config.ListenPort), nil)
-
-	// if got this far it means server crashed!
-	panic(err)
+	serveMux.Handle("/pow-bot-deterrent-static/", legacyStaticHandler("/pow-bot-deterrent-static/", "/powdet/static/"))
 }
 
 func myHTTPHandleFunc(path string, stack ...func(http.ResponseWriter, *http.Request) bool) {
-	http.HandleFunc(path, func(responseWriter http.ResponseWriter, request *http.Request) {
+	serveMux.HandleFunc(path, withAccessLog(func(responseWriter http.ResponseWriter, request *http.Request) {
+		limitRequestBody(responseWriter, request)
 		for _, handler := range stack {
 			if handler(responseWriter, request) {
 				break
 			}
 		}
-	})
-}
-
-func locateAPITokensFolder() string {
-	workingDirectory, err := os.Getwd()
-	if err != nil {
-		log.Fatalf("locateAPITokensFolder(): can't os.Getwd(): %v", err)
-	}
-	executableDirectory, err := getCurrentExecDir()
-	if err != nil {
-		log.Fatalf("locateAPITokensFolder(): can't getCurrentExecDir(): %v", err)
-	}
-
-	nextToExecutable := filepath.Join(executableDirectory, "PoW_Bot_Deterrent_API_Tokens")
-	inWorkingDirectory := filepath.Join(workingDirectory, "PoW_Bot_Deterrent_API_Tokens")
-
-	nextToExecutableStat, err := os.Stat(nextToExecutable)
-	foundKeysNextToExecutable := err == nil && nextToExecutableStat.IsDir()
-	inWorkingDirectoryStat, err := os.Stat(inWorkingDirectory)
-	foundKeysInWorkingDirectory := err == nil && inWorkingDirectoryStat.IsDir()
-	if foundKeysNextToExecutable && foundKeysInWorkingDirectory && workingDirectory != executableDirectory {
-		log.Fatalf(`locateAPITokensFolder(): Something went wrong with your installation, 
-			I found two PoW_Bot_Deterrent_API_Tokens folders and I'm not sure which one to use.
-			One of them is located at %s
-			and the other is at %s`, inWorkingDirectory, nextToExecutable)
-	}
-	if foundKeysInWorkingDirectory {
-		return inWorkingDirectory
-	} else if foundKeysNextToExecutable {
-		return nextToExecutable
-	}
-
-	log.Fatalf(`locateAPITokensFolder(): I didn't find a PoW_Bot_Deterrent_API_Tokens folder 
-		in the current working directory (in %s) or next to the executable (in %s)`, workingDirectory, executableDirectory)
-
-	return ""
+	}))
 }
 
 func getCurrentExecDir() (dir string, err error) {
@@ -488,105 +1012,400 @@ func getCurrentExecDir() (dir string, err error) {
 	return dir, nil
 }
 
-func loadAPITokens() error {
-	tokens := map[string]struct{}{}
-	fileInfos, err := ioutil.ReadDir(apiTokensFolder)
+// loadStartupConfiguration loads and applies config.json, or exits if it has issues.
+func loadStartupConfiguration() Config {
+	appDirectory = locateAppDirectory()
+
+	newConfig, newArgon2Parameters, err := loadConfiguration()
 	if err != nil {
-		return err
+		log.Fatalf("💥 PoW Bot Deterrent can't start because there are configuration issues:\n%v", err)
 	}
-	for _, fileInfo := range fileInfos {
-		parts := strings.Split(fileInfo.Name(), "_")
-		if len(parts) >= 1 && len(parts[0]) == 32 {
-			tokens[parts[0]] = struct{}{}
-		}
-	}
-	apiTokensCache.mu.Lock()
-	apiTokensCache.tokens = tokens
-	apiTokensCache.mu.Unlock()
-	return nil
+	applyConfiguration(newConfig, newArgon2Parameters)
+	return newConfig
 }
 
-func tokenExists(token string) bool {
-	apiTokensCache.mu.RLock()
-	_, ok := apiTokensCache.tokens[token]
-	apiTokensCache.mu.RUnlock()
-	if ok {
-		return true
+func readConfiguration() {
+	newConfig := loadStartupConfiguration()
+
+	var err error
+	challengeStore, err = newChallengeStore(newConfig.ChallengeStore, newConfig.Redis)
+	if err != nil {
+		log.Fatalf("failed to open the challenge store: %v", err)
 	}
-	// refresh once on miss (handles manual token file changes)
-	if err := loadAPITokens(); err != nil {
-		log.Printf("failed to reload API tokens: %v", err)
-		return false
+	if newConfig.PregenPoolSize > 0 {
+		challengePreimagePool = newPreimagePool(newConfig.PregenPoolSize, newConfig.PreimageLengthBytes)
+	}
+
+	slog.Info(
+		"💥 PoW Bot Deterrent starting up",
+		"appVersion", buildVersion, "instance", instanceName(), "configVersion", configVersion, "config", redactedConfigString(newConfig),
+	)
+
+	tokenStore, err = openTokenStore(newConfig.TokenStore, newConfig.Redis)
+	if err != nil {
+		log.Fatalf("failed to open the token store: %v", err)
+	}
+	if newConfig.AuditLog != "" {
+		auditLog, err = startAuditLog(newConfig.AuditLog, newConfig.AuditLogMaxBytes, newConfig.AuditLogMaxFiles)
+		if err != nil {
+			log.Fatalf("failed to start the audit log: %v", err)
+		}
+	}
+	if err := revokeExpiredTokens(); err != nil {
+		log.Printf("failed to schedule the revocation of rotated tokens: %v", err)
 	}
-	apiTokensCache.mu.RLock()
-	_, ok = apiTokensCache.tokens[token]
-	apiTokensCache.mu.RUnlock()
-	return ok
 }
 
-func readConfiguration() string {
-	apiTokensFolder = locateAPITokensFolder()
-	appDirectory = filepath.Dir(apiTokensFolder)
+// loadConfiguration reads and validates config.json (plus POW_BOT_DETERRENT_* environment overrides)
+// without touching the live configuration, so that a failed reload can keep the previous one.
+func loadConfiguration() (Config, Argon2Parameters, error) {
+	var newConfig Config
 	configJsonPath := filepath.Join(appDirectory, "config.json")
-	err := configlite.ReadConfiguration(configJsonPath, "POW_BOT_DETERRENT", []string{}, reflect.ValueOf(&config))
+	err := configlite.ReadConfiguration(configJsonPath, "POW_BOT_DETERRENT", []string{}, reflect.ValueOf(&newConfig))
 	if err != nil {
-		panic(errors.Wrap(err, "ReadConfiguration returned"))
+		return Config{}, Argon2Parameters{}, errors.Wrap(err, "ReadConfiguration returned")
 	}
 
 	errors := []string{}
-	if config.ListenPort == 0 {
-		config.ListenPort = 2370
+	if newConfig.ListenPort == 0 {
+		newConfig.ListenPort = 2370
+	}
+	if newConfig.BatchSize == 0 {
+		newConfig.BatchSize = 1000
+	}
+	if newConfig.DeprecateAfterBatches == 0 {
+		newConfig.DeprecateAfterBatches = 10
+	}
+	if newConfig.Argon2MemoryKiB == 0 {
+		newConfig.Argon2MemoryKiB = 16384
+	}
+	if newConfig.Argon2Iterations == 0 {
+		newConfig.Argon2Iterations = 2
+	}
+	if newConfig.Argon2Parallelism == 0 {
+		newConfig.Argon2Parallelism = 1
+	}
+	if newConfig.ReadTimeoutSeconds == 0 {
+		newConfig.ReadTimeoutSeconds = 10
+	}
+	if newConfig.WriteTimeoutSeconds == 0 {
+		newConfig.WriteTimeoutSeconds = 30
+	}
+	if newConfig.IdleTimeoutSeconds == 0 {
+		newConfig.IdleTimeoutSeconds = 60
+	}
+	if newConfig.MaxHeaderBytes == 0 {
+		newConfig.MaxHeaderBytes = 32 * 1024
+	}
+	if newConfig.MaxRequestBodyBytes == 0 {
+		newConfig.MaxRequestBodyBytes = 64 * 1024
+	}
+	if newConfig.NonceLengthBytes == 0 {
+		newConfig.NonceLengthBytes = 8
+	}
+	if newConfig.NonceLengthBytes < 4 || newConfig.NonceLengthBytes > 32 {
+		errors = append(errors, fmt.Sprintf("nonce_length_bytes (%d) must be between 4 and 32", newConfig.NonceLengthBytes))
+	}
+	if newConfig.PreimageLengthBytes == 0 {
+		newConfig.PreimageLengthBytes = 8
+	}
+	if newConfig.PreimageLengthBytes < 8 || newConfig.PreimageLengthBytes > 64 {
+		errors = append(errors, fmt.Sprintf("preimage_length_bytes (%d) must be between 8 and 64", newConfig.PreimageLengthBytes))
+	}
+	if newConfig.ChallengeStore.TTLSeconds == 0 {
+		newConfig.ChallengeStore.TTLSeconds = 3600
+	}
+	if newConfig.ChallengeStore.TTLSeconds < 0 {
+		errors = append(errors, fmt.Sprintf("challenge_store.ttl_seconds (%d) must not be negative", newConfig.ChallengeStore.TTLSeconds))
+	}
+	if newConfig.DifficultyPosition == "" {
+		newConfig.DifficultyPosition = difficultyPositionTail
+	}
+	if newConfig.DifficultyPosition != difficultyPositionTail && newConfig.DifficultyPosition != difficultyPositionHead {
+		errors = append(errors, fmt.Sprintf("difficulty_position '%s' is invalid, expected tail or head", newConfig.DifficultyPosition))
 	}
-	if config.BatchSize == 0 {
-		config.BatchSize = 1000
+	if newConfig.MinDifficultyLevel == 0 {
+		newConfig.MinDifficultyLevel = 1
 	}
-	if config.DeprecateAfterBatches == 0 {
-		config.DeprecateAfterBatches = 10
+	if newConfig.MaxDifficultyLevel == 0 {
+		newConfig.MaxDifficultyLevel = 64
 	}
-	if config.Argon2MemoryKiB == 0 {
-		config.Argon2MemoryKiB = 16384
+	if newConfig.MinDifficultyLevel < 1 {
+		errors = append(errors, fmt.Sprintf("min_difficulty_level (%d) must be at least 1", newConfig.MinDifficultyLevel))
 	}
-	if config.Argon2Iterations == 0 {
-		config.Argon2Iterations = 2
+	if newConfig.MaxDifficultyLevel < newConfig.MinDifficultyLevel {
+		errors = append(errors, fmt.Sprintf(
+			"max_difficulty_level (%d) must not be less than min_difficulty_level (%d)",
+			newConfig.MaxDifficultyLevel, newConfig.MinDifficultyLevel,
+		))
 	}
-	if config.Argon2Parallelism == 0 {
-		config.Argon2Parallelism = 1
+	if newConfig.MinDifficultyLevelEnforced < 0 || newConfig.MinDifficultyLevelEnforced > newConfig.MaxDifficultyLevel {
+		errors = append(errors, fmt.Sprintf(
+			"min_difficulty_level_enforced (%d) must be between 0 and max_difficulty_level (%d)",
+			newConfig.MinDifficultyLevelEnforced, newConfig.MaxDifficultyLevel,
+		))
 	}
-	if config.AdminAPIToken == "" {
-		errors = append(errors, "the POW_BOT_DETERRENT_ADMIN_API_TOKEN environment variable is required")
+	// the difficulty is compared against the tail of a 16 byte hash, so more bits than that can never be met
+	if newConfig.MaxDifficultyLevel > maxDifficultyLevel {
+		errors = append(errors, fmt.Sprintf("max_difficulty_level (%d) must not exceed %d", newConfig.MaxDifficultyLevel, maxDifficultyLevel))
+	}
+	for i := range newConfig.Argon2Tiers {
+		tier := &newConfig.Argon2Tiers[i]
+		if tier.KeyLength == 0 {
+			tier.KeyLength = 16
+		}
+		tierErrors := []string{}
+		if tier.MaxLevel < 1 {
+			tierErrors = append(tierErrors, "maxLevel must be at least 1")
+		}
+		if tier.Iterations < 1 {
+			tierErrors = append(tierErrors, "iterations must be at least 1")
+		}
+		if tier.Parallelism < 1 || tier.Parallelism > 255 {
+			tierErrors = append(tierErrors, "parallelism must be between 1 and 255")
+		}
+		// argon2 requires at least 8 KiB of memory per lane
+		if tier.MemoryKiB < 8*tier.Parallelism {
+			tierErrors = append(tierErrors, fmt.Sprintf("memoryKiB must be at least 8 * parallelism (%d)", 8*tier.Parallelism))
+		}
+		// the difficulty is compared against the tail of the hash, which must have enough bits for the highest level of the tier
+		if tier.KeyLength < 4 || tier.KeyLength > 64 {
+			tierErrors = append(tierErrors, "keyLength must be between 4 and 64")
+		} else if tier.KeyLength*8 < tier.MaxLevel && tier.KeyLength*8 < newConfig.MaxDifficultyLevel {
+			tierErrors = append(tierErrors, fmt.Sprintf("keyLength (%d bytes) is too short for maxLevel %d", tier.KeyLength, tier.MaxLevel))
+		}
+		for _, tierError := range tierErrors {
+			errors = append(errors, fmt.Sprintf("argon2_tiers[%d]: %s", i, tierError))
+		}
+	}
+	if _, err := parseLogLevel(newConfig.LogLevel); err != nil {
+		errors = append(errors, err.Error())
+	}
+	if newConfig.LogFormat != "" && newConfig.LogFormat != "text" && newConfig.LogFormat != "json" {
+		errors = append(errors, fmt.Sprintf("log_format '%s' is invalid, expected text or json", newConfig.LogFormat))
+	}
+	if len(newConfig.AllowedAlgorithms) == 0 {
+		newConfig.AllowedAlgorithms = []string{algorithmArgon2id}
+	}
+	for _, algorithm := range newConfig.AllowedAlgorithms {
+		if algorithm != algorithmArgon2id && algorithm != algorithmSHA256 {
+			errors = append(errors, fmt.Sprintf("allowed_algorithms contains '%s', expected argon2id or sha256", algorithm))
+		}
+	}
+	if newConfig.VerifyBatchMaxSize == 0 {
+		newConfig.VerifyBatchMaxSize = 20
+	}
+	if newConfig.VerifyBatchMaxSize < 0 {
+		errors = append(errors, fmt.Sprintf("verify_batch_max_size (%d) must not be negative", newConfig.VerifyBatchMaxSize))
+	}
+	for _, allowedOrigin := range newConfig.CORSAllowedOrigins {
+		if allowedOrigin == "*" && newConfig.CORSAllowCredentials {
+			errors = append(errors, "cors_allowed_origins must not contain \"*\" when cors_allow_credentials is enabled, list the origins explicitly")
+		}
+	}
+	if newConfig.TargetSolveSecondsMin < 0 || newConfig.TargetSolveSecondsMax < 0 ||
+		(newConfig.TargetSolveSecondsMax > 0 && newConfig.TargetSolveSecondsMax < newConfig.TargetSolveSecondsMin) {
+		errors = append(errors, fmt.Sprintf(
+			"target_solve_seconds_min (%g) and target_solve_seconds_max (%g) must not be negative, and max must not be below min",
+			newConfig.TargetSolveSecondsMin, newConfig.TargetSolveSecondsMax,
+		))
+	}
+	if newConfig.AuditLogMaxBytes == 0 {
+		newConfig.AuditLogMaxBytes = 100 * 1024 * 1024
+	}
+	if newConfig.AuditLogMaxFiles == 0 {
+		newConfig.AuditLogMaxFiles = 10
+	}
+	if newConfig.SelfTestBudgetSeconds == 0 {
+		newConfig.SelfTestBudgetSeconds = 30
+	}
+	if newConfig.PregenPoolSize < 0 {
+		errors = append(errors, fmt.Sprintf("pregen_pool_size (%d) must not be negative", newConfig.PregenPoolSize))
+	}
+	if newConfig.Argon2MaxConcurrency == 0 {
+		newConfig.Argon2MaxConcurrency = runtime.NumCPU()
+	}
+	// a limit below 1 would block every argon2 verification forever
+	if newConfig.Argon2MaxConcurrency < 0 {
+		errors = append(errors, fmt.Sprintf("argon2_max_concurrency (%d) must not be negative", newConfig.Argon2MaxConcurrency))
+	}
+	if newConfig.AdminAPIToken == "" && len(newConfig.AdminAPITokens) == 0 {
+		errors = append(errors, "the POW_BOT_DETERRENT_ADMIN_API_TOKEN environment variable (or admin_api_tokens) is required")
+	}
+	for i, adminAPIToken := range newConfig.AdminAPITokens {
+		if adminAPIToken == "" {
+			errors = append(errors, fmt.Sprintf("admin_api_tokens[%d] must not be empty", i))
+		}
 	}
 
 	if len(errors) > 0 {
-		log.Fatalln("💥 PoW Bot Deterrent can't start because there are configuration issues:")
-		log.Fatalln(strings.Join(errors, "\n"))
+		return Config{}, Argon2Parameters{}, fmt.Errorf("%s", strings.Join(errors, "\n"))
 	}
 
-	argon2Parameters = Argon2Parameters{
-		MemoryKiB:   config.Argon2MemoryKiB,
-		Iterations:  config.Argon2Iterations,
-		Parallelism: config.Argon2Parallelism,
+	newArgon2Parameters := Argon2Parameters{
+		MemoryKiB:   newConfig.Argon2MemoryKiB,
+		Iterations:  newConfig.Argon2Iterations,
+		Parallelism: newConfig.Argon2Parallelism,
 		KeyLength:   16,
 	}
 
-	log.Println("💥 PoW Bot Deterrent starting up with config:")
-	configToLogBytes, _ := json.MarshalIndent(config, "", "  ")
+	return newConfig, newArgon2Parameters, nil
+}
+
+func applyConfiguration(newConfig Config, newArgon2Parameters Argon2Parameters) {
+	// configVersion is public, so it hashes the redacted config: changing only a secret keeps the version,
+	// and the version can't be used to check guesses of a secret
+	configHash := sha256.Sum256([]byte(redactedConfigString(newConfig)))
+
+	configureLogging(newConfig.LogLevel, newConfig.LogFormat)
+
+	configMu.Lock()
+	config = newConfig
+	argon2Parameters = newArgon2Parameters
+	configVersion = hex.EncodeToString(configHash[:])[:12]
+	configMu.Unlock()
+}
+
+func currentConfiguration() (Config, Argon2Parameters) {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return config, argon2Parameters
+}
+
+func algorithmAllowed(currentConfig Config, algorithm string) bool {
+	for _, allowedAlgorithm := range currentConfig.AllowedAlgorithms {
+		if allowedAlgorithm == algorithm {
+			return true
+		}
+	}
+	return false
+}
+
+// argon2ParametersForLevel picks the first argon2_tiers entry that covers difficultyLevel, falling back to the global parameters.
+func argon2ParametersForLevel(currentConfig Config, defaultParameters Argon2Parameters, difficultyLevel int) Argon2Parameters {
+	for _, tier := range currentConfig.Argon2Tiers {
+		if tier.MaxLevel >= difficultyLevel {
+			return Argon2Parameters{
+				MemoryKiB:   tier.MemoryKiB,
+				Iterations:  tier.Iterations,
+				Parallelism: tier.Parallelism,
+				KeyLength:   tier.KeyLength,
+			}
+		}
+	}
+	return defaultParameters
+}
+
+// reloadConfiguration is triggered by SIGHUP. Outstanding challenges are kept, they embed their own
+// argon2 parameters so they can still be verified after the parameters change.
+func reloadConfiguration() {
+	metrics.add("config_reload_attempts", 1)
+
+	configMu.RLock()
+	oldConfig := config
+	oldConfigVersion := configVersion
+	configMu.RUnlock()
+
+	newConfig, newArgon2Parameters, err := loadConfiguration()
+	if err != nil {
+		metrics.add("config_reload_failures", 1)
+		log.Printf("config reload failed, keeping the previous config (version %s): %v", oldConfigVersion, err)
+		return
+	}
+	if newConfig.ListenPort != oldConfig.ListenPort {
+		slog.Warn("config reload: listen_port changed, this requires a restart to take effect", "from", oldConfig.ListenPort, "to", newConfig.ListenPort)
+	}
+	if newConfig.ReadTimeoutSeconds != oldConfig.ReadTimeoutSeconds || newConfig.WriteTimeoutSeconds != oldConfig.WriteTimeoutSeconds ||
+		newConfig.IdleTimeoutSeconds != oldConfig.IdleTimeoutSeconds || newConfig.MaxHeaderBytes != oldConfig.MaxHeaderBytes {
+		slog.Warn("config reload: http server timeouts / max_header_bytes changed, this requires a restart to take effect")
+	}
+	if newConfig.ChallengeStore != oldConfig.ChallengeStore {
+		slog.Warn("config reload: challenge_store changed, this requires a restart to take effect")
+	}
+	if newConfig.PregenPoolSize != oldConfig.PregenPoolSize {
+		slog.Warn("config reload: pregen_pool_size changed, this requires a restart to take effect")
+	}
+	if newConfig.AuditLog != oldConfig.AuditLog || newConfig.AuditLogMaxBytes != oldConfig.AuditLogMaxBytes ||
+		newConfig.AuditLogMaxFiles != oldConfig.AuditLogMaxFiles {
+		slog.Warn("config reload: audit_log changed, this requires a restart to take effect")
+	}
+	if newConfig.Redis != oldConfig.Redis {
+		slog.Warn("config reload: redis changed, this requires a restart to take effect")
+	}
+	if newConfig.TokenStore != oldConfig.TokenStore {
+		slog.Warn("config reload: token_store changed, this requires a restart to take effect")
+	}
+	applyConfiguration(newConfig, newArgon2Parameters)
+
+	configMu.RLock()
+	newConfigVersion := configVersion
+	configMu.RUnlock()
+
+	slog.Info("config reloaded", "from", oldConfigVersion, "to", newConfigVersion, "config", redactedConfigString(newConfig))
+}
+
+func handleReloadSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			slog.Info("received SIGHUP, reloading configuration")
+			reloadConfiguration()
+		}
+	}()
+}
+
+// handleShutdownSignals stops the server on SIGINT or SIGTERM. /readyz fails right away so the load balancer
+// stops sending traffic, then in-flight requests get shutdownTimeout to finish. The returned channel is closed when they have.
+func handleShutdownSignals(server *http.Server) <-chan struct{} {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	shutdownDone := make(chan struct{})
+	go func() {
+		receivedSignal := <-signals
+		slog.Info("shutting down", "signal", receivedSignal.String())
+		ready.Store(false)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("shutdown didn't finish cleanly: %v", err)
+		}
+		close(shutdownDone)
+	}()
+	return shutdownDone
+}
+
+// isAdminToken compares candidate against every configured admin token in constant time.
+func isAdminToken(currentConfig Config, candidate string) bool {
+	adminAPITokens := append([]string{currentConfig.AdminAPIToken}, currentConfig.AdminAPITokens...)
+	matched := 0
+	for _, adminAPIToken := range adminAPITokens {
+		if adminAPIToken != "" {
+			matched |= subtle.ConstantTimeCompare([]byte(candidate), []byte(adminAPIToken))
+		}
+	}
+	return matched == 1
+}
+
+func redactedConfigString(configToLog Config) string {
+	if configToLog.AdminAPIToken != "" {
+		configToLog.AdminAPIToken = "******"
+	}
+	redactedAdminAPITokens := make([]string, len(configToLog.AdminAPITokens))
+	for i := range redactedAdminAPITokens {
+		redactedAdminAPITokens[i] = "******"
+	}
+	configToLog.AdminAPITokens = redactedAdminAPITokens
+	if configToLog.Redis.Password != "" {
+		configToLog.Redis.Password = "******"
+	}
+
+	configToLogBytes, _ := json.MarshalIndent(configToLog, "", "  ")
 	configToLogString := regexp.MustCompile(
-		`("admin_api_token": ")[^"]+(",)`,
-	).ReplaceAllString(
-		string(configToLogBytes),
-		"$1******$2",
-	)
-	configToLogString = regexp.MustCompile(
 		`("imap_password": ")[^"]+(",?)`,
 	).ReplaceAllString(
-		configToLogString,
+		string(configToLogBytes),
 		"$1******$2",
 	)
-	log.Println(configToLogString)
-
-	if err := loadAPITokens(); err != nil {
-		log.Fatalf("failed to load API tokens from %s: %v", apiTokensFolder, err)
-	}
-
-	return apiTokensFolder
+	return configToLogString
 }
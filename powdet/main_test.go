@@ -0,0 +1,646 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testAdminToken = "test-admin-token"
+
+var registerHandlersOnce sync.Once
+
+// setupTest gives a test its own app directory, configuration and stores, like readConfiguration does at startup.
+// configJSON is merged over small defaults (cheap argon2 parameters, small batches) so challenges solve quickly.
+func setupTest(t testing.TB, configJSON string) {
+	t.Helper()
+	registerHandlersOnce.Do(registerHandlers)
+
+	appDirectory = t.TempDir()
+	writeTestConfig(t, configJSON)
+	newConfig, newArgon2Parameters, err := loadConfiguration()
+	if err != nil {
+		t.Fatalf("loadConfiguration() failed: %v", err)
+	}
+	applyConfiguration(newConfig, newArgon2Parameters)
+
+	challengeStore = newMemoryChallengeStore()
+	tokenStore, err = newJSONTokenStore(
+		filepath.Join(appDirectory, apiTokensJSONFileName),
+		filepath.Join(appDirectory, apiTokensAuditLogFileName),
+	)
+	if err != nil {
+		t.Fatalf("newJSONTokenStore() failed: %v", err)
+	}
+	challengePreimagePool = nil
+	auditLog = nil
+	resetMetrics()
+	resetDifficultyStats()
+}
+
+// writeTestConfig writes config.json to the app directory, so reloadConfiguration can be tested as well.
+func writeTestConfig(t testing.TB, configJSON string) {
+	t.Helper()
+	testConfig := map[string]interface{}{
+		"admin_api_token":    testAdminToken,
+		"batch_size":         5,
+		"argon2_memory_kib":  8,
+		"argon2_iterations":  1,
+		"argon2_parallelism": 1,
+		// keeps the access log of every test request out of the test output
+		"log_level": "warn",
+	}
+	if configJSON != "" {
+		if err := json.Unmarshal([]byte(configJSON), &testConfig); err != nil {
+			t.Fatalf("test config %s is not valid json: %v", configJSON, err)
+		}
+	}
+	configBytes, err := json.Marshal(testConfig)
+	if err != nil {
+		t.Fatalf("json marshal failed: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(appDirectory, "config.json"), configBytes, 0600); err != nil {
+		t.Fatalf("failed to write config.json: %v", err)
+	}
+}
+
+func resetMetrics() {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	metrics.counts = map[string]int64{}
+	metrics.perToken = map[string]map[string]int64{}
+	metrics.labeled = map[string]map[string]int64{}
+}
+
+func resetDifficultyStats() {
+	difficultyStats.mu.Lock()
+	defer difficultyStats.mu.Unlock()
+	difficultyStats.minutes = map[int64]map[int]*difficultyLevelCounts{}
+}
+
+func metricValue(name string) int64 {
+	return metrics.snapshot()[name]
+}
+
+func newTestRequest(method, target, bearerToken, body string) *http.Request {
+	request := httptest.NewRequest(method, target, strings.NewReader(body))
+	if bearerToken != "" {
+		request.Header.Set("Authorization", "Bearer "+bearerToken)
+	}
+	return request
+}
+
+func serveTestRequest(request *http.Request) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	serveMux.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func createTestToken(t testing.TB, name string) string {
+	t.Helper()
+	record, err := createToken(name, "", "test")
+	if err != nil {
+		t.Fatalf("createToken(%s) failed: %v", name, err)
+	}
+	return record.Token
+}
+
+// getTestChallenges asks /GetChallenges for a batch, query is appended to the url as is.
+func getTestChallenges(t testing.TB, token, query string) []string {
+	t.Helper()
+	challenges, err := requestTestChallenges(token, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return challenges
+}
+
+// requestTestChallenges is getTestChallenges for goroutines other than the test's own.
+func requestTestChallenges(token, query string) ([]string, error) {
+	response := serveTestRequest(newTestRequest("POST", "/GetChallenges?"+query, token, ""))
+	if response.Code != http.StatusOK {
+		return nil, fmt.Errorf("/GetChallenges?%s returned %d: %s", query, response.Code, response.Body.String())
+	}
+	challenges := []string{}
+	if err := json.Unmarshal(response.Body.Bytes(), &challenges); err != nil {
+		return nil, fmt.Errorf("/GetChallenges?%s returned invalid json: %v", query, err)
+	}
+	return challenges, nil
+}
+
+func decodeTestChallenge(t testing.TB, challengeBase64 string) Challenge {
+	t.Helper()
+	challengeJSON, err := base64.StdEncoding.DecodeString(challengeBase64)
+	if err != nil {
+		t.Fatalf("challenge %s is not base64: %v", challengeBase64, err)
+	}
+	var challenge Challenge
+	if err := json.Unmarshal(challengeJSON, &challenge); err != nil {
+		t.Fatalf("challenge %s is not json: %v", challengeJSON, err)
+	}
+	return challenge
+}
+
+// solveTestChallenge brute forces a nonce for the challenge like the browser does.
+func solveTestChallenge(t testing.TB, challengeBase64 string) string {
+	t.Helper()
+	nonceHex, err := solveChallenge(challengeBase64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nonceHex
+}
+
+// solveChallenge is solveTestChallenge for goroutines other than the test's own.
+func solveChallenge(challengeBase64 string) (string, error) {
+	challengeJSON, err := base64.StdEncoding.DecodeString(challengeBase64)
+	if err != nil {
+		return "", fmt.Errorf("challenge %s is not base64: %v", challengeBase64, err)
+	}
+	var challenge Challenge
+	if err := json.Unmarshal(challengeJSON, &challenge); err != nil {
+		return "", fmt.Errorf("challenge %s is not json: %v", challengeJSON, err)
+	}
+	preimageBytes, err := base64.StdEncoding.DecodeString(challenge.Preimage)
+	if err != nil {
+		return "", fmt.Errorf("preimage %s is not base64: %v", challenge.Preimage, err)
+	}
+	nonceLength := challenge.NonceLength
+	if nonceLength == 0 {
+		nonceLength = legacyMaxNonceLength
+	}
+	nonceBytes := make([]byte, nonceLength)
+	for attempt := uint32(0); attempt < 1<<20; attempt++ {
+		binary.BigEndian.PutUint32(nonceBytes[len(nonceBytes)-4:], attempt)
+		hash, err := hashChallenge(challenge, nonceBytes, preimageBytes)
+		if err != nil {
+			return "", err
+		}
+		meetsDifficulty, err := hashMeetsDifficulty(challenge, hash)
+		if err != nil {
+			return "", err
+		}
+		if meetsDifficulty {
+			return hex.EncodeToString(nonceBytes), nil
+		}
+	}
+	return "", fmt.Errorf("no nonce found for challenge %s", challengeBase64)
+}
+
+func TestChallengesPurge(t *testing.T) {
+	testCases := []struct {
+		name       string
+		purge      string
+		adminToken string
+		wantStatus int
+		wantPurged int64
+	}{
+		{name: "named token", purge: "a", adminToken: testAdminToken, wantStatus: http.StatusOK, wantPurged: 5},
+		{name: "unknown token", purge: "unknown", adminToken: testAdminToken, wantStatus: http.StatusNotFound},
+		{name: "missing token", purge: "", adminToken: testAdminToken, wantStatus: http.StatusBadRequest},
+		{name: "not an admin", purge: "a", adminToken: "wrong", wantStatus: http.StatusUnauthorized},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			setupTest(t, "")
+			tokens := map[string]string{"a": createTestToken(t, "a"), "b": createTestToken(t, "b")}
+			getTestChallenges(t, tokens["a"], "difficultyLevel=1")
+			getTestChallenges(t, tokens["b"], "difficultyLevel=1")
+
+			purgeToken := testCase.purge
+			if token, has := tokens[purgeToken]; has {
+				purgeToken = token
+			}
+			response := serveTestRequest(newTestRequest("POST", "/Challenges/Purge?token="+purgeToken, testCase.adminToken, ""))
+			if response.Code != testCase.wantStatus {
+				t.Fatalf("purge returned %d, want %d: %s", response.Code, testCase.wantStatus, response.Body.String())
+			}
+			if purged := metricValue("challenges_purged"); purged != testCase.wantPurged {
+				t.Errorf("challenges_purged is %d, want %d", purged, testCase.wantPurged)
+			}
+
+			countByToken, err := challengeStore.CountByToken()
+			if err != nil {
+				t.Fatalf("CountByToken() failed: %v", err)
+			}
+			if countByToken[tokens["b"]].Count != 5 {
+				t.Errorf("token b has %d challenges after the purge, want 5", countByToken[tokens["b"]].Count)
+			}
+			wantCountA := 5
+			if testCase.wantStatus == http.StatusOK {
+				wantCountA = 0
+			}
+			if countByToken[tokens["a"]].Count != wantCountA {
+				t.Errorf("token a has %d challenges after the purge, want %d", countByToken[tokens["a"]].Count, wantCountA)
+			}
+		})
+	}
+}
+
+func TestChallengesListsEveryToken(t *testing.T) {
+	setupTest(t, "")
+	token := createTestToken(t, "a")
+	getTestChallenges(t, token, "difficultyLevel=1")
+	getTestChallenges(t, token, "difficultyLevel=1")
+
+	response := serveTestRequest(newTestRequest("GET", "/Challenges", testAdminToken, ""))
+	if response.Code != http.StatusOK {
+		t.Fatalf("/Challenges returned %d: %s", response.Code, response.Body.String())
+	}
+	output := map[string]ChallengeStats{}
+	if err := json.Unmarshal(response.Body.Bytes(), &output); err != nil {
+		t.Fatalf("/Challenges returned invalid json: %v", err)
+	}
+	want := ChallengeStats{Count: 10, CurrentGeneration: 2, OldestGeneration: 1}
+	if output[token] != want {
+		t.Errorf("/Challenges reported %+v for the token, want %+v", output[token], want)
+	}
+}
+
+func TestLoadConfigurationValidation(t *testing.T) {
+	testCases := []struct {
+		name       string
+		configJSON string
+		wantError  string
+	}{
+		{name: "defaults", configJSON: ``},
+		{name: "negative verify_batch_max_size", configJSON: `{"verify_batch_max_size": -1}`, wantError: "verify_batch_max_size (-1) must not be negative"},
+		{name: "negative argon2_max_concurrency", configJSON: `{"argon2_max_concurrency": -2}`, wantError: "argon2_max_concurrency (-2) must not be negative"},
+		{name: "empty admin_api_tokens entry", configJSON: `{"admin_api_tokens": ["new-admin-token", ""]}`, wantError: "admin_api_tokens[1] must not be empty"},
+		{name: "unknown allowed_algorithms entry", configJSON: `{"allowed_algorithms": ["argon2id", "md5"]}`, wantError: "allowed_algorithms contains 'md5', expected argon2id or sha256"},
+		{name: "negative min_difficulty_level_enforced", configJSON: `{"min_difficulty_level_enforced": -1}`, wantError: "min_difficulty_level_enforced (-1) must be between 0 and max_difficulty_level (64)"},
+		{name: "min_difficulty_level_enforced above the max", configJSON: `{"max_difficulty_level": 10, "min_difficulty_level_enforced": 11}`, wantError: "min_difficulty_level_enforced (11) must be between 0 and max_difficulty_level (10)"},
+		{name: "nonce_length_bytes too short", configJSON: `{"nonce_length_bytes": 3}`, wantError: "nonce_length_bytes (3) must be between 4 and 32"},
+		{name: "nonce_length_bytes too long", configJSON: `{"nonce_length_bytes": 33}`, wantError: "nonce_length_bytes (33) must be between 4 and 32"},
+		{name: "cors wildcard with credentials", configJSON: `{"cors_allowed_origins": ["*"], "cors_allow_credentials": true}`, wantError: "cors_allowed_origins must not contain \"*\" when cors_allow_credentials is enabled"},
+		{name: "preimage_length_bytes too short", configJSON: `{"preimage_length_bytes": 7}`, wantError: "preimage_length_bytes (7) must be between 8 and 64"},
+		{name: "unknown difficulty_position", configJSON: `{"difficulty_position": "middle"}`, wantError: "difficulty_position 'middle' is invalid, expected tail or head"},
+		{name: "negative challenge_store.ttl_seconds", configJSON: `{"challenge_store": {"ttl_seconds": -1}}`, wantError: "challenge_store.ttl_seconds (-1) must not be negative"},
+		{name: "valid argon2 tier", configJSON: `{"argon2_tiers": [{"maxLevel": 4, "memoryKiB": 8, "iterations": 1, "parallelism": 1}]}`},
+		{name: "argon2 tier without maxLevel", configJSON: `{"argon2_tiers": [{"memoryKiB": 8, "iterations": 1, "parallelism": 1}]}`, wantError: "argon2_tiers[0]: maxLevel must be at least 1"},
+		{name: "argon2 tier without iterations", configJSON: `{"argon2_tiers": [{"maxLevel": 4, "memoryKiB": 8, "parallelism": 1}]}`, wantError: "argon2_tiers[0]: iterations must be at least 1"},
+		{name: "argon2 tier parallelism too high", configJSON: `{"argon2_tiers": [{"maxLevel": 4, "memoryKiB": 4096, "iterations": 1, "parallelism": 256}]}`, wantError: "argon2_tiers[0]: parallelism must be between 1 and 255"},
+		{name: "argon2 tier memory too low", configJSON: `{"argon2_tiers": [{"maxLevel": 4, "memoryKiB": 8, "iterations": 1, "parallelism": 2}]}`, wantError: "argon2_tiers[0]: memoryKiB must be at least 8 * parallelism (16)"},
+		{name: "argon2 tier keyLength out of range", configJSON: `{"argon2_tiers": [{"maxLevel": 4, "memoryKiB": 8, "iterations": 1, "parallelism": 1, "keyLength": 65}]}`, wantError: "argon2_tiers[0]: keyLength must be between 4 and 64"},
+		{name: "argon2 tier keyLength too short for maxLevel", configJSON: `{"argon2_tiers": [{"maxLevel": 40, "memoryKiB": 8, "iterations": 1, "parallelism": 1, "keyLength": 4}]}`, wantError: "argon2_tiers[0]: keyLength (4 bytes) is too short for maxLevel 40"},
+		{name: "second argon2 tier is reported by index", configJSON: `{"argon2_tiers": [{"maxLevel": 4, "memoryKiB": 8, "iterations": 1, "parallelism": 1}, {"maxLevel": 8}]}`, wantError: "argon2_tiers[1]: iterations must be at least 1"},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			appDirectory = t.TempDir()
+			writeTestConfig(t, testCase.configJSON)
+			_, _, err := loadConfiguration()
+			if testCase.wantError == "" {
+				if err != nil {
+					t.Errorf("loadConfiguration() failed: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), testCase.wantError) {
+				t.Errorf("loadConfiguration() returned %v, want an error containing %q", err, testCase.wantError)
+			}
+		})
+	}
+}
+
+func TestArgon2TiersForBoundaryLevels(t *testing.T) {
+	setupTest(t, `{
+		"argon2_memory_kib": 24,
+		"argon2_tiers": [
+			{"maxLevel": 4, "memoryKiB": 8, "iterations": 1, "parallelism": 1},
+			{"maxLevel": 8, "memoryKiB": 16, "iterations": 2, "parallelism": 1, "keyLength": 32}
+		]
+	}`)
+	token := createTestToken(t, "a")
+	cheapTier := Argon2Parameters{MemoryKiB: 8, Iterations: 1, Parallelism: 1, KeyLength: 16}
+	heavyTier := Argon2Parameters{MemoryKiB: 16, Iterations: 2, Parallelism: 1, KeyLength: 32}
+	global := Argon2Parameters{MemoryKiB: 24, Iterations: 1, Parallelism: 1, KeyLength: 16}
+
+	testCases := []struct {
+		difficultyLevel int
+		want            Argon2Parameters
+	}{
+		{difficultyLevel: 1, want: cheapTier},
+		{difficultyLevel: 4, want: cheapTier},
+		{difficultyLevel: 5, want: heavyTier},
+		{difficultyLevel: 8, want: heavyTier},
+		{difficultyLevel: 9, want: global},
+	}
+	for _, testCase := range testCases {
+		t.Run(fmt.Sprint(testCase.difficultyLevel), func(t *testing.T) {
+			challenges := getTestChallenges(t, token, fmt.Sprintf("difficultyLevel=%d", testCase.difficultyLevel))
+			challenge := decodeTestChallenge(t, challenges[0])
+			if challenge.Argon2Parameters != testCase.want {
+				t.Errorf("difficultyLevel %d embeds %+v, want %+v", testCase.difficultyLevel, challenge.Argon2Parameters, testCase.want)
+			}
+		})
+	}
+
+	// the parameters travel with the challenge, so /Verify needs nothing else to check a tier challenge
+	challenges := getTestChallenges(t, token, "difficultyLevel=5")
+	nonce := solveTestChallenge(t, challenges[0])
+	response := serveTestRequest(newTestRequest("POST", "/Verify?challenge="+challenges[0]+"&nonce="+nonce, token, ""))
+	if response.Code != http.StatusOK {
+		t.Errorf("/Verify of a tier challenge returned %d: %s", response.Code, response.Body.String())
+	}
+}
+
+func TestAdminTokens(t *testing.T) {
+	setupTest(t, `{"admin_api_token": "old-admin-token", "admin_api_tokens": ["new-admin-token"]}`)
+	testCases := []struct {
+		name          string
+		authorization string
+		wantStatus    int
+	}{
+		{name: "single admin_api_token", authorization: "Bearer old-admin-token", wantStatus: http.StatusOK},
+		{name: "token from admin_api_tokens", authorization: "Bearer new-admin-token", wantStatus: http.StatusOK},
+		{name: "third token", authorization: "Bearer other-admin-token", wantStatus: http.StatusUnauthorized},
+		{name: "prefix of a token", authorization: "Bearer old-admin", wantStatus: http.StatusUnauthorized},
+		{name: "empty token", authorization: "Bearer ", wantStatus: http.StatusUnauthorized},
+		{name: "without Bearer", authorization: "new-admin-token", wantStatus: http.StatusUnauthorized},
+		{name: "no header", wantStatus: http.StatusUnauthorized},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			request := newTestRequest("GET", "/Tokens", "", "")
+			if testCase.authorization != "" {
+				request.Header.Set("Authorization", testCase.authorization)
+			}
+			if response := serveTestRequest(request); response.Code != testCase.wantStatus {
+				t.Errorf("/Tokens returned %d, want %d", response.Code, testCase.wantStatus)
+			}
+		})
+	}
+}
+
+func TestMinDifficultyLevelEnforcedAfterReload(t *testing.T) {
+	setupTest(t, "")
+	token := createTestToken(t, "a")
+	if challenge := decodeTestChallenge(t, getTestChallenges(t, token, "difficultyLevel=2")[0]); challenge.DifficultyLevel != 2 {
+		t.Fatalf("without a floor difficultyLevel=2 was issued at %d", challenge.DifficultyLevel)
+	}
+
+	// the floor arrives with a config refresh, no restart
+	writeTestConfig(t, `{"min_difficulty_level_enforced": 6}`)
+	reloadConfiguration()
+	levelSix := decodeTestChallenge(t, getTestChallenges(t, token, "difficultyLevel=6")[0])
+
+	testCases := []struct {
+		requestedLevel int
+		wantLevel      int
+		wantClamped    int64
+	}{
+		{requestedLevel: 2, wantLevel: 6, wantClamped: 1},
+		{requestedLevel: 5, wantLevel: 6, wantClamped: 2},
+		{requestedLevel: 6, wantLevel: 6, wantClamped: 2},
+		{requestedLevel: 8, wantLevel: 8, wantClamped: 2},
+	}
+	for _, testCase := range testCases {
+		challenge := decodeTestChallenge(t, getTestChallenges(t, token, fmt.Sprintf("difficultyLevel=%d", testCase.requestedLevel))[0])
+		if challenge.DifficultyLevel != testCase.wantLevel {
+			t.Errorf("difficultyLevel=%d was issued at %d, want %d", testCase.requestedLevel, challenge.DifficultyLevel, testCase.wantLevel)
+		}
+		// clients solve against the embedded difficulty, so it has to be the clamped one too
+		if testCase.wantLevel == 6 && challenge.Difficulty != levelSix.Difficulty {
+			t.Errorf("difficultyLevel=%d embeds difficulty %s, want %s", testCase.requestedLevel, challenge.Difficulty, levelSix.Difficulty)
+		}
+		if clamped := metricValue("challenges_clamped"); clamped != testCase.wantClamped {
+			t.Errorf("after difficultyLevel=%d challenges_clamped is %d, want %d", testCase.requestedLevel, clamped, testCase.wantClamped)
+		}
+	}
+}
+
+func TestGetChallengesDifficultyLevelBounds(t *testing.T) {
+	testCases := []struct {
+		difficultyLevel string
+		wantStatus      int
+	}{
+		{difficultyLevel: "-1", wantStatus: http.StatusBadRequest},
+		{difficultyLevel: "0", wantStatus: http.StatusBadRequest},
+		{difficultyLevel: "1", wantStatus: http.StatusOK},
+		{difficultyLevel: "64", wantStatus: http.StatusOK},
+		{difficultyLevel: "65", wantStatus: http.StatusBadRequest},
+		{difficultyLevel: "4096", wantStatus: http.StatusBadRequest},
+		{difficultyLevel: "abc", wantStatus: http.StatusBadRequest},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.difficultyLevel, func(t *testing.T) {
+			setupTest(t, "")
+			token := createTestToken(t, "a")
+			response := serveTestRequest(newTestRequest("POST", "/GetChallenges?difficultyLevel="+testCase.difficultyLevel, token, ""))
+			if response.Code != testCase.wantStatus {
+				t.Fatalf("difficultyLevel=%s returned %d, want %d: %s", testCase.difficultyLevel, response.Code, testCase.wantStatus, response.Body.String())
+			}
+			wantBadRequests := int64(0)
+			if testCase.wantStatus == http.StatusBadRequest {
+				wantBadRequests = 1
+			}
+			if badRequests := metricValue("challenges_bad_request"); badRequests != wantBadRequests {
+				t.Errorf("challenges_bad_request is %d, want %d", badRequests, wantBadRequests)
+			}
+			if testCase.wantStatus == http.StatusBadRequest && testCase.difficultyLevel != "abc" &&
+				!strings.Contains(response.Body.String(), "must be between 1 and 64 (inclusive)") {
+				t.Errorf("the error %q doesn't name the allowed range", response.Body.String())
+			}
+		})
+	}
+}
+
+func TestGetChallengesConfiguredDifficultyRange(t *testing.T) {
+	setupTest(t, `{"min_difficulty_level": 4, "max_difficulty_level": 8}`)
+	token := createTestToken(t, "a")
+	for difficultyLevel, wantStatus := range map[string]int{"3": 400, "4": 200, "8": 200, "9": 400} {
+		response := serveTestRequest(newTestRequest("POST", "/GetChallenges?difficultyLevel="+difficultyLevel, token, ""))
+		if response.Code != wantStatus {
+			t.Errorf("difficultyLevel=%s returned %d, want %d", difficultyLevel, response.Code, wantStatus)
+		}
+	}
+}
+
+func TestGetChallengesEnvelope(t *testing.T) {
+	testCases := []struct {
+		name          string
+		query         string
+		accept        string
+		wantEnvelope  bool
+		wantAlgorithm string
+	}{
+		{name: "bare array by default", query: "difficultyLevel=4", wantAlgorithm: algorithmArgon2id},
+		{name: "format=envelope", query: "difficultyLevel=4&format=envelope", wantEnvelope: true, wantAlgorithm: algorithmArgon2id},
+		{name: "Accept header", query: "difficultyLevel=4", accept: "application/vnd.powdet.envelope+json", wantEnvelope: true, wantAlgorithm: algorithmArgon2id},
+		{name: "sha256 envelope", query: "difficultyLevel=4&algorithm=sha256&format=envelope", wantEnvelope: true, wantAlgorithm: algorithmSHA256},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			setupTest(t, `{"allowed_algorithms": ["argon2id", "sha256"], "deprecate_after_batches": 7}`)
+			token := createTestToken(t, "a")
+			// a second batch, so the batch id isn't 1 by coincidence
+			getTestChallenges(t, token, "difficultyLevel=4")
+
+			request := newTestRequest("POST", "/GetChallenges?"+testCase.query, token, "")
+			if testCase.accept != "" {
+				request.Header.Set("Accept", testCase.accept)
+			}
+			response := serveTestRequest(request)
+			if response.Code != http.StatusOK {
+				t.Fatalf("/GetChallenges returned %d: %s", response.Code, response.Body.String())
+			}
+			if !testCase.wantEnvelope {
+				var challenges []string
+				if err := json.Unmarshal(response.Body.Bytes(), &challenges); err != nil || len(challenges) != 5 {
+					t.Errorf("the default response %s is not a bare array of 5 challenges: %v", response.Body.String(), err)
+				}
+				if envelopes := metricValue("challenge_batches_envelope"); envelopes != 0 {
+					t.Errorf("challenge_batches_envelope is %d, want 0", envelopes)
+				}
+				return
+			}
+
+			var envelope ChallengeBatchEnvelope
+			if err := json.Unmarshal(response.Body.Bytes(), &envelope); err != nil {
+				t.Fatalf("the envelope %s is not json: %v", response.Body.String(), err)
+			}
+			if len(envelope.Challenges) != 5 {
+				t.Fatalf("the envelope holds %d challenges, want 5", len(envelope.Challenges))
+			}
+			if envelope.BatchID != 2 || envelope.DeprecatesAfterBatches != 7 || envelope.DifficultyLevel != 4 {
+				t.Errorf("the envelope has batchId %d, deprecatesAfterBatches %d, difficultyLevel %d, want 2, 7, 4",
+					envelope.BatchID, envelope.DeprecatesAfterBatches, envelope.DifficultyLevel)
+			}
+			issuedAt, err := time.Parse(time.RFC3339, envelope.IssuedAt)
+			if err != nil {
+				t.Errorf("issuedAt %q is not RFC 3339: %v", envelope.IssuedAt, err)
+			}
+			if envelope.Algorithm != testCase.wantAlgorithm {
+				t.Errorf("the envelope has algorithm %q, want %q", envelope.Algorithm, testCase.wantAlgorithm)
+			}
+			if (envelope.Params == nil) != (testCase.wantAlgorithm == algorithmSHA256) {
+				t.Errorf("the envelope params are %+v for a %s batch", envelope.Params, testCase.wantAlgorithm)
+			}
+			for _, challengeBase64 := range envelope.Challenges {
+				challenge := decodeTestChallenge(t, challengeBase64)
+				if challenge.DifficultyLevel != envelope.DifficultyLevel {
+					t.Errorf("a challenge has difficulty level %d, the envelope says %d", challenge.DifficultyLevel, envelope.DifficultyLevel)
+				}
+				if challenge.IssuedAt != issuedAt.Unix() {
+					t.Errorf("a challenge was issued at %d, the envelope says %s", challenge.IssuedAt, envelope.IssuedAt)
+				}
+				if challenge.Algorithm != envelope.Algorithm {
+					t.Errorf("a challenge has algorithm %q, the envelope says %q", challenge.Algorithm, envelope.Algorithm)
+				}
+				if envelope.Params != nil && challenge.Argon2Parameters != *envelope.Params {
+					t.Errorf("a challenge has params %+v, the envelope says %+v", challenge.Argon2Parameters, *envelope.Params)
+				}
+			}
+			if envelopes := metricValue("challenge_batches_envelope"); envelopes != 1 {
+				t.Errorf("challenge_batches_envelope is %d, want 1", envelopes)
+			}
+		})
+	}
+}
+
+func TestPowdetConfigTracksReloads(t *testing.T) {
+	setupTest(t, "")
+	type discoveryDocument struct {
+		Argon2           Argon2Parameters `json:"argon2"`
+		NonceLengthBytes int              `json:"nonceLengthBytes"`
+		Algorithms       []string         `json:"algorithms"`
+		StaticBase       string           `json:"staticBase"`
+		ConfigVersion    string           `json:"configVersion"`
+	}
+	getDocument := func() discoveryDocument {
+		t.Helper()
+		response := serveTestRequest(newTestRequest("GET", "/powdet/config", "", ""))
+		if response.Code != http.StatusOK {
+			t.Fatalf("/powdet/config returned %d: %s", response.Code, response.Body.String())
+		}
+		if response.Header().Get("Cache-Control") != "public, max-age=60" {
+			t.Errorf("/powdet/config has Cache-Control %q", response.Header().Get("Cache-Control"))
+		}
+		if strings.Contains(response.Body.String(), testAdminToken) {
+			t.Errorf("/powdet/config leaks the admin token: %s", response.Body.String())
+		}
+		var document discoveryDocument
+		if err := json.Unmarshal(response.Body.Bytes(), &document); err != nil {
+			t.Fatalf("/powdet/config returned invalid json: %v", err)
+		}
+		return document
+	}
+
+	before := getDocument()
+	wantBefore := discoveryDocument{
+		Argon2:           Argon2Parameters{MemoryKiB: 8, Iterations: 1, Parallelism: 1, KeyLength: before.Argon2.KeyLength},
+		NonceLengthBytes: 8,
+		Algorithms:       []string{algorithmArgon2id},
+		StaticBase:       "/powdet/static/",
+		ConfigVersion:    configVersion,
+	}
+	if !reflect.DeepEqual(before, wantBefore) {
+		t.Errorf("/powdet/config returned %+v, want %+v", before, wantBefore)
+	}
+
+	writeTestConfig(t, `{"argon2_memory_kib": 16, "argon2_iterations": 2, "nonce_length_bytes": 12, "allowed_algorithms": ["argon2id", "sha256"]}`)
+	reloadConfiguration()
+	after := getDocument()
+	wantAfter := discoveryDocument{
+		Argon2:           Argon2Parameters{MemoryKiB: 16, Iterations: 2, Parallelism: 1, KeyLength: before.Argon2.KeyLength},
+		NonceLengthBytes: 12,
+		Algorithms:       []string{algorithmArgon2id, algorithmSHA256},
+		StaticBase:       "/powdet/static/",
+		ConfigVersion:    configVersion,
+	}
+	if !reflect.DeepEqual(after, wantAfter) {
+		t.Errorf("/powdet/config after a reload returned %+v, want %+v", after, wantAfter)
+	}
+	if after.ConfigVersion == before.ConfigVersion {
+		t.Errorf("configVersion stayed %s across a config change", after.ConfigVersion)
+	}
+
+	response := serveTestRequest(newTestRequest("POST", "/powdet/config", "", ""))
+	if response.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /powdet/config returned %d, want 405", response.Code)
+	}
+}
+
+// configVersion is served without auth, so it must not change, and can't be used to guess, when only a secret does
+func TestConfigVersionIgnoresSecrets(t *testing.T) {
+	baseConfig := `{"admin_api_tokens": ["second-admin-token"], "redis": {"addr": "localhost:6379", "password": "redis-password"}}`
+	testCases := []struct {
+		name        string
+		configJSON  string
+		wantChanged bool
+	}{
+		{name: "admin_api_token", configJSON: `{"admin_api_token": "another-admin-token"}`},
+		{name: "admin_api_tokens entry", configJSON: `{"admin_api_tokens": ["another-second-admin-token"]}`},
+		{name: "redis password", configJSON: `{"redis": {"addr": "localhost:6379", "password": "another-redis-password"}}`},
+		{name: "batch_size", configJSON: `{"batch_size": 6}`, wantChanged: true},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			setupTest(t, baseConfig)
+			before := configVersion
+
+			var changedConfig map[string]interface{}
+			json.Unmarshal([]byte(baseConfig), &changedConfig)
+			json.Unmarshal([]byte(testCase.configJSON), &changedConfig)
+			changedConfigJSON, _ := json.Marshal(changedConfig)
+			writeTestConfig(t, string(changedConfigJSON))
+			reloadConfiguration()
+
+			if changed := configVersion != before; changed != testCase.wantChanged {
+				t.Errorf("changing %s moved configVersion from %s to %s, want changed %t", testCase.name, before, configVersion, testCase.wantChanged)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"sync"
+)
+
+// at most this many distinct token prefixes are tracked, the rest are summed up under otherTokensKey
+const maxPerTokenPrefixes = 100
+const otherTokensKey = "other"
+
+// at most this many distinct labels are tracked per labeled counter, the rest are summed up under otherLabelsKey
+const maxLabelsPerCounter = 100
+const otherLabelsKey = "other"
+
+type metricsCounters struct {
+	counts map[string]int64
+	// token prefix -> counter name -> count, only filled when metrics_per_token is enabled
+	perToken map[string]map[string]int64
+	// counter name -> label -> count
+	labeled map[string]map[string]int64
+	mu      sync.Mutex
+}
+
+var metrics = metricsCounters{
+	counts:   map[string]int64{},
+	perToken: map[string]map[string]int64{},
+	labeled:  map[string]map[string]int64{},
+}
+
+func (m *metricsCounters) add(name string, delta int64) {
+	m.mu.Lock()
+	m.counts[name] += delta
+	m.mu.Unlock()
+}
+
+// set overwrites a gauge such as tokens_folder_unavailable, gauges share the snapshot with the counters.
+func (m *metricsCounters) set(name string, value int64) {
+	m.mu.Lock()
+	m.counts[name] = value
+	m.mu.Unlock()
+}
+
+// addForToken counts like add, and additionally per token prefix when metrics_per_token is enabled.
+// Only the first 8 hex characters of the token are kept so the snapshot never leaks a usable token.
+func (m *metricsCounters) addForToken(name, token string, delta int64) {
+	currentConfig, _ := currentConfiguration()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counts[name] += delta
+	if !currentConfig.MetricsPerToken {
+		return
+	}
+
+	tokenPrefix := shortTokenPrefix(token)
+	if _, has := m.perToken[tokenPrefix]; !has {
+		if len(m.perToken) >= maxPerTokenPrefixes {
+			tokenPrefix = otherTokensKey
+		}
+		if _, has := m.perToken[tokenPrefix]; !has {
+			m.perToken[tokenPrefix] = map[string]int64{}
+		}
+	}
+	m.perToken[tokenPrefix][name] += delta
+}
+
+// addLabeled counts like add, and additionally under label, e.g. a referer host.
+func (m *metricsCounters) addLabeled(name, label string, delta int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counts[name] += delta
+	if _, has := m.labeled[name]; !has {
+		m.labeled[name] = map[string]int64{}
+	}
+	if _, has := m.labeled[name][label]; !has && len(m.labeled[name]) >= maxLabelsPerCounter {
+		label = otherLabelsKey
+	}
+	m.labeled[name][label] += delta
+}
+
+func (m *metricsCounters) snapshot() map[string]int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	toReturn := make(map[string]int64, len(m.counts))
+	for name, count := range m.counts {
+		toReturn[name] = count
+	}
+	return toReturn
+}
+
+func (m *metricsCounters) snapshotPerToken() map[string]map[string]int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	toReturn := make(map[string]map[string]int64, len(m.perToken))
+	for tokenPrefix, counts := range m.perToken {
+		toReturn[tokenPrefix] = make(map[string]int64, len(counts))
+		for name, count := range counts {
+			toReturn[tokenPrefix][name] = count
+		}
+	}
+	return toReturn
+}
+
+func (m *metricsCounters) snapshotLabeled() map[string]map[string]int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	toReturn := make(map[string]map[string]int64, len(m.labeled))
+	for name, labels := range m.labeled {
+		toReturn[name] = make(map[string]int64, len(labels))
+		for label, count := range labels {
+			toReturn[name][label] = count
+		}
+	}
+	return toReturn
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestMetricsPerTokenCap(t *testing.T) {
+	setupTest(t, `{"metrics_per_token": true}`)
+	for i := 0; i < maxPerTokenPrefixes+5; i++ {
+		metrics.addForToken("verify_ok", fmt.Sprintf("%08x%024x", i, 0), 1)
+	}
+	perToken := metrics.snapshotPerToken()
+	testCases := []struct {
+		tokenPrefix string
+		want        int64
+	}{
+		{tokenPrefix: "00000000", want: 1},
+		{tokenPrefix: fmt.Sprintf("%08x", maxPerTokenPrefixes-1), want: 1},
+		{tokenPrefix: otherTokensKey, want: 5},
+		{tokenPrefix: fmt.Sprintf("%08x", maxPerTokenPrefixes), want: 0},
+	}
+	for _, testCase := range testCases {
+		if count := perToken[testCase.tokenPrefix]["verify_ok"]; count != testCase.want {
+			t.Errorf("perToken[%s] verify_ok is %d, want %d", testCase.tokenPrefix, count, testCase.want)
+		}
+	}
+	// 100 prefixes plus "other"
+	if len(perToken) != maxPerTokenPrefixes+1 {
+		t.Errorf("perToken has %d entries, want %d", len(perToken), maxPerTokenPrefixes+1)
+	}
+	// a prefix that already has a slot keeps counting there
+	metrics.addForToken("verify_ok", "00000000"+fmt.Sprintf("%024x", 1), 1)
+	if count := metrics.snapshotPerToken()["00000000"]["verify_ok"]; count != 2 {
+		t.Errorf("a known prefix counted %d, want 2", count)
+	}
+	if total := metricValue("verify_ok"); total != maxPerTokenPrefixes+6 {
+		t.Errorf("the global verify_ok is %d, want %d", total, maxPerTokenPrefixes+6)
+	}
+}
+
+// the counters are cumulative: snapshots are copies and reading them resets nothing
+func TestMetricsSnapshotsAreCopies(t *testing.T) {
+	setupTest(t, `{"metrics_per_token": true}`)
+	metrics.addForToken("verify_ok", "aaaaaaaabbbbbbbb", 1)
+
+	snapshot := metrics.snapshot()
+	perToken := metrics.snapshotPerToken()
+	snapshot["verify_ok"] = 100
+	perToken["aaaaaaaa"]["verify_ok"] = 100
+
+	testCases := []struct {
+		name string
+		got  int64
+	}{
+		{name: "verify_ok", got: metrics.snapshot()["verify_ok"]},
+		{name: "perToken verify_ok", got: metrics.snapshotPerToken()["aaaaaaaa"]["verify_ok"]},
+	}
+	for _, testCase := range testCases {
+		if testCase.got != 1 {
+			t.Errorf("%s is %d after changing a snapshot and taking another one, want 1", testCase.name, testCase.got)
+		}
+	}
+}
+
+func TestMetricsPerTokenOverHTTP(t *testing.T) {
+	testCases := []struct {
+		name         string
+		configJSON   string
+		wantPerToken bool
+	}{
+		{name: "metrics_per_token off", configJSON: "", wantPerToken: false},
+		{name: "metrics_per_token on", configJSON: `{"metrics_per_token": true}`, wantPerToken: true},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			setupTest(t, testCase.configJSON)
+			failing := createTestToken(t, "failing")
+			healthy := createTestToken(t, "healthy")
+			failingChallenges := getTestChallenges(t, failing, "difficultyLevel=1")
+			getTestChallenges(t, healthy, "difficultyLevel=1")
+			serveTestRequest(newTestRequest("POST", "/Verify?challenge="+failingChallenges[0]+"&nonce=zz", failing, ""))
+
+			response := serveTestRequest(newTestRequest("GET", "/Metrics", testAdminToken, ""))
+			if response.Code != http.StatusOK {
+				t.Fatalf("/Metrics returned %d", response.Code)
+			}
+			output := struct {
+				PerToken map[string]map[string]int64 `json:"perToken"`
+			}{}
+			if err := json.Unmarshal(response.Body.Bytes(), &output); err != nil {
+				t.Fatalf("/Metrics returned invalid json: %v", err)
+			}
+			if !testCase.wantPerToken {
+				if output.PerToken != nil {
+					t.Errorf("/Metrics has perToken %v with metrics_per_token off", output.PerToken)
+				}
+				return
+			}
+			want := map[string]map[string]int64{
+				failing[:8]: {"challenge_batches": 1, "verify_bad_nonce": 1},
+				healthy[:8]: {"challenge_batches": 1},
+			}
+			if fmt.Sprint(output.PerToken) != fmt.Sprint(want) {
+				t.Errorf("perToken is %v, want %v", output.PerToken, want)
+			}
+		})
+	}
+}
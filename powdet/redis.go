@@ -0,0 +1,583 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	errors "git.sequentialread.com/forest/pkg-errors"
+	"github.com/redis/go-redis/v9"
+)
+
+type RedisConfig struct {
+	// host:port of the redis server
+	Addr         string `json:"addr"`
+	Password     string `json:"password"`
+	PasswordFile string `json:"password_file"`
+	DB           int    `json:"db"`
+	TLS          bool   `json:"tls"`
+	// prepended to every key, so several powdet deployments can share one redis
+	KeyPrefix string `json:"key_prefix"`
+}
+
+const redisTimeout = 3 * time.Second
+
+// the token audit list is trimmed to this many entries
+const redisTokenAuditMaxEntries = 10000
+
+var redisClient *redis.Client
+
+// sharedRedisClient connects to redis once, the challenge store and the token store share the client.
+func sharedRedisClient(redisConfig RedisConfig) (*redis.Client, error) {
+	if redisClient != nil {
+		return redisClient, nil
+	}
+	if redisConfig.Addr == "" {
+		return nil, errors.New("redis.addr is required when a store type is 'redis'")
+	}
+
+	password := redisConfig.Password
+	if redisConfig.PasswordFile != "" {
+		passwordBytes, err := ioutil.ReadFile(redisConfig.PasswordFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "can't read redis.password_file %s", redisConfig.PasswordFile)
+		}
+		password = strings.TrimSpace(string(passwordBytes))
+	}
+
+	options := &redis.Options{
+		Addr:         redisConfig.Addr,
+		Password:     password,
+		DB:           redisConfig.DB,
+		DialTimeout:  redisTimeout,
+		ReadTimeout:  redisTimeout,
+		WriteTimeout: redisTimeout,
+	}
+	if redisConfig.TLS {
+		host, _, err := net.SplitHostPort(redisConfig.Addr)
+		if err != nil {
+			host = redisConfig.Addr
+		}
+		options.TLSConfig = &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	}
+
+	client := redis.NewClient(options)
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, errors.Wrapf(err, "can't reach redis at %s", redisConfig.Addr)
+	}
+	redisClient = client
+	return redisClient, nil
+}
+
+// redisError turns a failed redis command into a storeUnavailableError, so the request fails with 503.
+func redisError(err error, message string) error {
+	if err == nil {
+		return nil
+	}
+	return &storeUnavailableError{err: errors.Wrap(err, message)}
+}
+
+// redisChallengeStore keeps challenges in redis so several powdet replicas can share them.
+// Layout:
+//   - <prefix>challenge:<token>:<challenge> = generation, one key per challenge that expires after ttl
+//   - <prefix>challenge-owner:<challenge> = token, the index Owner uses, expires with the challenge
+//   - <prefix>batch:<token>:<generation> = set of the challenges of that batch, for SweepExpired and CountByToken
+//   - <prefix>generation:<token> = current generation, <prefix>swept:<token> = newest generation already swept
+//   - <prefix>challenge-tokens = set of tokens with outstanding challenges
+type redisChallengeStore struct {
+	client    *redis.Client
+	keyPrefix string
+	ttl       time.Duration
+}
+
+func newRedisChallengeStore(redisConfig RedisConfig, ttl time.Duration) (*redisChallengeStore, error) {
+	client, err := sharedRedisClient(redisConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &redisChallengeStore{client: client, keyPrefix: redisConfig.KeyPrefix, ttl: ttl}, nil
+}
+
+func (store *redisChallengeStore) challengeKey(token, challengeBase64 string) string {
+	return store.keyPrefix + "challenge:" + token + ":" + challengeBase64
+}
+
+func (store *redisChallengeStore) ownerKey(challengeBase64 string) string {
+	return store.keyPrefix + "challenge-owner:" + challengeBase64
+}
+
+func (store *redisChallengeStore) batchKey(token string, generation int) string {
+	return store.keyPrefix + "batch:" + token + ":" + strconv.Itoa(generation)
+}
+
+func (store *redisChallengeStore) generationKey(token string) string {
+	return store.keyPrefix + "generation:" + token
+}
+
+func (store *redisChallengeStore) sweptKey(token string) string {
+	return store.keyPrefix + "swept:" + token
+}
+
+func (store *redisChallengeStore) tokensKey() string {
+	return store.keyPrefix + "challenge-tokens"
+}
+
+// KEYS: owner keys. ARGV: token.
+// Drops challenges from the owner index, unless they were since issued to another token.
+var redisRemoveOwnersScript = redis.NewScript(`
+for _, ownerKey in ipairs(KEYS) do
+	if redis.call('GET', ownerKey) == ARGV[1] then
+		redis.call('DEL', ownerKey)
+	end
+end
+return 0
+`)
+
+func (store *redisChallengeStore) removeOwners(ctx context.Context, token string, challengeBase64s []string) error {
+	if len(challengeBase64s) == 0 {
+		return nil
+	}
+	ownerKeys := make([]string, len(challengeBase64s))
+	for i, challengeBase64 := range challengeBase64s {
+		ownerKeys[i] = store.ownerKey(challengeBase64)
+	}
+	return redisRemoveOwnersScript.Run(ctx, store.client, ownerKeys, token).Err()
+}
+
+// generations returns the current generation of token and the newest one SweepExpired already removed.
+// Both are 0 when the store knows nothing about token.
+func (store *redisChallengeStore) generations(ctx context.Context, client redis.Cmdable, token string) (current, swept int, err error) {
+	values, err := client.MGet(ctx, store.generationKey(token), store.sweptKey(token)).Result()
+	if err != nil {
+		return 0, 0, err
+	}
+	if value, ok := values[0].(string); ok {
+		current, _ = strconv.Atoi(value)
+	}
+	if value, ok := values[1].(string); ok {
+		swept, _ = strconv.Atoi(value)
+	}
+	return current, swept, nil
+}
+
+// batchMembers lists the challenges of the given batches of token.
+func (store *redisChallengeStore) batchMembers(ctx context.Context, client redis.Cmdable, token string, generations []int) ([]string, error) {
+	if len(generations) == 0 {
+		return nil, nil
+	}
+	membersCommands := make([]*redis.StringSliceCmd, len(generations))
+	_, err := client.Pipelined(ctx, func(pipeline redis.Pipeliner) error {
+		for i, generation := range generations {
+			membersCommands[i] = pipeline.SMembers(ctx, store.batchKey(token, generation))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	challengeBase64s := []string{}
+	for _, membersCommand := range membersCommands {
+		challengeBase64s = append(challengeBase64s, membersCommand.Val()...)
+	}
+	return challengeBase64s, nil
+}
+
+// queueDeleteBatches adds the deletion of the given batches of token, their challenges challengeBase64s and
+// their owner entries to a MULTI pipeline. Summing up the returned commands gives how many challenges
+// were still outstanding, challenges that expired or were consumed meanwhile are not counted.
+func (store *redisChallengeStore) queueDeleteBatches(
+	ctx context.Context, pipeline redis.Pipeliner, token string, generations []int, challengeBase64s []string,
+) []*redis.IntCmd {
+	if len(generations) == 0 {
+		return nil
+	}
+	deleteCommands := make([]*redis.IntCmd, len(challengeBase64s))
+	ownerKeys := make([]string, len(challengeBase64s))
+	for i, challengeBase64 := range challengeBase64s {
+		deleteCommands[i] = pipeline.Del(ctx, store.challengeKey(token, challengeBase64))
+		ownerKeys[i] = store.ownerKey(challengeBase64)
+	}
+	batchKeys := make([]string, len(generations))
+	for i, generation := range generations {
+		batchKeys[i] = store.batchKey(token, generation)
+	}
+	pipeline.Del(ctx, batchKeys...)
+	if len(ownerKeys) > 0 {
+		// EVAL instead of EVALSHA, a NOSCRIPT error can't be retried inside MULTI
+		redisRemoveOwnersScript.Eval(ctx, pipeline, ownerKeys, token)
+	}
+	return deleteCommands
+}
+
+func sumDeleted(deleteCommands []*redis.IntCmd) int {
+	removed := 0
+	for _, deleteCommand := range deleteCommands {
+		removed += int(deleteCommand.Val())
+	}
+	return removed
+}
+
+// updateGenerations runs Put and SweepExpired. With newBatch it stores challengeBase64s under a new generation,
+// then it removes the batches more than deprecateAfterBatches generations old. The INCR, the new batch and
+// the sweep are one MULTI/EXEC, and WATCH on the generation keys retries it when another Put or sweep of
+// the same token got in between, so concurrent batches of one token can't interleave.
+func (store *redisChallengeStore) updateGenerations(
+	token string, newBatch bool, challengeBase64s []string, deprecateAfterBatches int,
+) (generation, removed int, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	update := func(tx *redis.Tx) error {
+		currentGeneration, sweptGeneration, err := store.generations(ctx, tx, token)
+		if err != nil {
+			return err
+		}
+		generation = currentGeneration
+		if newBatch {
+			generation++
+		}
+		expired := []int{}
+		for expiredGeneration := sweptGeneration + 1; expiredGeneration+deprecateAfterBatches < generation; expiredGeneration++ {
+			expired = append(expired, expiredGeneration)
+		}
+		if !newBatch && len(expired) == 0 {
+			return nil
+		}
+		expiredChallenges, err := store.batchMembers(ctx, tx, token, expired)
+		if err != nil {
+			return err
+		}
+
+		var deleteCommands []*redis.IntCmd
+		_, err = tx.TxPipelined(ctx, func(pipeline redis.Pipeliner) error {
+			if newBatch {
+				store.queuePutBatch(ctx, pipeline, token, generation, challengeBase64s)
+			}
+			deleteCommands = store.queueDeleteBatches(ctx, pipeline, token, expired, expiredChallenges)
+			if len(expired) > 0 {
+				pipeline.Set(ctx, store.sweptKey(token), expired[len(expired)-1], store.ttl)
+			}
+			return nil
+		})
+		removed = sumDeleted(deleteCommands)
+		return err
+	}
+
+	// one of the competing updates always commits, so this only keeps retrying under sustained contention,
+	// and then only until redisTimeout runs out
+	for {
+		err = store.client.Watch(ctx, update, store.generationKey(token), store.sweptKey(token))
+		if err != redis.TxFailedErr {
+			return generation, removed, err
+		}
+		if ctx.Err() != nil {
+			return 0, 0, err
+		}
+	}
+}
+
+// queuePutBatch adds storing challengeBase64s as batch generation of token to a MULTI pipeline.
+func (store *redisChallengeStore) queuePutBatch(
+	ctx context.Context, pipeline redis.Pipeliner, token string, generation int, challengeBase64s []string,
+) {
+	pipeline.Incr(ctx, store.generationKey(token))
+	// the generation counter has to outlive the challenges of its newest batch
+	pipeline.Expire(ctx, store.generationKey(token), store.ttl)
+	pipeline.Expire(ctx, store.sweptKey(token), store.ttl)
+	pipeline.SAdd(ctx, store.tokensKey(), token)
+	batchKey := store.batchKey(token, generation)
+	members := make([]interface{}, len(challengeBase64s))
+	for i, challengeBase64 := range challengeBase64s {
+		pipeline.SetEx(ctx, store.challengeKey(token, challengeBase64), generation, store.ttl)
+		pipeline.SetEx(ctx, store.ownerKey(challengeBase64), token, store.ttl)
+		members[i] = challengeBase64
+	}
+	if len(members) > 0 {
+		pipeline.SAdd(ctx, batchKey, members...)
+		pipeline.Expire(ctx, batchKey, store.ttl)
+	}
+}
+
+func (store *redisChallengeStore) Put(token string, challengeBase64s []string, deprecateAfterBatches int) (int, error) {
+	generation, _, err := store.updateGenerations(token, true, challengeBase64s, deprecateAfterBatches)
+	return generation, redisError(err, "redis put challenges failed")
+}
+
+func (store *redisChallengeStore) Consume(token, challengeBase64 string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	// GETDEL only returns the challenge to one caller, which makes this check-and-delete atomic across replicas
+	generation, err := store.client.GetDel(ctx, store.challengeKey(token, challengeBase64)).Int()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, redisError(err, "redis consume challenge failed")
+	}
+	// the challenge is used up at this point, a failure to clean up after it only leaves entries that expire anyway
+	if err := store.client.SRem(ctx, store.batchKey(token, generation), challengeBase64).Err(); err != nil {
+		log.Printf("failed to remove a consumed challenge from its batch in redis: %v", err)
+	}
+	if err := store.removeOwners(ctx, token, []string{challengeBase64}); err != nil {
+		log.Printf("failed to remove a consumed challenge from the owner index in redis: %v", err)
+	}
+	return true, nil
+}
+
+func (store *redisChallengeStore) SweepExpired(token string, deprecateAfterBatches int) (int, error) {
+	_, removed, err := store.updateGenerations(token, false, nil, deprecateAfterBatches)
+	return removed, redisError(err, "redis sweep challenges failed")
+}
+
+func (store *redisChallengeStore) Owner(challengeBase64 string) (string, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	token, err := store.client.Get(ctx, store.ownerKey(challengeBase64)).Result()
+	if err == redis.Nil {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, redisError(err, "redis look up challenge owner failed")
+	}
+	return token, true, nil
+}
+
+func (store *redisChallengeStore) CountByToken() (map[string]ChallengeStats, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	tokens, err := store.client.SMembers(ctx, store.tokensKey()).Result()
+	if err != nil {
+		return nil, redisError(err, "redis list challenge tokens failed")
+	}
+
+	output := map[string]ChallengeStats{}
+	for _, token := range tokens {
+		currentGeneration, sweptGeneration, err := store.generations(ctx, store.client, token)
+		if err != nil {
+			return nil, redisError(err, "redis get challenge generation failed")
+		}
+		if currentGeneration == 0 {
+			// the challenges of this token expired, forget about it
+			store.client.SRem(ctx, store.tokensKey(), token)
+			continue
+		}
+
+		countCommands := map[int]*redis.IntCmd{}
+		_, err = store.client.Pipelined(ctx, func(pipeline redis.Pipeliner) error {
+			for generation := sweptGeneration + 1; generation <= currentGeneration; generation++ {
+				countCommands[generation] = pipeline.SCard(ctx, store.batchKey(token, generation))
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, redisError(err, "redis count challenges failed")
+		}
+		stats := ChallengeStats{CurrentGeneration: currentGeneration}
+		for generation := sweptGeneration + 1; generation <= currentGeneration; generation++ {
+			count := int(countCommands[generation].Val())
+			stats.Count += count
+			if count > 0 && stats.OldestGeneration == 0 {
+				stats.OldestGeneration = generation
+			}
+		}
+		output[token] = stats
+	}
+	return output, nil
+}
+
+func (store *redisChallengeStore) Purge(token string) (int, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	currentGeneration, sweptGeneration, err := store.generations(ctx, store.client, token)
+	if err != nil {
+		return 0, false, redisError(err, "redis get challenge generation failed")
+	}
+	generations := []int{}
+	for generation := sweptGeneration + 1; generation <= currentGeneration; generation++ {
+		generations = append(generations, generation)
+	}
+	challengeBase64s, err := store.batchMembers(ctx, store.client, token, generations)
+	if err != nil {
+		return 0, false, redisError(err, "redis purge challenges failed")
+	}
+	var deleteCommands []*redis.IntCmd
+	var removedTokenCommand *redis.IntCmd
+	_, err = store.client.TxPipelined(ctx, func(pipeline redis.Pipeliner) error {
+		deleteCommands = store.queueDeleteBatches(ctx, pipeline, token, generations, challengeBase64s)
+		removedTokenCommand = pipeline.SRem(ctx, store.tokensKey(), token)
+		pipeline.Del(ctx, store.generationKey(token), store.sweptKey(token))
+		return nil
+	})
+	if err != nil {
+		return 0, false, redisError(err, "redis purge challenges failed")
+	}
+	removed, removedToken := sumDeleted(deleteCommands), removedTokenCommand.Val()
+	return removed, currentGeneration != 0 || removedToken == 1, nil
+}
+
+func (store *redisChallengeStore) Close() error {
+	return nil
+}
+
+// redisTokenStore keeps API tokens in the redis hash <prefix>tokens (token -> json TokenRecord)
+// and appends audit entries to the list <prefix>tokens:audit.
+type redisTokenStore struct {
+	client    *redis.Client
+	keyPrefix string
+}
+
+// KEYS: tokens hash. ARGV: token, json TokenRecord.
+// Replaces the record of token only while it is still in the hash, so an Expire racing a Revoke can't recreate it.
+var redisUpdateTokenScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+return 1
+`)
+
+func newRedisTokenStore(redisConfig RedisConfig) (*redisTokenStore, error) {
+	client, err := sharedRedisClient(redisConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &redisTokenStore{client: client, keyPrefix: redisConfig.KeyPrefix}, nil
+}
+
+func (store *redisTokenStore) tokensKey() string {
+	return store.keyPrefix + "tokens"
+}
+
+func (store *redisTokenStore) auditKey() string {
+	return store.keyPrefix + "tokens:audit"
+}
+
+func (store *redisTokenStore) audit(ctx context.Context, action string, record TokenRecord, actor string) error {
+	entryBytes, err := json.Marshal(tokenAuditEntry{
+		Time:        time.Now().UTC().Format(time.RFC3339),
+		Action:      action,
+		TokenPrefix: shortTokenPrefix(record.Token),
+		Name:        record.Name,
+		Actor:       actor,
+	})
+	if err != nil {
+		return errors.Wrap(err, "json marshal failed")
+	}
+	_, err = store.client.Pipelined(ctx, func(pipeline redis.Pipeliner) error {
+		pipeline.RPush(ctx, store.auditKey(), entryBytes)
+		pipeline.LTrim(ctx, store.auditKey(), -redisTokenAuditMaxEntries, -1)
+		return nil
+	})
+	return redisError(err, "redis append token audit entry failed")
+}
+
+func (store *redisTokenStore) put(ctx context.Context, record TokenRecord) error {
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrap(err, "json marshal failed")
+	}
+	return redisError(store.client.HSet(ctx, store.tokensKey(), record.Token, recordBytes).Err(), "redis store token failed")
+}
+
+func (store *redisTokenStore) Create(record TokenRecord, actor string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := store.put(ctx, record); err != nil {
+		return err
+	}
+	return store.audit(ctx, "create", record, actor)
+}
+
+func (store *redisTokenStore) Revoke(token, actor string) (bool, error) {
+	record, found, err := store.Get(token)
+	if err != nil || !found {
+		return false, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	removed, err := store.client.HDel(ctx, store.tokensKey(), token).Result()
+	if err != nil {
+		return false, redisError(err, "redis revoke token failed")
+	}
+	if removed == 0 {
+		// another replica revoked it first
+		return false, nil
+	}
+	return true, store.audit(ctx, "revoke", record, actor)
+}
+
+func (store *redisTokenStore) Expire(token string, expiresAt time.Time, actor string) error {
+	record, found, err := store.Get(token)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errors.Errorf("token %s is not in the token store", shortTokenPrefix(token))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	record.ExpiresAt = expiresAt.Unix()
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrap(err, "json marshal failed")
+	}
+	updated, err := redisUpdateTokenScript.Run(ctx, store.client, []string{store.tokensKey()}, token, recordBytes).Int()
+	if err != nil {
+		return redisError(err, "redis expire token failed")
+	}
+	if updated == 0 {
+		// another replica revoked it after the Get, don't bring it back
+		return errors.Errorf("token %s is not in the token store", shortTokenPrefix(token))
+	}
+	return store.audit(ctx, "expire", record, actor)
+}
+
+func (store *redisTokenStore) Get(token string) (TokenRecord, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	recordBytes, err := store.client.HGet(ctx, store.tokensKey(), token).Bytes()
+	if err == redis.Nil {
+		return TokenRecord{}, false, nil
+	}
+	if err != nil {
+		return TokenRecord{}, false, redisError(err, "redis get token failed")
+	}
+	var record TokenRecord
+	if err := json.Unmarshal(recordBytes, &record); err != nil {
+		return TokenRecord{}, false, errors.Wrapf(err, "token %s in redis couldn't be parsed", shortTokenPrefix(token))
+	}
+	return record, true, nil
+}
+
+func (store *redisTokenStore) List() ([]TokenRecord, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	recordsByToken, err := store.client.HGetAll(ctx, store.tokensKey()).Result()
+	if err != nil {
+		return nil, redisError(err, "redis list tokens failed")
+	}
+	records := make([]TokenRecord, 0, len(recordsByToken))
+	for token, recordString := range recordsByToken {
+		var record TokenRecord
+		if err := json.Unmarshal([]byte(recordString), &record); err != nil {
+			return nil, errors.Wrapf(err, "token %s in redis couldn't be parsed", shortTokenPrefix(token))
+		}
+		records = append(records, record)
+	}
+	sortTokenRecords(records)
+	return records, nil
+}
+
+func (store *redisTokenStore) Exists(token string) (bool, error) {
+	record, found, err := store.Get(token)
+	return found && record.valid(), err
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestRedisChallengeStore connects a store with its own client, like a separate powdet instance would.
+func newTestRedisChallengeStore(t *testing.T, addr string) *redisChallengeStore {
+	t.Helper()
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	t.Cleanup(func() { client.Close() })
+	return &redisChallengeStore{client: client, keyPrefix: "powdet:", ttl: time.Hour}
+}
+
+// Two instances pointed at the same redis: a challenge issued by one verifies on the other, and only once.
+func TestRedisChallengeStoreSharedBetweenInstances(t *testing.T) {
+	setupTest(t, "")
+	server := miniredis.RunT(t)
+	instanceA := newTestRedisChallengeStore(t, server.Addr())
+	instanceB := newTestRedisChallengeStore(t, server.Addr())
+	token := createTestToken(t, "a")
+
+	challengeStore = instanceA
+	challenges := getTestChallenges(t, token, "difficultyLevel=1")
+	nonce := solveTestChallenge(t, challenges[0])
+	verifyURL := "/Verify?challenge=" + challenges[0] + "&nonce=" + nonce
+
+	testCases := []struct {
+		name       string
+		store      ChallengeStore
+		wantStatus int
+	}{
+		{name: "verify on the other instance", store: instanceB, wantStatus: 200},
+		{name: "replay on the issuing instance", store: instanceA, wantStatus: 404},
+		{name: "replay on the other instance", store: instanceB, wantStatus: 404},
+	}
+	for _, testCase := range testCases {
+		challengeStore = testCase.store
+		response := serveTestRequest(newTestRequest("POST", verifyURL, token, ""))
+		if response.Code != testCase.wantStatus {
+			t.Errorf("%s: /Verify returned %d, want %d: %s", testCase.name, response.Code, testCase.wantStatus, response.Body.String())
+		}
+	}
+
+	counts, err := instanceA.CountByToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts[token].Count != len(challenges)-1 {
+		t.Errorf("instance A sees %d outstanding challenges, want %d", counts[token].Count, len(challenges)-1)
+	}
+}
+
+// every challenge is its own key that expires after the configured ttl, not a per-token hash
+func TestRedisChallengeStoreKeys(t *testing.T) {
+	server := miniredis.RunT(t)
+	store := newTestRedisChallengeStore(t, server.Addr())
+	store.ttl = 90 * time.Second
+	if _, err := store.Put("a", []string{"c1", "c2"}, testKeepAllBatches); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		key       string
+		wantValue string
+	}{
+		{key: "powdet:challenge:a:c1", wantValue: "1"},
+		{key: "powdet:challenge:a:c2", wantValue: "1"},
+		{key: "powdet:challenge-owner:c1", wantValue: "a"},
+		{key: "powdet:challenge-owner:c2", wantValue: "a"},
+	}
+	for _, testCase := range testCases {
+		value, err := server.Get(testCase.key)
+		if err != nil || value != testCase.wantValue {
+			t.Errorf("%s = %q, %v, want %q", testCase.key, value, err, testCase.wantValue)
+		}
+		if ttl := server.TTL(testCase.key); ttl != store.ttl {
+			t.Errorf("%s expires in %s, want %s", testCase.key, ttl, store.ttl)
+		}
+	}
+
+	// a later batch doesn't extend the challenges issued before it
+	server.FastForward(60 * time.Second)
+	if _, err := store.Put("a", []string{"c3"}, testKeepAllBatches); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := server.TTL("powdet:challenge:a:c1"); ttl != 30*time.Second {
+		t.Errorf("c1 expires in %s after another batch, want 30s", ttl)
+	}
+
+	if consumed, err := store.Consume("a", "c1"); err != nil || !consumed {
+		t.Fatalf("Consume(a, c1) = %t, %v, want true", consumed, err)
+	}
+	for _, key := range []string{"powdet:challenge:a:c1", "powdet:challenge-owner:c1"} {
+		if server.Exists(key) {
+			t.Errorf("%s is still there after the challenge was consumed", key)
+		}
+	}
+}
+
+func TestRedisChallengeStoreExpiry(t *testing.T) {
+	server := miniredis.RunT(t)
+	store := newTestRedisChallengeStore(t, server.Addr())
+	if _, err := store.Put("a", []string{"c1", "c2"}, testKeepAllBatches); err != nil {
+		t.Fatal(err)
+	}
+	if consumed, err := store.Consume("a", "c1"); err != nil || !consumed {
+		t.Fatalf("Consume before the ttl = %t, %v, want true", consumed, err)
+	}
+
+	server.FastForward(store.ttl + time.Second)
+	if consumed, err := store.Consume("a", "c2"); err != nil || consumed {
+		t.Errorf("Consume after the ttl = %t, %v, want false", consumed, err)
+	}
+	if _, found, err := store.Owner("c2"); err != nil || found {
+		t.Errorf("Owner after the ttl = %t, %v, want not found", found, err)
+	}
+	if counts, err := store.CountByToken(); err != nil || len(counts) != 0 {
+		t.Errorf("CountByToken after the ttl = %+v, %v, want nothing", counts, err)
+	}
+	if keys := server.Keys(); len(keys) != 0 {
+		t.Errorf("redis still holds %v after everything expired", keys)
+	}
+}
+
+func TestRedisChallengeStoreConcurrentConsume(t *testing.T) {
+	store := newTestRedisChallengeStore(t, miniredis.RunT(t).Addr())
+	testConcurrentConsume(t, store)
+}
+
+// testConcurrentConsume consumes one challenge from many goroutines at once, only one of them may get it.
+func testConcurrentConsume(t *testing.T, store ChallengeStore) {
+	if _, err := store.Put("a", []string{"c1"}, testKeepAllBatches); err != nil {
+		t.Fatal(err)
+	}
+	var consumedCount int32
+	var waitGroup sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			consumed, err := store.Consume("a", "c1")
+			if err != nil {
+				t.Error(err)
+			}
+			if consumed {
+				atomic.AddInt32(&consumedCount, 1)
+			}
+		}()
+	}
+	waitGroup.Wait()
+	if consumedCount != 1 {
+		t.Errorf("the challenge was consumed %d times, want once", consumedCount)
+	}
+}
+
+// once redis goes away, requests fail with 503 and the process keeps running
+func TestRedisUnavailable(t *testing.T) {
+	setupTest(t, "")
+	server := miniredis.RunT(t)
+	challengeStore = newTestRedisChallengeStore(t, server.Addr())
+	token := createTestToken(t, "a")
+	challenges := getTestChallenges(t, token, "difficultyLevel=1")
+	nonce := solveTestChallenge(t, challenges[0])
+	server.Close()
+
+	testCases := []struct {
+		name       string
+		request    *http.Request
+		wantMetric string
+	}{
+		{name: "GetChallenges", request: newTestRequest("POST", "/GetChallenges?difficultyLevel=1", token, ""), wantMetric: "store_unavailable"},
+		{name: "Verify", request: newTestRequest("POST", "/Verify?challenge="+challenges[0]+"&nonce="+nonce, token, ""), wantMetric: "verify_store_unavailable"},
+	}
+	for _, testCase := range testCases {
+		response := serveTestRequest(testCase.request)
+		if response.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s returned %d, want 503: %s", testCase.name, response.Code, response.Body.String())
+		}
+		if value := metricValue(testCase.wantMetric); value != 1 {
+			t.Errorf("%s: %s is %d, want 1", testCase.name, testCase.wantMetric, value)
+		}
+	}
+}
+
+func TestRedisTokenStore(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	store := &redisTokenStore{client: client, keyPrefix: "powdet:"}
+
+	recordA, recordB := testTokenRecord("a"), testTokenRecord("b")
+	for _, record := range []TokenRecord{recordA, recordB} {
+		if err := store.Create(record, "test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if records, err := store.List(); err != nil || len(records) != 2 {
+		t.Fatalf("List() = %v, %v, want 2 records", records, err)
+	}
+	if err := store.Expire(recordA.Token, time.Now().Add(-time.Second), "test"); err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := store.Revoke(recordB.Token, "test"); err != nil || !removed {
+		t.Fatalf("Revoke(b) = %t, %v, want true", removed, err)
+	}
+
+	testCases := []struct {
+		name       string
+		token      string
+		wantFound  bool
+		wantExists bool
+	}{
+		{name: "expired", token: recordA.Token, wantFound: true, wantExists: false},
+		{name: "revoked", token: recordB.Token, wantFound: false, wantExists: false},
+		{name: "unknown", token: testTokenFor("c"), wantFound: false, wantExists: false},
+	}
+	for _, testCase := range testCases {
+		if _, found, err := store.Get(testCase.token); err != nil || found != testCase.wantFound {
+			t.Errorf("%s: Get() found %t, %v, want %t", testCase.name, found, err, testCase.wantFound)
+		}
+		if exists, err := store.Exists(testCase.token); err != nil || exists != testCase.wantExists {
+			t.Errorf("%s: Exists() = %t, %v, want %t", testCase.name, exists, err, testCase.wantExists)
+		}
+	}
+	if removed, err := store.Revoke(recordB.Token, "test"); err != nil || removed {
+		t.Errorf("revoking b again = %t, %v, want false", removed, err)
+	}
+
+	auditEntries, err := server.List("powdet:tokens:audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantActions := []string{"create", "create", "expire", "revoke"}
+	if len(auditEntries) != len(wantActions) {
+		t.Fatalf("the audit list holds %d entries, want %d", len(auditEntries), len(wantActions))
+	}
+	for i, auditEntryJSON := range auditEntries {
+		var auditEntry tokenAuditEntry
+		if err := json.Unmarshal([]byte(auditEntryJSON), &auditEntry); err != nil {
+			t.Fatal(err)
+		}
+		if auditEntry.Action != wantActions[i] || strings.Contains(auditEntryJSON, recordA.Token) || strings.Contains(auditEntryJSON, recordB.Token) {
+			t.Errorf("audit entry %d is %s, want action %s and only a token prefix", i, auditEntryJSON, wantActions[i])
+		}
+	}
+}
+
+// TestRedisIntegration runs the challenge store against a real redis, e.g. REDIS_ADDR=localhost:6379 go test -run Redis.
+// It only touches keys under its own prefix and deletes them afterwards.
+// revokeAfterGetHook deletes the token from the tokens hash right after the first HGET,
+// like another replica revoking it between the read and the write of Expire.
+type revokeAfterGetHook struct {
+	server *miniredis.Miniredis
+	key    string
+	token  string
+	once   sync.Once
+}
+
+func (hook *revokeAfterGetHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (hook *revokeAfterGetHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		err := next(ctx, cmd)
+		if cmd.Name() == "hget" {
+			hook.once.Do(func() { hook.server.HDel(hook.key, hook.token) })
+		}
+		return err
+	}
+}
+
+func (hook *revokeAfterGetHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func TestRedisTokenStoreExpireRacingRevoke(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	store := &redisTokenStore{client: client, keyPrefix: "powdet:"}
+	record := testTokenRecord("a")
+	if err := store.Create(record, "test"); err != nil {
+		t.Fatal(err)
+	}
+	client.AddHook(&revokeAfterGetHook{server: server, key: store.tokensKey(), token: record.Token})
+
+	err := store.Expire(record.Token, time.Now().Add(time.Minute), "test")
+	if err == nil || strings.Contains(err.Error(), record.Token) {
+		t.Errorf("Expire of a token revoked after the Get returned %v, want a not-found error with only the truncated token", err)
+	}
+	if recordJSON := server.HGet(store.tokensKey(), record.Token); recordJSON != "" {
+		t.Errorf("Expire brought back the revoked token: %s", recordJSON)
+	}
+	auditEntries, _ := server.List(store.auditKey())
+	if len(auditEntries) != 1 {
+		t.Errorf("the audit list holds %v, want only the create entry", auditEntries)
+	}
+}
+
+func TestRedisIntegration(t *testing.T) {
+	redisAddr := os.Getenv("REDIS_ADDR")
+	if redisAddr == "" {
+		t.Skip("REDIS_ADDR is not set")
+	}
+	client := redis.NewClient(&redis.Options{Addr: redisAddr})
+	t.Cleanup(func() { client.Close() })
+	keyPrefix := fmt.Sprintf("powdet-test-%d:", time.Now().UnixNano())
+	t.Cleanup(func() {
+		ctx := context.Background()
+		keys, _ := client.Keys(ctx, keyPrefix+"*").Result()
+		if len(keys) > 0 {
+			client.Del(ctx, keys...)
+		}
+	})
+
+	t.Run("conformance", func(t *testing.T) {
+		testChallengeStore(t, &redisChallengeStore{client: client, keyPrefix: keyPrefix + "conformance:", ttl: time.Minute})
+	})
+	t.Run("concurrent consume", func(t *testing.T) {
+		testConcurrentConsume(t, &redisChallengeStore{client: client, keyPrefix: keyPrefix + "concurrent:", ttl: time.Minute})
+	})
+	t.Run("expiry", func(t *testing.T) {
+		store := &redisChallengeStore{client: client, keyPrefix: keyPrefix + "expiry:", ttl: time.Second}
+		if _, err := store.Put("a", []string{"c1"}, testKeepAllBatches); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(1500 * time.Millisecond)
+		if consumed, err := store.Consume("a", "c1"); err != nil || consumed {
+			t.Errorf("Consume after the ttl = %t, %v, want false", consumed, err)
+		}
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"time"
+
+	errors "git.sequentialread.com/forest/pkg-errors"
+)
+
+// runSelfTest builds an argon2id challenge at min_difficulty_level with the configured parameters, solves it in-process
+// and runs the solution through the same checks /Verify uses. It catches argon2 parameters that can't work before
+// any client spins forever on them. It doesn't touch the challenge store or the difficulty stats.
+func runSelfTest(currentConfig Config, currentArgon2Parameters Argon2Parameters) (time.Duration, error) {
+	difficultyLevel := currentConfig.MinDifficultyLevel
+	difficulty, err := difficultyTargetForLevel(difficultyLevel)
+	if err != nil {
+		return 0, err
+	}
+	preimageBytes := make([]byte, currentConfig.PreimageLengthBytes)
+	if _, err := rand.Read(preimageBytes); err != nil {
+		return 0, errors.Wrap(err, "read random bytes failed")
+	}
+	challenge := Challenge{
+		Argon2Parameters:   argon2ParametersForLevel(currentConfig, currentArgon2Parameters, difficultyLevel),
+		Preimage:           base64.StdEncoding.EncodeToString(preimageBytes),
+		Difficulty:         difficulty,
+		DifficultyLevel:    difficultyLevel,
+		Algorithm:          algorithmArgon2id,
+		NonceLength:        currentConfig.NonceLengthBytes,
+		PreimageLength:     currentConfig.PreimageLengthBytes,
+		DifficultyPosition: currentConfig.DifficultyPosition,
+		IssuedAt:           time.Now().Unix(),
+	}
+	challengeBytes, err := json.Marshal(challenge)
+	if err != nil {
+		return 0, errors.Wrap(err, "serialize challenge as json failed")
+	}
+	challengeBase64 := base64.StdEncoding.EncodeToString(challengeBytes)
+
+	budget := time.Duration(currentConfig.SelfTestBudgetSeconds) * time.Second
+	startedAt := time.Now()
+	nonceBytes := make([]byte, currentConfig.NonceLengthBytes)
+	for attempt := uint64(0); ; attempt++ {
+		if time.Since(startedAt) > budget {
+			return time.Since(startedAt), errors.Errorf(
+				"no solution found within %s after %d attempts at difficulty level %d", budget, attempt, difficultyLevel,
+			)
+		}
+		// the counter goes into the last 4 bytes, nonces are at least 4 bytes long
+		binary.BigEndian.PutUint32(nonceBytes[len(nonceBytes)-4:], uint32(attempt))
+		hash, err := hashChallenge(challenge, nonceBytes, preimageBytes)
+		if err != nil {
+			return time.Since(startedAt), err
+		}
+		meetsDifficulty, err := hashMeetsDifficulty(challenge, hash)
+		if err != nil {
+			return time.Since(startedAt), err
+		}
+		if meetsDifficulty {
+			break
+		}
+	}
+	solveDuration := time.Since(startedAt)
+
+	// decode it again like /Verify does, so what the challenge json carries is checked too
+	decodedChallenge, err := decodeChallenge(challengeBase64)
+	if err != nil {
+		return solveDuration, err
+	}
+	outcome := checkChallengeSolution(decodedChallenge, challengeBase64, hex.EncodeToString(nonceBytes), "")
+	if outcome != verifyOK {
+		return solveDuration, errors.Errorf("the solved challenge did not verify: %s", outcome)
+	}
+	return solveDuration, nil
+}
+
+// selfTestOrFail runs the self test and exits the process if it fails.
+func selfTestOrFail(currentConfig Config, currentArgon2Parameters Argon2Parameters) {
+	solveDuration, err := runSelfTest(currentConfig, currentArgon2Parameters)
+	if err != nil {
+		log.Fatalf("💥 self test failed after %s: %v", solveDuration, err)
+	}
+	slog.Info("self test passed", "difficultyLevel", currentConfig.MinDifficultyLevel, "solveDuration", solveDuration.String())
+}
+
+// runSelfTestCommand is -self-test. It only loads the configuration: the stores, the audit log and the preimage pool
+// stay closed, so it can run next to a powdet that holds the bolt lock.
+func runSelfTestCommand() {
+	loadStartupConfiguration()
+	currentConfig, currentArgon2Parameters := currentConfiguration()
+	selfTestOrFail(currentConfig, currentArgon2Parameters)
+}
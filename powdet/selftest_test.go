@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	testCases := []struct {
+		name       string
+		configJSON string
+		wantError  string
+	}{
+		{name: "defaults", configJSON: ``},
+		{name: "higher min_difficulty_level", configJSON: `{"min_difficulty_level": 4}`},
+		{name: "12 byte nonces and 16 byte preimages", configJSON: `{"nonce_length_bytes": 12, "preimage_length_bytes": 16}`},
+		{name: "head mode", configJSON: `{"difficulty_position": "head"}`},
+		{name: "argon2 tier", configJSON: `{"argon2_tiers": [{"maxLevel": 2, "memoryKiB": 16, "iterations": 2, "parallelism": 1}]}`},
+		{name: "over budget", configJSON: `{"min_difficulty_level": 40, "self_test_budget_seconds": 1}`, wantError: "no solution found within 1s"},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			setupTest(t, testCase.configJSON)
+			currentConfig, currentArgon2Parameters := currentConfiguration()
+			_, err := runSelfTest(currentConfig, currentArgon2Parameters)
+			if testCase.wantError == "" && err != nil {
+				t.Errorf("runSelfTest() failed: %v", err)
+			}
+			if testCase.wantError != "" && (err == nil || !strings.Contains(err.Error(), testCase.wantError)) {
+				t.Errorf("runSelfTest() returned %v, want an error containing %q", err, testCase.wantError)
+			}
+
+			// the self test must not leave anything behind that looks like real traffic
+			if stats := difficultyStats.snapshot(difficultyStatsMaxMinutes); len(stats) != 0 {
+				t.Errorf("the self test added difficulty stats %+v", stats)
+			}
+			if counts, err := challengeStore.CountByToken(); err != nil || len(counts) != 0 {
+				t.Errorf("the self test left challenges %+v in the store (%v)", counts, err)
+			}
+			if snapshot := metrics.snapshot(); len(snapshot) != 0 {
+				t.Errorf("the self test counted metrics %v", snapshot)
+			}
+		})
+	}
+}
+
+// -self-test only checks the configuration, so it must work while the real service holds the bolt lock
+// and must not create the token store or the audit log.
+func TestSelfTestCommandLeavesTheStoresClosed(t *testing.T) {
+	setupTest(t, "")
+	chdirTest(t, appDirectory)
+	boltPath := filepath.Join(appDirectory, "challenges.db")
+	auditLogPath := filepath.Join(appDirectory, "audit.jsonl")
+	runningStore, err := newBoltChallengeStore(boltPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { runningStore.Close() })
+	configJSON, err := json.Marshal(map[string]interface{}{
+		"challenge_store":  map[string]string{"type": "bolt", "path": boltPath},
+		"audit_log":        auditLogPath,
+		"pregen_pool_size": 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestConfig(t, string(configJSON))
+	testChallengeStore, testTokenStore := challengeStore, tokenStore
+
+	runSelfTestCommand()
+
+	if currentConfig, _ := currentConfiguration(); currentConfig.ChallengeStore.Path != boltPath {
+		t.Errorf("-self-test didn't load config.json, challenge_store.path is %q", currentConfig.ChallengeStore.Path)
+	}
+	if challengeStore != testChallengeStore || tokenStore != testTokenStore || auditLog != nil || challengePreimagePool != nil {
+		t.Error("-self-test opened a store, the audit log or the preimage pool")
+	}
+	for _, path := range []string{auditLogPath, filepath.Join(appDirectory, apiTokensJSONFileName)} {
+		if _, err := os.Stat(path); err == nil {
+			t.Errorf("-self-test created %s", path)
+		}
+	}
+}
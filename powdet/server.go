@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+func newHTTPServer(currentConfig Config, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              fmt.Sprintf(":%d", currentConfig.ListenPort),
+		Handler:           handler,
+		ReadTimeout:       time.Duration(currentConfig.ReadTimeoutSeconds) * time.Second,
+		ReadHeaderTimeout: time.Duration(currentConfig.ReadTimeoutSeconds) * time.Second,
+		WriteTimeout:      time.Duration(currentConfig.WriteTimeoutSeconds) * time.Second,
+		IdleTimeout:       time.Duration(currentConfig.IdleTimeoutSeconds) * time.Second,
+		MaxHeaderBytes:    currentConfig.MaxHeaderBytes,
+	}
+}
+
+// serve accepts connections on listener. /readyz only reports ready while it does, so probes never see ready
+// before the port is bound or after the server was shut down.
+func serve(server *http.Server, listener net.Listener) error {
+	ready.Store(true)
+	defer ready.Store(false)
+	return server.Serve(listener)
+}
+
+// limitRequestBody caps how much of the request body handlers can read, reading past the cap fails with *http.MaxBytesError.
+func limitRequestBody(responseWriter http.ResponseWriter, request *http.Request) {
+	currentConfig, _ := currentConfiguration()
+	request.Body = http.MaxBytesReader(responseWriter, request.Body, currentConfig.MaxRequestBodyBytes)
+}
+
+func isRequestBodyTooLarge(err error) bool {
+	var maxBytesError *http.MaxBytesError
+	return errors.As(err, &maxBytesError)
+}
+
+// storeUnavailableError marks a failure to reach a shared store (redis), which fails the request with 503
+// rather than bringing down the process.
+type storeUnavailableError struct {
+	err error
+}
+
+func (err *storeUnavailableError) Error() string {
+	return "store unavailable: " + err.err.Error()
+}
+
+func (err *storeUnavailableError) Unwrap() error {
+	return err.err
+}
+
+func isStoreUnavailable(err error) bool {
+	var storeUnavailable *storeUnavailableError
+	return errors.As(err, &storeUnavailable)
+}
+
+// writeStoreError logs a challenge or token store error and answers the request with 503 or 500.
+func writeStoreError(responseWriter http.ResponseWriter, err error, logMessage string) {
+	log.Printf("%s: %v", logMessage, err)
+	if isStoreUnavailable(err) {
+		metrics.add("store_unavailable", 1)
+		http.Error(responseWriter, "503 service unavailable: the store is unreachable", http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(responseWriter, "500 internal server error", http.StatusInternalServerError)
+}
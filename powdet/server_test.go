@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReadyzFollowsTheListener(t *testing.T) {
+	setupTest(t, "")
+	ready.Store(false)
+
+	if response := serveTestRequest(newTestRequest("GET", "/readyz", "", "")); response.Code != http.StatusServiceUnavailable {
+		t.Fatalf("/readyz before listening returned %d, want 503", response.Code)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	currentConfig, _ := currentConfiguration()
+	server := newHTTPServer(currentConfig, serveMux)
+	serveErrors := make(chan error, 1)
+	go func() { serveErrors <- serve(server, listener) }()
+
+	// once a connection is accepted, the server is serving and must report ready
+	response, err := http.Get("http://" + listener.Addr().String() + "/readyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK || string(body) != "OK" {
+		t.Errorf("/readyz while serving returned %d %q, want 200 OK", response.StatusCode, body)
+	}
+
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-serveErrors; err != http.ErrServerClosed {
+		t.Errorf("serve returned %v, want http.ErrServerClosed", err)
+	}
+	if response := serveTestRequest(newTestRequest("GET", "/readyz", "", "")); response.Code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz after shutdown returned %d, want 503", response.Code)
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	setupTest(t, "")
+	testCases := []struct {
+		name       string
+		method     string
+		bearer     string
+		wantStatus int
+	}{
+		{name: "without a token", method: "GET", wantStatus: http.StatusOK},
+		{name: "with an unknown token", method: "GET", bearer: "nope", wantStatus: http.StatusOK},
+		{name: "POST", method: "POST", wantStatus: http.StatusMethodNotAllowed},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			response := serveTestRequest(newTestRequest(testCase.method, "/healthz", testCase.bearer, ""))
+			if response.Code != testCase.wantStatus {
+				t.Fatalf("%s /healthz returned %d, want %d", testCase.method, response.Code, testCase.wantStatus)
+			}
+			if testCase.wantStatus != http.StatusOK {
+				return
+			}
+			body := response.Body.String()
+			health := map[string]interface{}{}
+			if err := json.Unmarshal([]byte(body), &health); err != nil {
+				t.Fatalf("/healthz returned invalid json %q: %v", body, err)
+			}
+			if health["status"] != "ok" || health["configVersion"] != configVersion {
+				t.Errorf("/healthz returned %s", body)
+			}
+			for _, secret := range []string{testAdminToken, `"m"`, "memory", "argon2"} {
+				if strings.Contains(body, secret) {
+					t.Errorf("/healthz leaks %s: %s", secret, body)
+				}
+			}
+		})
+	}
+}
+
+// the probes only take the config read lock briefly, so they keep answering while reloads run
+func TestHealthzDuringReload(t *testing.T) {
+	setupTest(t, "")
+	ready.Store(true)
+	defer ready.Store(false)
+
+	var waitGroup sync.WaitGroup
+	waitGroup.Add(1)
+	go func() {
+		defer waitGroup.Done()
+		for i := 0; i < 20; i++ {
+			reloadConfiguration()
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		for _, path := range []string{"/healthz", "/readyz"} {
+			if response := serveTestRequest(newTestRequest("GET", path, "", "")); response.Code != http.StatusOK {
+				t.Errorf("%s during a reload returned %d", path, response.Code)
+			}
+		}
+	}
+	waitGroup.Wait()
+}
+
+func TestRequestBodyLimit(t *testing.T) {
+	setupTest(t, `{"max_request_body_bytes": 512}`)
+	token := createTestToken(t, "a")
+	entry := `{"challenge": "bm90IGEgY2hhbGxlbmdl", "nonce": "00"}`
+
+	testCases := []struct {
+		name       string
+		entries    int
+		wantStatus int
+	}{
+		{name: "under the limit", entries: 1, wantStatus: http.StatusOK},
+		{name: "over the limit", entries: 20, wantStatus: http.StatusRequestEntityTooLarge},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			body := "[" + strings.TrimSuffix(strings.Repeat(entry+",", testCase.entries), ",") + "]"
+			response := serveTestRequest(newTestRequest("POST", "/VerifyBatch", token, body))
+			if response.Code != testCase.wantStatus {
+				t.Fatalf("a %d byte body returned %d, want %d: %s", len(body), response.Code, testCase.wantStatus, response.Body.String())
+			}
+			if testCase.wantStatus == http.StatusRequestEntityTooLarge &&
+				!strings.Contains(response.Body.String(), "must not exceed 512 bytes") {
+				t.Errorf("the 413 doesn't name the limit: %s", response.Body.String())
+			}
+		})
+	}
+}
+
+func TestHTTPServerTimeouts(t *testing.T) {
+	testCases := []struct {
+		name               string
+		configJSON         string
+		wantReadTimeout    time.Duration
+		wantWriteTimeout   time.Duration
+		wantIdleTimeout    time.Duration
+		wantMaxHeaderBytes int
+	}{
+		{
+			name:            "defaults",
+			wantReadTimeout: 10 * time.Second, wantWriteTimeout: 30 * time.Second, wantIdleTimeout: 60 * time.Second,
+			wantMaxHeaderBytes: 32 * 1024,
+		},
+		{
+			name:            "configured",
+			configJSON:      `{"read_timeout_seconds": 1, "write_timeout_seconds": 2, "idle_timeout_seconds": 3, "max_header_bytes": 4096}`,
+			wantReadTimeout: time.Second, wantWriteTimeout: 2 * time.Second, wantIdleTimeout: 3 * time.Second,
+			wantMaxHeaderBytes: 4096,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			setupTest(t, testCase.configJSON)
+			currentConfig, _ := currentConfiguration()
+			server := newHTTPServer(currentConfig, serveMux)
+			if server.ReadTimeout != testCase.wantReadTimeout || server.ReadHeaderTimeout != testCase.wantReadTimeout {
+				t.Errorf("read timeouts are %s and %s, want %s", server.ReadTimeout, server.ReadHeaderTimeout, testCase.wantReadTimeout)
+			}
+			if server.WriteTimeout != testCase.wantWriteTimeout {
+				t.Errorf("write timeout is %s, want %s", server.WriteTimeout, testCase.wantWriteTimeout)
+			}
+			if server.IdleTimeout != testCase.wantIdleTimeout {
+				t.Errorf("idle timeout is %s, want %s", server.IdleTimeout, testCase.wantIdleTimeout)
+			}
+			if server.MaxHeaderBytes != testCase.wantMaxHeaderBytes {
+				t.Errorf("max header bytes is %d, want %d", server.MaxHeaderBytes, testCase.wantMaxHeaderBytes)
+			}
+		})
+	}
+}
+
+// a client that never finishes its headers gets disconnected after read_timeout_seconds
+func TestSlowHeadersAreDisconnected(t *testing.T) {
+	setupTest(t, `{"read_timeout_seconds": 1}`)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	currentConfig, _ := currentConfiguration()
+	server := newHTTPServer(currentConfig, serveMux)
+	go serve(server, listener)
+	defer server.Close()
+
+	connection, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+	if _, err := connection.Write([]byte("GET /healthz HTTP/1.1\r\nHost: powdet\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	connection.SetReadDeadline(time.Now().Add(5 * time.Second))
+	startedAt := time.Now()
+	io.ReadAll(connection)
+	if elapsed := time.Since(startedAt); elapsed > 3*time.Second {
+		t.Errorf("the connection stayed open for %s, want it closed after about 1s", elapsed)
+	}
+}
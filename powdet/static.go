@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+//go:embed static
+var embeddedStatic embed.FS
+
+// ETags of the embedded files never change for the lifetime of the process, so they are computed once
+var embeddedETags sync.Map
+
+func init() {
+	// older mime tables don't know about wasm or source maps, and browsers refuse to
+	// instantiateStreaming a .wasm file that isn't served as application/wasm
+	mime.AddExtensionType(".wasm", "application/wasm")
+	mime.AddExtensionType(".map", "application/json")
+}
+
+// staticFileSystem prefers the on-disk static_dir (for development) and falls back to the embedded assets.
+func staticFileSystem(staticDir string) fs.FS {
+	if staticDir != "" {
+		return os.DirFS(staticDir)
+	}
+	embeddedStaticRoot, err := fs.Sub(embeddedStatic, "static")
+	if err != nil {
+		log.Fatalf("fs.Sub(embeddedStatic, \"static\") failed: %v", err)
+	}
+	return embeddedStaticRoot
+}
+
+const staticAllowedMethods = "GET, HEAD, OPTIONS"
+
+func staticHandler(prefix string) http.Handler {
+	return http.StripPrefix(prefix, http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		if applyCORS(responseWriter, request, "GET, HEAD") {
+			return
+		}
+		switch request.Method {
+		case http.MethodGet, http.MethodHead:
+			// HEAD is answered by FileServerFS below with the same headers and no body
+		case http.MethodOptions:
+			responseWriter.Header().Set("Allow", staticAllowedMethods)
+			responseWriter.WriteHeader(http.StatusNoContent)
+			return
+		default:
+			responseWriter.Header().Set("Allow", staticAllowedMethods)
+			http.Error(responseWriter, "405 Method Not Allowed, try GET", http.StatusMethodNotAllowed)
+			return
+		}
+
+		currentConfig, _ := currentConfiguration()
+		staticFS := staticFileSystem(currentConfig.StaticDir)
+
+		name := strings.TrimPrefix(path.Clean("/"+request.URL.Path), "/")
+		content, err := fs.ReadFile(staticFS, name)
+		if name == "" || err != nil {
+			http.NotFound(responseWriter, request)
+			return
+		}
+
+		etag, cached := "", false
+		if currentConfig.StaticDir == "" {
+			var cachedETag interface{}
+			cachedETag, cached = embeddedETags.Load(name)
+			if cached {
+				etag = cachedETag.(string)
+			}
+		}
+		if !cached {
+			contentHash := sha256.Sum256(content)
+			etag = `"` + hex.EncodeToString(contentHash[:16]) + `"`
+			if currentConfig.StaticDir == "" {
+				embeddedETags.Store(name, etag)
+			}
+		}
+
+		responseWriter.Header().Set("ETag", etag)
+		if currentConfig.StaticDir == "" {
+			responseWriter.Header().Set("Cache-Control", "public, max-age=3600")
+		} else {
+			responseWriter.Header().Set("Cache-Control", "no-cache")
+		}
+		if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+			responseWriter.Header().Set("Content-Type", contentType)
+		}
+
+		// FileServerFS answers If-None-Match with 304 based on the ETag header set above
+		http.FileServerFS(staticFS).ServeHTTP(responseWriter, request)
+	}))
+}
+
+// legacyStaticHandler serves the static assets under a deprecated prefix, marking every response as deprecated
+// and counting the requests per referer host, so we can find out who still has to move to currentPrefix.
+func legacyStaticHandler(legacyPrefix, currentPrefix string) http.Handler {
+	handler := staticHandler(legacyPrefix)
+	return http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		refererHost := "none"
+		if refererURL, err := url.Parse(request.Referer()); err == nil && refererURL.Host != "" {
+			refererHost = refererURL.Host
+		}
+		metrics.addLabeled("legacy_static_requests", refererHost, 1)
+
+		currentConfig, _ := currentConfiguration()
+		if currentConfig.LegacyStaticEnabled != nil && !*currentConfig.LegacyStaticEnabled {
+			errorMessage := fmt.Sprintf("410 Gone: %s was removed, use %s instead", legacyPrefix, currentPrefix)
+			http.Error(responseWriter, errorMessage, http.StatusGone)
+			return
+		}
+
+		responseWriter.Header().Set("Warning", fmt.Sprintf(`299 - "Deprecated path, use %s instead"`, currentPrefix))
+		responseWriter.Header().Set("X-Deprecated-Path", currentPrefix)
+		handler.ServeHTTP(responseWriter, request)
+	})
+}
@@ -52,9 +52,25 @@ function normalizeChallenge(raw) {
     preimageBase64: raw.i,
     difficultyHex: raw.d,
     difficultyLevel: raw.dl,
+    // challenges issued before the algorithm field existed are always argon2id
+    algorithm: raw.a || "argon2id",
+    // challenges without nlen accept any nonce of up to 8 bytes
+    nonceLength: raw.nlen || 0,
+    // "tail" (default) compares the trailing hex of the hash against the difficulty, "head" the leading hex
+    difficultyPosition: raw.dpos || "tail",
   };
 }
 
+async function sha256HashHex(opts) {
+  const { nonceHex, preimageBytes } = opts;
+  const nonceBytes = hexToBytes(nonceHex);
+  const input = new Uint8Array(nonceBytes.length + preimageBytes.length);
+  input.set(nonceBytes, 0);
+  input.set(preimageBytes, nonceBytes.length);
+  const digest = new Uint8Array(await crypto.subtle.digest("SHA-256", input));
+  return Array.from(digest, (b) => b.toString(16).padStart(2, "0")).join("");
+}
+
 async function argon2idHashHex(opts) {
   const { nonceHex, preimageBytes, challenge } = opts;
   const nonceBytes = hexToBytes(nonceHex);
@@ -81,15 +97,22 @@ async function runSingleBatch(ctx) {
     if ((nonceHex.length % 2) === 1) {
       nonceHex = `0${nonceHex}`;
     }
+    if (challenge.nonceLength) {
+      nonceHex = nonceHex.padStart(challenge.nonceLength * 2, "0");
+    }
 
-    const hashHex = await argon2idHashHex({
+    const hashFn = challenge.algorithm === "sha256" ? sha256HashHex : argon2idHashHex;
+    const hashHex = await hashFn({
       nonceHex,
       preimageBytes,
       challenge,
     });
 
     const difficultyLen = challenge.difficultyHex.length;
-    const endOfHash = hashHex.substring(hashHex.length - difficultyLen);
+    const endOfHash =
+      challenge.difficultyPosition === "head"
+        ? hashHex.substring(0, difficultyLen)
+        : hashHex.substring(hashHex.length - difficultyLen);
 
     if (endOfHash < ctx.smallestHash) {
       ctx.smallestHash = endOfHash;
@@ -210,7 +233,8 @@ onmessage = function (e) {
     challenge,
   };
 
-  ensureHashWasmReady()
+  const ready = challenge.algorithm === "sha256" ? Promise.resolve() : ensureHashWasmReady();
+  ready
     .then(() => runBatches(ctx))
     .catch((err) => {
       postMessage({
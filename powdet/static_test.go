@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStaticServesEmbeddedFiles(t *testing.T) {
+	setupTest(t, "")
+	testCases := []struct {
+		path            string
+		wantStatus      int
+		wantContentType string
+	}{
+		{path: "/powdet/static/pow-bot-deterrent.js", wantStatus: http.StatusOK, wantContentType: "text/javascript"},
+		{path: "/powdet/static/pow-bot-deterrent.css", wantStatus: http.StatusOK, wantContentType: "text/css"},
+		{path: "/powdet/static/missing.js", wantStatus: http.StatusNotFound},
+		{path: "/powdet/static/", wantStatus: http.StatusNotFound},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.path, func(t *testing.T) {
+			response := serveTestRequest(newTestRequest("GET", testCase.path, "", ""))
+			if response.Code != testCase.wantStatus {
+				t.Fatalf("GET %s returned %d, want %d", testCase.path, response.Code, testCase.wantStatus)
+			}
+			if testCase.wantStatus != http.StatusOK {
+				return
+			}
+			if response.Body.Len() == 0 {
+				t.Errorf("GET %s returned an empty body", testCase.path)
+			}
+			if contentType := response.Header().Get("Content-Type"); !strings.HasPrefix(contentType, testCase.wantContentType) {
+				t.Errorf("GET %s has Content-Type %s, want %s", testCase.path, contentType, testCase.wantContentType)
+			}
+			if response.Header().Get("Cache-Control") != "public, max-age=3600" {
+				t.Errorf("GET %s has Cache-Control %s", testCase.path, response.Header().Get("Cache-Control"))
+			}
+		})
+	}
+}
+
+func TestStaticConditionalGet(t *testing.T) {
+	setupTest(t, "")
+	response := serveTestRequest(newTestRequest("GET", "/powdet/static/pow-bot-deterrent.js", "", ""))
+	etag := response.Header().Get("ETag")
+	if response.Code != http.StatusOK || etag == "" {
+		t.Fatalf("GET returned %d with ETag %q", response.Code, etag)
+	}
+
+	testCases := []struct {
+		ifNoneMatch string
+		wantStatus  int
+	}{
+		{ifNoneMatch: etag, wantStatus: http.StatusNotModified},
+		{ifNoneMatch: `"something-else"`, wantStatus: http.StatusOK},
+	}
+	for _, testCase := range testCases {
+		request := newTestRequest("GET", "/powdet/static/pow-bot-deterrent.js", "", "")
+		request.Header.Set("If-None-Match", testCase.ifNoneMatch)
+		response := serveTestRequest(request)
+		if response.Code != testCase.wantStatus {
+			t.Errorf("If-None-Match %s returned %d, want %d", testCase.ifNoneMatch, response.Code, testCase.wantStatus)
+		}
+	}
+}
+
+func TestStaticDirOverride(t *testing.T) {
+	staticDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(staticDir, "pow-bot-deterrent.js"), []byte("// from disk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	setupTest(t, `{"static_dir": "`+staticDir+`"}`)
+
+	response := serveTestRequest(newTestRequest("GET", "/powdet/static/pow-bot-deterrent.js", "", ""))
+	if response.Code != http.StatusOK || response.Body.String() != "// from disk" {
+		t.Fatalf("GET returned %d %q, want the file from static_dir", response.Code, response.Body.String())
+	}
+	if response.Header().Get("Cache-Control") != "no-cache" {
+		t.Errorf("files from static_dir have Cache-Control %s, want no-cache", response.Header().Get("Cache-Control"))
+	}
+	// static_dir replaces the embedded files, it doesn't fall back to them
+	response = serveTestRequest(newTestRequest("GET", "/powdet/static/pow-bot-deterrent.css", "", ""))
+	if response.Code != http.StatusNotFound {
+		t.Errorf("GET of a file missing from static_dir returned %d, want 404", response.Code)
+	}
+}
+
+func TestLegacyStaticPath(t *testing.T) {
+	testCases := []struct {
+		name           string
+		configJSON     string
+		referer        string
+		wantStatus     int
+		wantDeprecated bool
+		wantLabel      string
+	}{
+		{name: "enabled by default", referer: "https://landing.example.com/page", wantStatus: http.StatusOK, wantDeprecated: true, wantLabel: "landing.example.com"},
+		{name: "without a referer", wantStatus: http.StatusOK, wantDeprecated: true, wantLabel: "none"},
+		{name: "enabled explicitly", configJSON: `{"legacy_static_enabled": true}`, wantStatus: http.StatusOK, wantDeprecated: true, wantLabel: "none"},
+		{name: "disabled", configJSON: `{"legacy_static_enabled": false}`, referer: "https://old.example.com/", wantStatus: http.StatusGone, wantLabel: "old.example.com"},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			setupTest(t, testCase.configJSON)
+			request := newTestRequest("GET", "/pow-bot-deterrent-static/pow-bot-deterrent.js", "", "")
+			if testCase.referer != "" {
+				request.Header.Set("Referer", testCase.referer)
+			}
+			response := serveTestRequest(request)
+			if response.Code != testCase.wantStatus {
+				t.Fatalf("GET returned %d, want %d", response.Code, testCase.wantStatus)
+			}
+
+			if testCase.wantDeprecated {
+				current := serveTestRequest(newTestRequest("GET", "/powdet/static/pow-bot-deterrent.js", "", ""))
+				if response.Body.String() != current.Body.String() {
+					t.Error("the legacy path serves something else than /powdet/static/")
+				}
+				if response.Header().Get("X-Deprecated-Path") != "/powdet/static/" {
+					t.Errorf("X-Deprecated-Path is %q, want /powdet/static/", response.Header().Get("X-Deprecated-Path"))
+				}
+				if !strings.HasPrefix(response.Header().Get("Warning"), "299 ") {
+					t.Errorf("Warning is %q, want a 299 warning", response.Header().Get("Warning"))
+				}
+			} else if !strings.Contains(response.Body.String(), "/powdet/static/") {
+				t.Errorf("the 410 response %q doesn't point at /powdet/static/", response.Body.String())
+			}
+
+			if count := metricValue("legacy_static_requests"); count != 1 {
+				t.Errorf("legacy_static_requests is %d, want 1", count)
+			}
+			if labels := metrics.snapshotLabeled()["legacy_static_requests"]; len(labels) != 1 || labels[testCase.wantLabel] != 1 {
+				t.Errorf("legacy_static_requests is labeled %v, want %s", labels, testCase.wantLabel)
+			}
+		})
+	}
+}
+
+func TestLegacyStaticRefererHostsAreCapped(t *testing.T) {
+	setupTest(t, "")
+	for i := 0; i < maxLabelsPerCounter+50; i++ {
+		request := newTestRequest("GET", "/pow-bot-deterrent-static/pow-bot-deterrent.js", "", "")
+		request.Header.Set("Referer", fmt.Sprintf("https://site-%d.example.com/", i))
+		serveTestRequest(request)
+	}
+	labels := metrics.snapshotLabeled()["legacy_static_requests"]
+	if len(labels) != maxLabelsPerCounter+1 || labels[otherLabelsKey] != 50 {
+		t.Errorf("legacy_static_requests has %d labels with %d under %s, want %d labels and 50",
+			len(labels), labels[otherLabelsKey], otherLabelsKey, maxLabelsPerCounter+1)
+	}
+}
+
+func TestStaticMethods(t *testing.T) {
+	setupTest(t, "")
+	get := serveTestRequest(newTestRequest("GET", "/powdet/static/pow-bot-deterrent.js", "", ""))
+	if get.Code != http.StatusOK {
+		t.Fatalf("GET returned %d", get.Code)
+	}
+
+	testCases := []struct {
+		method     string
+		path       string
+		wantStatus int
+		wantBody   bool
+		wantAllow  bool
+	}{
+		{method: "GET", path: "/powdet/static/pow-bot-deterrent.js", wantStatus: http.StatusOK, wantBody: true},
+		{method: "HEAD", path: "/powdet/static/pow-bot-deterrent.js", wantStatus: http.StatusOK},
+		{method: "HEAD", path: "/pow-bot-deterrent-static/pow-bot-deterrent.js", wantStatus: http.StatusOK},
+		{method: "OPTIONS", path: "/powdet/static/pow-bot-deterrent.js", wantStatus: http.StatusNoContent, wantAllow: true},
+		{method: "POST", path: "/powdet/static/pow-bot-deterrent.js", wantStatus: http.StatusMethodNotAllowed, wantBody: true, wantAllow: true},
+		{method: "PUT", path: "/powdet/static/pow-bot-deterrent.js", wantStatus: http.StatusMethodNotAllowed, wantBody: true, wantAllow: true},
+		{method: "DELETE", path: "/pow-bot-deterrent-static/pow-bot-deterrent.js", wantStatus: http.StatusMethodNotAllowed, wantBody: true, wantAllow: true},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.method+" "+testCase.path, func(t *testing.T) {
+			response := serveTestRequest(newTestRequest(testCase.method, testCase.path, "", ""))
+			if response.Code != testCase.wantStatus {
+				t.Fatalf("%s %s returned %d, want %d", testCase.method, testCase.path, response.Code, testCase.wantStatus)
+			}
+			if hasBody := response.Body.Len() > 0; hasBody != testCase.wantBody {
+				t.Errorf("%s %s returned a body of %d bytes", testCase.method, testCase.path, response.Body.Len())
+			}
+			allow := response.Header().Get("Allow")
+			if testCase.wantAllow && allow != "GET, HEAD, OPTIONS" {
+				t.Errorf("%s %s has Allow %q, want GET, HEAD, OPTIONS", testCase.method, testCase.path, allow)
+			}
+			if !testCase.wantAllow && allow != "" {
+				t.Errorf("%s %s has Allow %q, want none", testCase.method, testCase.path, allow)
+			}
+			if testCase.wantStatus != http.StatusOK {
+				return
+			}
+			// HEAD describes the same file GET would send
+			for _, header := range []string{"ETag", "Content-Type", "Content-Length", "Cache-Control"} {
+				if response.Header().Get(header) != get.Header().Get(header) {
+					t.Errorf("%s %s has %s %q, GET has %q", testCase.method, testCase.path, header, response.Header().Get(header), get.Header().Get(header))
+				}
+			}
+		})
+	}
+}
+
+func TestStaticContentTypes(t *testing.T) {
+	staticDir := t.TempDir()
+	files := map[string]string{
+		"argon2.wasm":                "\x00asm\x01\x00\x00\x00",
+		"pow-bot-deterrent.js.map":   `{"version":3}`,
+		"pow-bot-deterrent.js":       "console.log('from disk')",
+		"pow-bot-deterrent-font.svg": "<svg></svg>",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(staticDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setupTest(t, `{"static_dir": "`+staticDir+`"}`)
+
+	testCases := []struct {
+		name            string
+		wantContentType string
+	}{
+		{name: "argon2.wasm", wantContentType: "application/wasm"},
+		{name: "pow-bot-deterrent.js.map", wantContentType: "application/json"},
+		{name: "pow-bot-deterrent.js", wantContentType: "text/javascript"},
+		{name: "pow-bot-deterrent-font.svg", wantContentType: "image/svg+xml"},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			for _, method := range []string{"GET", "HEAD"} {
+				response := serveTestRequest(newTestRequest(method, "/powdet/static/"+testCase.name, "", ""))
+				if response.Code != http.StatusOK {
+					t.Fatalf("%s %s returned %d", method, testCase.name, response.Code)
+				}
+				if contentType := response.Header().Get("Content-Type"); !strings.HasPrefix(contentType, testCase.wantContentType) {
+					t.Errorf("%s %s has Content-Type %q, want %s", method, testCase.name, contentType, testCase.wantContentType)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	errors "git.sequentialread.com/forest/pkg-errors"
+)
+
+// folderTokenStore is the original token layout: one file per token named <token>_<name> in the
+// PoW_Bot_Deterrent_API_Tokens folder, so tokens can also be added or removed by hand.
+type folderTokenStore struct {
+	folder string
+	// token -> unix timestamp after which the token is no longer accepted, 0 means it never expires
+	tokens map[string]int64
+	mu     sync.RWMutex
+	// when the folder was last re-read because of an unknown token, see Exists
+	lastMissReload time.Time
+	missReloadMu   sync.Mutex
+	// when the "folder is missing" warning was last logged, see load
+	lastMissingLog time.Time
+}
+
+// a flood of unknown tokens re-reads the tokens folder at most this often
+const folderTokenStoreMissReloadInterval = time.Second
+
+// while the tokens folder is missing, say so in the log at most this often
+const folderTokenStoreMissingLogInterval = time.Minute
+
+// tokensFolderUnavailable is set while the tokens folder has gone missing (deleted or unmounted) at runtime.
+// The cached tokens keep working and /readyz stays 200, /healthz and the tokens_folder_unavailable gauge report it.
+var tokensFolderUnavailable atomic.Bool
+
+// tokenFileContent is what gets stored inside each file in the API tokens folder.
+// Older token files only contain the creation unix timestamp as plain text.
+type tokenFileContent struct {
+	CreatedAt int64  `json:"createdAt"`
+	Note      string `json:"note,omitempty"`
+	ExpiresAt int64  `json:"expiresAt,omitempty"`
+}
+
+func parseTokenFile(content []byte) tokenFileContent {
+	tokenFile := tokenFileContent{}
+	if json.Unmarshal(content, &tokenFile) == nil {
+		return tokenFile
+	}
+	tokenFile.CreatedAt, _ = strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	return tokenFile
+}
+
+// locateAPITokensFolder looks for the tokens folder in the working directory and next to the executable.
+func locateAPITokensFolder() (string, bool) {
+	workingDirectory, err := os.Getwd()
+	if err != nil {
+		log.Fatalf("locateAPITokensFolder(): can't os.Getwd(): %v", err)
+	}
+	executableDirectory, err := getCurrentExecDir()
+	if err != nil {
+		log.Fatalf("locateAPITokensFolder(): can't getCurrentExecDir(): %v", err)
+	}
+
+	nextToExecutable := filepath.Join(executableDirectory, apiTokensFolderName)
+	inWorkingDirectory := filepath.Join(workingDirectory, apiTokensFolderName)
+
+	nextToExecutableStat, err := os.Stat(nextToExecutable)
+	foundKeysNextToExecutable := err == nil && nextToExecutableStat.IsDir()
+	inWorkingDirectoryStat, err := os.Stat(inWorkingDirectory)
+	foundKeysInWorkingDirectory := err == nil && inWorkingDirectoryStat.IsDir()
+	if foundKeysNextToExecutable && foundKeysInWorkingDirectory && workingDirectory != executableDirectory {
+		log.Fatalf(`locateAPITokensFolder(): Something went wrong with your installation, 
+			I found two PoW_Bot_Deterrent_API_Tokens folders and I'm not sure which one to use.
+			One of them is located at %s
+			and the other is at %s`, inWorkingDirectory, nextToExecutable)
+	}
+	if foundKeysInWorkingDirectory {
+		return inWorkingDirectory, true
+	} else if foundKeysNextToExecutable {
+		return nextToExecutable, true
+	}
+
+	return "", false
+}
+
+func newFolderTokenStore(folder string) (*folderTokenStore, error) {
+	store := &folderTokenStore{folder: folder, tokens: map[string]int64{}}
+	if err := store.load(); err != nil {
+		return nil, errors.Wrapf(err, "failed to load API tokens from %s", folder)
+	}
+	return store, nil
+}
+
+// load re-reads the tokens folder into the cache. If the folder is missing the previous cache is kept,
+// so a deleted or unmounted folder doesn't lock out every client until it comes back.
+func (store *folderTokenStore) load() error {
+	records, err := store.List()
+	if err != nil {
+		if _, statErr := os.Stat(store.folder); os.IsNotExist(statErr) {
+			store.setFolderUnavailable(true)
+			return nil
+		}
+		return err
+	}
+	store.setFolderUnavailable(false)
+	tokens := map[string]int64{}
+	for _, record := range records {
+		tokens[record.Token] = record.ExpiresAt
+	}
+	store.mu.Lock()
+	store.tokens = tokens
+	store.mu.Unlock()
+	return nil
+}
+
+func (store *folderTokenStore) setFolderUnavailable(unavailable bool) {
+	wasUnavailable := tokensFolderUnavailable.Swap(unavailable)
+	if unavailable {
+		metrics.set("tokens_folder_unavailable", 1)
+		store.missReloadMu.Lock()
+		defer store.missReloadMu.Unlock()
+		if time.Since(store.lastMissingLog) >= folderTokenStoreMissingLogInterval {
+			store.lastMissingLog = time.Now()
+			slog.Warn("the API tokens folder is missing, keeping the cached tokens until it comes back", "folder", store.folder, "cachedTokens", store.cachedTokenCount())
+		}
+	} else if wasUnavailable {
+		metrics.set("tokens_folder_unavailable", 0)
+		slog.Info("the API tokens folder is available again", "folder", store.folder)
+	}
+}
+
+func (store *folderTokenStore) cachedTokenCount() int {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return len(store.tokens)
+}
+
+// findTokenFile returns the name of the file that belongs to token, or "" if there is none.
+func (store *folderTokenStore) findTokenFile(token string) (string, error) {
+	fileInfos, err := ioutil.ReadDir(store.folder)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to list the apiTokensFolder (%s)", store.folder)
+	}
+	for _, fileInfo := range fileInfos {
+		if strings.HasPrefix(fileInfo.Name(), token+"_") {
+			return fileInfo.Name(), nil
+		}
+	}
+	return "", nil
+}
+
+func (store *folderTokenStore) Create(record TokenRecord, actor string) error {
+	tokenFileBytes, err := json.Marshal(tokenFileContent{CreatedAt: record.CreatedAt, Note: record.Note})
+	if err != nil {
+		return errors.Wrap(err, "json marshal failed")
+	}
+	tokenFilePath := path.Join(store.folder, fmt.Sprintf("%s_%s", record.Token, record.Name))
+	err = ioutil.WriteFile(tokenFilePath, tokenFileBytes, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "failed to write the token file (%s)", tokenFilePath)
+	}
+
+	store.mu.Lock()
+	store.tokens[record.Token] = 0
+	store.mu.Unlock()
+	return nil
+}
+
+func (store *folderTokenStore) Revoke(token, actor string) (bool, error) {
+	fileInfos, err := ioutil.ReadDir(store.folder)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to list the apiTokensFolder (%s)", store.folder)
+	}
+	removed := false
+	for _, fileInfo := range fileInfos {
+		if strings.HasPrefix(fileInfo.Name(), token) {
+			os.Remove(path.Join(store.folder, fileInfo.Name()))
+			removed = true
+		}
+	}
+	if removed {
+		store.mu.Lock()
+		delete(store.tokens, token)
+		store.mu.Unlock()
+	}
+	return removed, nil
+}
+
+func (store *folderTokenStore) Expire(token string, expiresAt time.Time, actor string) error {
+	tokenFileName, err := store.findTokenFile(token)
+	if err != nil {
+		return err
+	}
+	if tokenFileName == "" {
+		return errors.Errorf("token %s has no token file", truncatedToken(token))
+	}
+	tokenFilePath := path.Join(store.folder, tokenFileName)
+	content, err := ioutil.ReadFile(tokenFilePath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read the token file (%s)", tokenFilePath)
+	}
+
+	tokenFile := parseTokenFile(content)
+	tokenFile.ExpiresAt = expiresAt.Unix()
+	tokenFileBytes, err := json.Marshal(tokenFile)
+	if err != nil {
+		return errors.Wrap(err, "json marshal failed")
+	}
+	err = ioutil.WriteFile(tokenFilePath, tokenFileBytes, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "failed to write the token file (%s)", tokenFilePath)
+	}
+
+	store.mu.Lock()
+	store.tokens[token] = expiresAt.Unix()
+	store.mu.Unlock()
+	return nil
+}
+
+func (store *folderTokenStore) Get(token string) (TokenRecord, bool, error) {
+	records, err := store.List()
+	if err != nil {
+		return TokenRecord{}, false, err
+	}
+	for _, record := range records {
+		if record.Token == token {
+			return record, true, nil
+		}
+	}
+	return TokenRecord{}, false, nil
+}
+
+func (store *folderTokenStore) List() ([]TokenRecord, error) {
+	fileInfos, err := ioutil.ReadDir(store.folder)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list the apiTokensFolder (%s)", store.folder)
+	}
+	records := []TokenRecord{}
+	for _, fileInfo := range fileInfos {
+		filenameSplit := strings.Split(fileInfo.Name(), "_")
+		if len(filenameSplit) != 2 || len(filenameSplit[0]) != 32 {
+			continue
+		}
+		filepath := path.Join(store.folder, fileInfo.Name())
+		content, err := ioutil.ReadFile(filepath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read the token file (%s)", filepath)
+		}
+		tokenFile := parseTokenFile(content)
+		records = append(records, TokenRecord{
+			Token:     filenameSplit[0],
+			Name:      filenameSplit[1],
+			CreatedAt: tokenFile.CreatedAt,
+			Note:      tokenFile.Note,
+			ExpiresAt: tokenFile.ExpiresAt,
+		})
+	}
+	return records, nil
+}
+
+func (store *folderTokenStore) Exists(token string) (bool, error) {
+	store.mu.RLock()
+	expiresAt, ok := store.tokens[token]
+	store.mu.RUnlock()
+	if ok && !tokensFolderUnavailable.Load() {
+		return TokenRecord{ExpiresAt: expiresAt}.valid(), nil
+	}
+	// refresh once on miss (handles manual token file changes), throttled so unknown tokens can't cause a ReadDir storm.
+	// While the folder is missing, known tokens take this path too, so the folder is picked up within a reload interval
+	// of coming back.
+	store.missReloadMu.Lock()
+	if time.Since(store.lastMissReload) < folderTokenStoreMissReloadInterval {
+		store.missReloadMu.Unlock()
+		return ok && TokenRecord{ExpiresAt: expiresAt}.valid(), nil
+	}
+	store.lastMissReload = time.Now()
+	store.missReloadMu.Unlock()
+
+	if err := store.load(); err != nil {
+		log.Printf("failed to reload API tokens: %v", err)
+		return false, nil
+	}
+	store.mu.RLock()
+	expiresAt, ok = store.tokens[token]
+	store.mu.RUnlock()
+	return ok && TokenRecord{ExpiresAt: expiresAt}.valid(), nil
+}
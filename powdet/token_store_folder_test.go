@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// An unknown token re-reads the folder at most once per second, so a flood of bogus tokens can't hammer the disk,
+// while token files added by hand are still picked up.
+func TestFolderTokenStoreMissReloadThrottle(t *testing.T) {
+	setupTest(t, "")
+	defer tokensFolderUnavailable.Store(false)
+	folder := t.TempDir()
+	store, err := newFolderTokenStore(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first miss reloads and starts the throttle window
+	if exists, err := store.Exists(strings.Repeat("0", 32)); err != nil || exists {
+		t.Fatalf("Exists of an unknown token returned %t, %v", exists, err)
+	}
+	addedByHand := strings.Repeat("ab", 16)
+	if err := os.WriteFile(filepath.Join(folder, addedByHand+"_by-hand"), []byte("1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name       string
+		lastReload time.Time
+		want       bool
+	}{
+		{name: "within the throttle window", lastReload: time.Now(), want: false},
+		{name: "after the throttle window", lastReload: time.Now().Add(-folderTokenStoreMissReloadInterval), want: true},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			store.missReloadMu.Lock()
+			store.lastMissReload = testCase.lastReload
+			store.missReloadMu.Unlock()
+			for i := 0; i < 100; i++ {
+				if exists, err := store.Exists(addedByHand); err != nil || exists != testCase.want {
+					t.Fatalf("Exists of the token added by hand returned %t, %v, want %t", exists, err, testCase.want)
+				}
+			}
+		})
+	}
+}
+
+func TestFolderTokenStoreExpireUnknownToken(t *testing.T) {
+	store, err := newFolderTokenStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := testTokenFor("missing")
+	err = store.Expire(token, time.Now(), "test")
+	if err == nil || strings.Contains(err.Error(), token) || !strings.Contains(err.Error(), truncatedToken(token)) {
+		t.Errorf("Expire of an unknown token returned %v, want an error with only the truncated token", err)
+	}
+}
+
+// A folder that disappears at runtime (deleted or unmounted) keeps the cached tokens working and the service ready,
+// shows up in the metrics and /healthz, warns once, and everything goes back to normal when the folder is back.
+func TestFolderTokenStoreMissingFolder(t *testing.T) {
+	setupTest(t, "")
+	logs := captureLogs(t, "info", "")
+	ready.Store(true)
+	defer ready.Store(false)
+	defer tokensFolderUnavailable.Store(false)
+
+	folder := filepath.Join(t.TempDir(), apiTokensFolderName)
+	movedFolder := folder + ".moved"
+	if err := os.Mkdir(folder, 0755); err != nil {
+		t.Fatal(err)
+	}
+	token := strings.Repeat("cd", 16)
+	if err := os.WriteFile(filepath.Join(folder, token+"_landing"), []byte("1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	store, err := newFolderTokenStore(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenStore = store
+
+	testCases := []struct {
+		name            string
+		change          func() error
+		wantUnavailable int64
+		wantWarnings    int
+		wantLog         string
+	}{
+		{name: "folder present"},
+		{
+			name:            "folder removed",
+			change:          func() error { return os.Rename(folder, movedFolder) },
+			wantUnavailable: 1,
+			wantWarnings:    1,
+			wantLog:         "keeping the cached tokens",
+		},
+		{
+			name:            "folder still missing",
+			wantUnavailable: 1,
+			wantWarnings:    1,
+		},
+		{
+			name:         "folder restored",
+			change:       func() error { return os.Rename(movedFolder, folder) },
+			wantWarnings: 1,
+			wantLog:      "the API tokens folder is available again",
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if testCase.change != nil {
+				if err := testCase.change(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// every step re-checks the folder instead of waiting out the miss reload throttle
+			store.missReloadMu.Lock()
+			store.lastMissReload = time.Time{}
+			store.missReloadMu.Unlock()
+
+			if exists, err := store.Exists(token); err != nil || !exists {
+				t.Fatalf("Exists of the cached token returned %t, %v", exists, err)
+			}
+			if exists, err := store.Exists(strings.Repeat("0", 32)); err != nil || exists {
+				t.Fatalf("Exists of an unknown token returned %t, %v", exists, err)
+			}
+			if unavailable := metricValue("tokens_folder_unavailable"); unavailable != testCase.wantUnavailable {
+				t.Errorf("tokens_folder_unavailable is %d, want %d", unavailable, testCase.wantUnavailable)
+			}
+			if response := serveTestRequest(newTestRequest("GET", "/readyz", "", "")); response.Code != http.StatusOK {
+				t.Errorf("/readyz returned %d, want 200 while the cached tokens are in use", response.Code)
+			}
+			response := serveTestRequest(newTestRequest("GET", "/healthz", "", ""))
+			health := map[string]interface{}{}
+			if err := json.Unmarshal(response.Body.Bytes(), &health); err != nil || response.Code != http.StatusOK {
+				t.Fatalf("/healthz returned %d %s (%v)", response.Code, response.Body.String(), err)
+			}
+			if reported := health["tokensFolderUnavailable"] == true; reported != (testCase.wantUnavailable == 1) {
+				t.Errorf("/healthz returned %s, want tokensFolderUnavailable %t", response.Body.String(), testCase.wantUnavailable == 1)
+			}
+			if warnings := strings.Count(logs.String(), "the API tokens folder is missing"); warnings != testCase.wantWarnings {
+				t.Errorf("the missing folder warning was logged %d times, want %d:\n%s", warnings, testCase.wantWarnings, logs.String())
+			}
+			if !strings.Contains(logs.String(), testCase.wantLog) {
+				t.Errorf("the log doesn't contain %q:\n%s", testCase.wantLog, logs.String())
+			}
+		})
+	}
+}
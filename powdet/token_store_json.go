@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	errors "git.sequentialread.com/forest/pkg-errors"
+)
+
+// jsonTokenStore keeps all API tokens in a single json file which is replaced atomically on every change,
+// and appends one line per change to an audit log next to it.
+type jsonTokenStore struct {
+	path      string
+	auditPath string
+	tokens    map[string]TokenRecord
+	mu        sync.RWMutex
+}
+
+type tokenAuditEntry struct {
+	Time        string `json:"time"`
+	Action      string `json:"action"`
+	TokenPrefix string `json:"tokenPrefix"`
+	Name        string `json:"name,omitempty"`
+	Actor       string `json:"actor,omitempty"`
+}
+
+func newJSONTokenStore(path, auditPath string) (*jsonTokenStore, error) {
+	store := &jsonTokenStore{path: path, auditPath: auditPath, tokens: map[string]TokenRecord{}}
+
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read the token store (%s)", path)
+	}
+	records := []TokenRecord{}
+	if err := json.Unmarshal(content, &records); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse the token store (%s)", path)
+	}
+	for _, record := range records {
+		store.tokens[record.Token] = record
+	}
+	return store, nil
+}
+
+// save writes all tokens to a temporary file and renames it over the store, so a crash never leaves a half written store behind.
+// The caller must hold store.mu.
+func (store *jsonTokenStore) save() error {
+	records := make([]TokenRecord, 0, len(store.tokens))
+	for _, record := range store.tokens {
+		records = append(records, record)
+	}
+	sortTokenRecords(records)
+	recordsBytes, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "json marshal failed")
+	}
+
+	tempFile, err := ioutil.TempFile(filepath.Dir(store.path), filepath.Base(store.path)+".tmp")
+	if err != nil {
+		return errors.Wrapf(err, "failed to create a temporary file next to the token store (%s)", store.path)
+	}
+	tempPath := tempFile.Name()
+	_, err = tempFile.Write(recordsBytes)
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	closeErr := tempFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tempPath, 0600)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return errors.Wrapf(err, "failed to write the temporary token store (%s)", tempPath)
+	}
+	if err := os.Rename(tempPath, store.path); err != nil {
+		os.Remove(tempPath)
+		return errors.Wrapf(err, "failed to replace the token store (%s)", store.path)
+	}
+	return nil
+}
+
+// audit appends one line to the audit log. Only a prefix of the token is recorded so the log never leaks a usable token.
+func (store *jsonTokenStore) audit(action string, record TokenRecord, actor string) error {
+	entryBytes, err := json.Marshal(tokenAuditEntry{
+		Time:        time.Now().UTC().Format(time.RFC3339),
+		Action:      action,
+		TokenPrefix: shortTokenPrefix(record.Token),
+		Name:        record.Name,
+		Actor:       actor,
+	})
+	if err != nil {
+		return errors.Wrap(err, "json marshal failed")
+	}
+
+	auditFile, err := os.OpenFile(store.auditPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open the token audit log (%s)", store.auditPath)
+	}
+	defer auditFile.Close()
+	if _, err := auditFile.Write(append(entryBytes, '\n')); err != nil {
+		return errors.Wrapf(err, "failed to write the token audit log (%s)", store.auditPath)
+	}
+	return nil
+}
+
+// importRecords adds records that aren't in the store yet, used when migrating from the tokens folder.
+func (store *jsonTokenStore) importRecords(records []TokenRecord, actor string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	imported := []TokenRecord{}
+	for _, record := range records {
+		if _, has := store.tokens[record.Token]; has {
+			continue
+		}
+		store.tokens[record.Token] = record
+		imported = append(imported, record)
+	}
+	if err := store.save(); err != nil {
+		return err
+	}
+	for _, record := range imported {
+		if err := store.audit("import", record, actor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importedTokenPrefixes lists the prefixes of the tokens imported from the tokens folder, from the import entries of the audit log.
+func (store *jsonTokenStore) importedTokenPrefixes() map[string]bool {
+	prefixes := map[string]bool{}
+	content, err := ioutil.ReadFile(store.auditPath)
+	if err != nil {
+		return prefixes
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		var entry tokenAuditEntry
+		if json.Unmarshal([]byte(line), &entry) == nil && entry.Action == "import" {
+			prefixes[entry.TokenPrefix] = true
+		}
+	}
+	return prefixes
+}
+
+func (store *jsonTokenStore) Create(record TokenRecord, actor string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.tokens[record.Token] = record
+	if err := store.save(); err != nil {
+		delete(store.tokens, record.Token)
+		return err
+	}
+	return store.audit("create", record, actor)
+}
+
+func (store *jsonTokenStore) Revoke(token, actor string) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	record, has := store.tokens[token]
+	if !has {
+		return false, nil
+	}
+	delete(store.tokens, token)
+	if err := store.save(); err != nil {
+		store.tokens[token] = record
+		return false, err
+	}
+	return true, store.audit("revoke", record, actor)
+}
+
+func (store *jsonTokenStore) Expire(token string, expiresAt time.Time, actor string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	record, has := store.tokens[token]
+	if !has {
+		return errors.Errorf("token %s is not in the token store", truncatedToken(token))
+	}
+	expiringRecord := record
+	expiringRecord.ExpiresAt = expiresAt.Unix()
+	store.tokens[token] = expiringRecord
+	if err := store.save(); err != nil {
+		store.tokens[token] = record
+		return err
+	}
+	return store.audit("expire", expiringRecord, actor)
+}
+
+func (store *jsonTokenStore) Get(token string) (TokenRecord, bool, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	record, has := store.tokens[token]
+	return record, has, nil
+}
+
+func (store *jsonTokenStore) List() ([]TokenRecord, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	records := make([]TokenRecord, 0, len(store.tokens))
+	for _, record := range store.tokens {
+		records = append(records, record)
+	}
+	sortTokenRecords(records)
+	return records, nil
+}
+
+func (store *jsonTokenStore) Exists(token string) (bool, error) {
+	store.mu.RLock()
+	record, has := store.tokens[token]
+	store.mu.RUnlock()
+	return has && record.valid(), nil
+}
+
+// sortTokenRecords orders records oldest first, so listings and the store file are stable.
+func sortTokenRecords(records []TokenRecord) {
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].CreatedAt != records[j].CreatedAt {
+			return records[i].CreatedAt < records[j].CreatedAt
+		}
+		return records[i].Token < records[j].Token
+	})
+}
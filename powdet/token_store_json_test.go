@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestJSONTokenStore(t *testing.T, directory string) *jsonTokenStore {
+	t.Helper()
+	store, err := newJSONTokenStore(filepath.Join(directory, apiTokensJSONFileName), filepath.Join(directory, apiTokensAuditLogFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func testTokenRecord(name string) TokenRecord {
+	return TokenRecord{Token: testTokenFor(name), Name: name, CreatedAt: time.Now().Unix()}
+}
+
+// testTokenFor derives a well-formed token from name, so the same name always gives the same token.
+func testTokenFor(name string) string {
+	nameHash := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(nameHash[:16])
+}
+
+// A crash between writing the temporary file and renaming it leaves the temporary file behind,
+// the store itself must still hold the previous content.
+func TestJSONTokenStoreCrashBeforeRename(t *testing.T) {
+	directory := t.TempDir()
+	store := newTestJSONTokenStore(t, directory)
+	record := testTokenRecord("a")
+	if err := store.Create(record, "test"); err != nil {
+		t.Fatal(err)
+	}
+	storeBytes, err := os.ReadFile(store.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// what the next save would have got to before the crash
+	if err := os.WriteFile(store.path+".tmp123456", storeBytes[:len(storeBytes)/2], 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newTestJSONTokenStore(t, directory)
+	if _, found, _ := restarted.Get(record.Token); !found {
+		t.Error("the token is missing after a crash before the rename")
+	}
+	if err := restarted.Create(testTokenRecord("b"), "test"); err != nil {
+		t.Errorf("creating a token next to a leftover temporary file failed: %v", err)
+	}
+}
+
+func TestJSONTokenStoreFailedRenameKeepsTheOldFile(t *testing.T) {
+	directory := t.TempDir()
+	store := newTestJSONTokenStore(t, directory)
+	record := testTokenRecord("a")
+	if err := store.Create(record, "test"); err != nil {
+		t.Fatal(err)
+	}
+	storeBytes, err := os.ReadFile(store.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// renaming a file over a non-empty directory fails
+	store.path = filepath.Join(directory, "store-directory")
+	if err := os.MkdirAll(filepath.Join(store.path, "child"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Create(testTokenRecord("b"), "test"); err == nil {
+		t.Fatal("Create succeeded although the store couldn't be replaced")
+	}
+	if records, _ := store.List(); len(records) != 1 {
+		t.Errorf("the failed Create left %d tokens in memory, want 1", len(records))
+	}
+	leftovers, _ := filepath.Glob(filepath.Join(directory, "*.tmp*"))
+	if len(leftovers) != 0 {
+		t.Errorf("the failed Create left temporary files behind: %v", leftovers)
+	}
+	if unchanged, _ := os.ReadFile(filepath.Join(directory, apiTokensJSONFileName)); string(unchanged) != string(storeBytes) {
+		t.Error("the failed Create changed the previous store file")
+	}
+}
+
+func TestJSONTokenStoreAuditLog(t *testing.T) {
+	directory := t.TempDir()
+	store := newTestJSONTokenStore(t, directory)
+	record := testTokenRecord("a")
+	if err := store.Create(record, "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Expire(record.Token, time.Now().Add(time.Minute), "192.0.2.2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Revoke(record.Token, "192.0.2.3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.importRecords([]TokenRecord{testTokenRecord("b")}, "migration"); err != nil {
+		t.Fatal(err)
+	}
+
+	auditBytes, err := os.ReadFile(store.auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(auditBytes), record.Token) {
+		t.Error("the audit log contains a full token")
+	}
+	lines := strings.Split(strings.TrimSpace(string(auditBytes)), "\n")
+	want := []tokenAuditEntry{
+		{Action: "create", TokenPrefix: record.Token[:8], Name: "a", Actor: "192.0.2.1"},
+		{Action: "expire", TokenPrefix: record.Token[:8], Name: "a", Actor: "192.0.2.2"},
+		{Action: "revoke", TokenPrefix: record.Token[:8], Name: "a", Actor: "192.0.2.3"},
+		{Action: "import", TokenPrefix: testTokenFor("b")[:8], Name: "b", Actor: "migration"},
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("the audit log has %d lines, want %d:\n%s", len(lines), len(want), auditBytes)
+	}
+	for i, line := range lines {
+		var entry tokenAuditEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("audit line %d is not json: %v", i, err)
+		}
+		if _, err := time.Parse(time.RFC3339, entry.Time); err != nil {
+			t.Errorf("audit line %d has time %q: %v", i, entry.Time, err)
+		}
+		entry.Time = ""
+		if entry != want[i] {
+			t.Errorf("audit line %d is %+v, want %+v", i, entry, want[i])
+		}
+	}
+}
+
+func TestJSONTokenStoreExpireUnknownToken(t *testing.T) {
+	store := newTestJSONTokenStore(t, t.TempDir())
+	token := testTokenFor("missing")
+	err := store.Expire(token, time.Now(), "test")
+	if err == nil || strings.Contains(err.Error(), token) || !strings.Contains(err.Error(), truncatedToken(token)) {
+		t.Errorf("Expire of an unknown token returned %v, want an error with only the truncated token", err)
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	errors "git.sequentialread.com/forest/pkg-errors"
+)
+
+const apiTokensFolderName = "PoW_Bot_Deterrent_API_Tokens"
+const apiTokensJSONFileName = "PoW_Bot_Deterrent_API_Tokens.json"
+const apiTokensAuditLogFileName = "PoW_Bot_Deterrent_API_Tokens_audit.jsonl"
+
+type TokenRecord struct {
+	Token     string `json:"token"`
+	Name      string `json:"name"`
+	CreatedAt int64  `json:"createdAt"`
+	Note      string `json:"note,omitempty"`
+	// set when the token was rotated, the token stays valid until then
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
+}
+
+func (record TokenRecord) valid() bool {
+	return record.ExpiresAt == 0 || time.Now().Unix() < record.ExpiresAt
+}
+
+// TokenStore persists the API tokens handed out to landing workers.
+// actor identifies who asked for a change (the admin's remote IP) for stores that keep an audit log.
+type TokenStore interface {
+	Create(record TokenRecord, actor string) error
+	// Revoke removes token, reporting whether it existed.
+	Revoke(token, actor string) (bool, error)
+	// Expire keeps token valid until expiresAt.
+	Expire(token string, expiresAt time.Time, actor string) error
+	Get(token string) (TokenRecord, bool, error)
+	List() ([]TokenRecord, error)
+	// Exists reports whether token is known and not expired.
+	Exists(token string) (bool, error)
+}
+
+var tokenStore TokenStore
+
+var hexTokenRegexp = regexp.MustCompile("^[0-9a-f]{32}$")
+
+// validateTokenFormat checks that token looks like an API token. The error only contains a truncated token,
+// since these messages are sent back to the client and end up in reverse proxy logs.
+func validateTokenFormat(token string) error {
+	if !hexTokenRegexp.MatchString(token) {
+		return errors.Errorf("%s must be a 32 character hex string", truncatedToken(token))
+	}
+	return nil
+}
+
+// shortTokenPrefix is how API tokens show up in logs, metrics and the audit log: the first 8 characters,
+// enough to tell tokens apart without leaking a usable one.
+func shortTokenPrefix(token string) string {
+	if len(token) > 8 {
+		return token[:8]
+	}
+	return token
+}
+
+// truncatedToken is how tokens are echoed back in error messages: the first 6 characters plus the length.
+func truncatedToken(token string) string {
+	if len(token) <= 6 {
+		return fmt.Sprintf("'%s' (%d characters)", token, len(token))
+	}
+	return fmt.Sprintf("'%s...' (%d characters)", token[:6], len(token))
+}
+
+// locateAppDirectory finds the directory holding config.json and the API tokens, either the working directory
+// or the one next to the executable. An existing tokens folder wins, so older installs keep working unchanged.
+func locateAppDirectory() string {
+	if apiTokensFolder, found := locateAPITokensFolder(); found {
+		return filepath.Dir(apiTokensFolder)
+	}
+
+	workingDirectory, err := os.Getwd()
+	if err != nil {
+		log.Fatalf("locateAppDirectory(): can't os.Getwd(): %v", err)
+	}
+	executableDirectory, err := getCurrentExecDir()
+	if err != nil {
+		log.Fatalf("locateAppDirectory(): can't getCurrentExecDir(): %v", err)
+	}
+	for _, fileName := range []string{apiTokensJSONFileName, "config.json"} {
+		if _, err := os.Stat(filepath.Join(workingDirectory, fileName)); err == nil {
+			return workingDirectory
+		}
+		if _, err := os.Stat(filepath.Join(executableDirectory, fileName)); err == nil {
+			return executableDirectory
+		}
+	}
+	return workingDirectory
+}
+
+// openTokenStore opens the store selected by token_store. The json store is the default; when it doesn't exist yet
+// but an API tokens folder does, the tokens from the folder are imported into it.
+func openTokenStore(storeType string, redisConfig RedisConfig) (TokenStore, error) {
+	switch storeType {
+	case "redis":
+		return newRedisTokenStore(redisConfig)
+	case "folder":
+		apiTokensFolder, found := locateAPITokensFolder()
+		if !found {
+			return nil, errors.Errorf("token_store is 'folder' but no %s folder was found", apiTokensFolderName)
+		}
+		return newFolderTokenStore(apiTokensFolder)
+	case "", "json":
+		jsonStorePath := filepath.Join(appDirectory, apiTokensJSONFileName)
+		_, statErr := os.Stat(jsonStorePath)
+		jsonStoreExists := statErr == nil
+
+		store, err := newJSONTokenStore(jsonStorePath, filepath.Join(appDirectory, apiTokensAuditLogFileName))
+		if err != nil {
+			return nil, err
+		}
+
+		apiTokensFolder, found := locateAPITokensFolder()
+		if found && jsonStoreExists {
+			if err := warnAboutUnimportedTokens(store, apiTokensFolder); err != nil {
+				return nil, err
+			}
+		}
+		if found && !jsonStoreExists {
+			folderStore, err := newFolderTokenStore(apiTokensFolder)
+			if err != nil {
+				return nil, err
+			}
+			records, err := folderStore.List()
+			if err != nil {
+				return nil, err
+			}
+			if err := store.importRecords(records, "migration from "+apiTokensFolder); err != nil {
+				return nil, err
+			}
+			slog.Info("imported the API tokens folder", "count", len(records), "from", apiTokensFolder, "into", jsonStorePath)
+		}
+		return store, nil
+	default:
+		return nil, errors.Errorf("unknown token_store '%s', expected 'json', 'folder' or 'redis'", storeType)
+	}
+}
+
+// requestActor is what gets recorded in the token audit log for an admin request.
+func requestActor(request *http.Request) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
+
+func tokenExists(token string) (bool, error) {
+	return tokenStore.Exists(token)
+}
+
+// createToken persists a new API token named name. The token only becomes usable once it was stored.
+func createToken(name, note, actor string) (TokenRecord, error) {
+	tokenBytes := make([]byte, 16)
+	_, err := rand.Read(tokenBytes)
+	if err != nil {
+		return TokenRecord{}, errors.Wrap(err, "read random bytes failed")
+	}
+
+	record := TokenRecord{
+		Token:     fmt.Sprintf("%x", tokenBytes),
+		Name:      name,
+		CreatedAt: time.Now().Unix(),
+		Note:      note,
+	}
+	if err := tokenStore.Create(record, actor); err != nil {
+		return TokenRecord{}, err
+	}
+	auditLog.record("token_create", map[string]interface{}{"tokenPrefix": shortTokenPrefix(record.Token), "name": name, "actor": actor})
+	return record, nil
+}
+
+// warnAboutUnimportedTokens catches tokens added to the legacy tokens folder after it was imported into the json store.
+// The folder is only read once, so those tokens would otherwise be rejected without a trace.
+func warnAboutUnimportedTokens(store *jsonTokenStore, apiTokensFolder string) error {
+	folderStore, err := newFolderTokenStore(apiTokensFolder)
+	if err != nil {
+		return err
+	}
+	records, err := folderStore.List()
+	if err != nil {
+		return err
+	}
+	// tokens revoked since the import are still in the folder, they are not new
+	importedTokenPrefixes := store.importedTokenPrefixes()
+	unimported := 0
+	for _, record := range records {
+		if _, found, _ := store.Get(record.Token); !found && !importedTokenPrefixes[shortTokenPrefix(record.Token)] {
+			unimported++
+		}
+	}
+	if unimported > 0 {
+		slog.Warn(
+			"⚠️ the API tokens folder was changed after it was imported into the JSON token store. "+
+				"The folder is only imported once and is ignored since, so its new tokens will be rejected. "+
+				"Create them with /Tokens/Create instead, or set token_store to 'folder'",
+			"unimportedTokens", unimported, "folder", apiTokensFolder, "store", store.path,
+		)
+	}
+	return nil
+}
+
+func revokeToken(token, actor string) (bool, error) {
+	removed, err := tokenStore.Revoke(token, actor)
+	if err != nil {
+		return false, err
+	}
+	if removed {
+		auditLog.record("token_revoke", map[string]interface{}{"tokenPrefix": shortTokenPrefix(token), "actor": actor})
+		if _, _, err := challengeStore.Purge(token); err != nil {
+			log.Printf("failed to purge the challenges of revoked token %s...: %v", shortTokenPrefix(token), err)
+		}
+	}
+	return removed, nil
+}
+
+// revokeTokensByName revokes every token named exactly name and returns them.
+func revokeTokensByName(name, actor string) ([]string, error) {
+	records, err := tokenStore.List()
+	if err != nil {
+		return nil, err
+	}
+	revoked := []string{}
+	for _, record := range records {
+		if record.Name != name {
+			continue
+		}
+		removed, err := revokeToken(record.Token, actor)
+		if err != nil {
+			return revoked, err
+		}
+		if removed {
+			revoked = append(revoked, record.Token)
+		}
+	}
+	return revoked, nil
+}
+
+// expireToken keeps token valid for gracePeriod and then revokes it.
+// The expiry is persisted and the token stores treat a token past it as unknown, on every replica and after a restart.
+// The revocation only cleans up the token and its challenges.
+func expireToken(token string, gracePeriod time.Duration, actor string) (time.Time, error) {
+	expiresAt := time.Now().Add(gracePeriod)
+	if err := tokenStore.Expire(token, expiresAt, actor); err != nil {
+		return time.Time{}, err
+	}
+	scheduleExpiredTokenRevocation(token, expiresAt)
+	return expiresAt, nil
+}
+
+func scheduleExpiredTokenRevocation(token string, expiresAt time.Time) {
+	time.AfterFunc(time.Until(expiresAt), func() {
+		if _, err := revokeToken(token, "expiry after rotation"); err != nil {
+			log.Printf("failed to revoke rotated token after its grace period: %v", err)
+		}
+	})
+}
+
+// revokeExpiredTokens picks up the cleanup of rotated tokens whose revocation timer was lost in a restart.
+func revokeExpiredTokens() error {
+	records, err := tokenStore.List()
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if record.ExpiresAt != 0 {
+			scheduleExpiredTokenRevocation(record.Token, time.Unix(record.ExpiresAt, 0))
+		}
+	}
+	return nil
+}
+
+// sanitizeTokenName makes a user supplied token name safe to use as part of a file name.
+func sanitizeTokenName(name string) string {
+	// we use underscore as a syntax character in the filename, so we have to remove it from the user-inputted name
+	name = strings.ReplaceAll(name, "_", "-")
+	// let's also remove any sort of funky or path-related characters
+	name = strings.ReplaceAll(name, "*", "")
+	name = strings.ReplaceAll(name, "?", "")
+	name = strings.ReplaceAll(name, "/", "-")
+	name = strings.ReplaceAll(name, "\\", "-")
+	name = strings.ReplaceAll(name, ".", "-")
+	return name
+}
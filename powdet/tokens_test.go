@@ -0,0 +1,514 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokensCreate(t *testing.T) {
+	testCases := []struct {
+		name   string
+		accept string
+	}{
+		{name: "plain text", accept: ""},
+		{name: "json", accept: "application/json"},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			setupTest(t, "")
+			request := newTestRequest("POST", "/Tokens/Create?name=landing_eu/1&note=for+the+eu+worker", testAdminToken, "")
+			request.Header.Set("Accept", testCase.accept)
+			response := serveTestRequest(request)
+			if response.Code != http.StatusOK {
+				t.Fatalf("/Tokens/Create returned %d: %s", response.Code, response.Body.String())
+			}
+
+			token := response.Body.String()
+			if testCase.accept == "application/json" {
+				output := map[string]string{}
+				if err := json.Unmarshal(response.Body.Bytes(), &output); err != nil {
+					t.Fatalf("/Tokens/Create returned invalid json: %v", err)
+				}
+				if output["name"] != "landing-eu-1" || output["createdAt"] == "" {
+					t.Errorf("/Tokens/Create returned %v", output)
+				}
+				token = output["token"]
+			}
+			if err := validateTokenFormat(token); err != nil {
+				t.Fatalf("/Tokens/Create returned an invalid token: %v", err)
+			}
+
+			record, found, err := tokenStore.Get(token)
+			if err != nil || !found {
+				t.Fatalf("the created token is not in the store: %v", err)
+			}
+			if record.Name != "landing-eu-1" || record.Note != "for the eu worker" {
+				t.Errorf("the created token was stored as %+v", record)
+			}
+		})
+	}
+}
+
+func TestTokensCreateWriteFailure(t *testing.T) {
+	testCases := []struct {
+		name  string
+		store func(unwritable string) TokenStore
+	}{
+		{name: "json", store: func(unwritable string) TokenStore {
+			store, _ := newJSONTokenStore(filepath.Join(appDirectory, apiTokensJSONFileName), filepath.Join(appDirectory, apiTokensAuditLogFileName))
+			store.path = filepath.Join(unwritable, apiTokensJSONFileName)
+			return store
+		}},
+		{name: "folder", store: func(unwritable string) TokenStore {
+			return &folderTokenStore{folder: unwritable, tokens: map[string]int64{}}
+		}},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			setupTest(t, "")
+			// a regular file where the store expects a directory can't be written to, not even by root
+			unwritable := filepath.Join(t.TempDir(), "not-a-directory")
+			if err := os.WriteFile(unwritable, []byte{}, 0600); err != nil {
+				t.Fatal(err)
+			}
+			tokenStore = testCase.store(unwritable)
+
+			response := serveTestRequest(newTestRequest("POST", "/Tokens/Create?name=a", testAdminToken, ""))
+			if response.Code != http.StatusInternalServerError {
+				t.Fatalf("/Tokens/Create returned %d, want 500: %s", response.Code, response.Body.String())
+			}
+			if strings.Contains(response.Body.String(), "not-a-directory") {
+				t.Errorf("the error response leaks the store path: %s", response.Body.String())
+			}
+			if jsonStore, isJSONStore := tokenStore.(*jsonTokenStore); isJSONStore && len(jsonStore.tokens) != 0 {
+				t.Errorf("the json store kept %d tokens in memory that were never persisted", len(jsonStore.tokens))
+			}
+			if folderStore, isFolderStore := tokenStore.(*folderTokenStore); isFolderStore && len(folderStore.tokens) != 0 {
+				t.Errorf("the folder store cached %d tokens that were never persisted", len(folderStore.tokens))
+			}
+		})
+	}
+}
+
+func TestTokensList(t *testing.T) {
+	setupTest(t, "")
+	if _, err := createToken("a", "requested by ops, for the eu worker", "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	response := serveTestRequest(newTestRequest("GET", "/Tokens", testAdminToken, ""))
+	if response.Code != http.StatusOK {
+		t.Fatalf("/Tokens returned %d", response.Code)
+	}
+	// existing consumers split every line into exactly 4 columns
+	for _, line := range strings.Split(response.Body.String(), "\n") {
+		if columns := strings.Split(line, ","); len(columns) != 4 {
+			t.Errorf("/Tokens line %q has %d columns, want 4", line, len(columns))
+		}
+	}
+
+	request := newTestRequest("GET", "/Tokens", testAdminToken, "")
+	request.Header.Set("Accept", "application/json")
+	response = serveTestRequest(request)
+	output := []map[string]string{}
+	if err := json.Unmarshal(response.Body.Bytes(), &output); err != nil {
+		t.Fatalf("/Tokens returned invalid json: %v", err)
+	}
+	if len(output) != 1 || output[0]["note"] != "requested by ops, for the eu worker" || output[0]["name"] != "a" {
+		t.Errorf("/Tokens returned %v", output)
+	}
+}
+
+func TestTokensRotate(t *testing.T) {
+	setupTest(t, "")
+	oldToken := createTestToken(t, "a")
+	challenges := getTestChallenges(t, oldToken, "difficultyLevel=1")
+
+	response := serveTestRequest(newTestRequest("POST", "/Tokens/Rotate?token="+oldToken+"&graceSeconds=1", testAdminToken, ""))
+	if response.Code != http.StatusOK {
+		t.Fatalf("/Tokens/Rotate returned %d: %s", response.Code, response.Body.String())
+	}
+	output := map[string]string{}
+	if err := json.Unmarshal(response.Body.Bytes(), &output); err != nil {
+		t.Fatalf("/Tokens/Rotate returned invalid json: %v", err)
+	}
+	newToken := output["token"]
+	if output["name"] != "a" || output["oldToken"] != oldToken || newToken == oldToken || validateTokenFormat(newToken) != nil {
+		t.Fatalf("/Tokens/Rotate returned %v", output)
+	}
+
+	// during the grace window both tokens work, and the challenges of the old token still verify
+	getTestChallenges(t, newToken, "difficultyLevel=1")
+	getTestChallenges(t, oldToken, "difficultyLevel=1")
+	nonce := solveTestChallenge(t, challenges[0])
+	response = serveTestRequest(newTestRequest("POST", "/Verify?challenge="+challenges[0]+"&nonce="+nonce, oldToken, ""))
+	if response.Code != http.StatusOK {
+		t.Errorf("/Verify of an old token challenge during the grace window returned %d: %s", response.Code, response.Body.String())
+	}
+
+	// rotating again would leave a second replacement behind
+	response = serveTestRequest(newTestRequest("POST", "/Tokens/Rotate?token="+oldToken, testAdminToken, ""))
+	if response.Code != http.StatusConflict {
+		t.Errorf("rotating a token in its grace window returned %d, want 409", response.Code)
+	}
+	records, err := tokenStore.List()
+	if err != nil || len(records) != 2 {
+		t.Errorf("the store holds %d tokens (%v), want the old and the new one", len(records), err)
+	}
+
+	// wait for the revocation to finish purging the challenges too, so it doesn't run into the next test
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, found, _ := tokenStore.Get(oldToken)
+		countByToken, _ := challengeStore.CountByToken()
+		if _, hasChallenges := countByToken[oldToken]; !found && !hasChallenges {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the old token was not revoked after its grace period")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	nonce = solveTestChallenge(t, challenges[1])
+	response = serveTestRequest(newTestRequest("POST", "/Verify?challenge="+challenges[1]+"&nonce="+nonce, oldToken, ""))
+	if response.Code == http.StatusOK {
+		t.Error("an old token challenge still verified after the grace period")
+	}
+	if _, found, _ := tokenStore.Get(newToken); !found {
+		t.Error("the new token was revoked along with the old one")
+	}
+}
+
+// A rotated token whose revocation timer was lost, to a restart or because another replica rotated it,
+// is rejected once its grace period is over, and revokeExpiredTokens cleans it up on the next start.
+func TestExpiredTokenWithoutTimer(t *testing.T) {
+	setupTest(t, "")
+	expiredToken := createTestToken(t, "expired")
+	rotatingToken := createTestToken(t, "rotating")
+	challenges := getTestChallenges(t, expiredToken, "difficultyLevel=1")
+	if err := tokenStore.Expire(expiredToken, time.Now().Add(-time.Second), "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tokenStore.Expire(rotatingToken, time.Now().Add(time.Hour), "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	nonce := solveTestChallenge(t, challenges[0])
+	testCases := []struct {
+		name       string
+		request    *http.Request
+		wantStatus int
+	}{
+		{name: "GetChallenges with the expired token", request: newTestRequest("POST", "/GetChallenges?difficultyLevel=1", expiredToken, ""), wantStatus: http.StatusUnauthorized},
+		{name: "Verify with the expired token", request: newTestRequest("POST", "/Verify?challenge="+challenges[0]+"&nonce="+nonce, expiredToken, ""), wantStatus: http.StatusUnauthorized},
+		{name: "GetChallenges in the grace period", request: newTestRequest("POST", "/GetChallenges?difficultyLevel=1", rotatingToken, ""), wantStatus: http.StatusOK},
+	}
+	for _, testCase := range testCases {
+		if response := serveTestRequest(testCase.request); response.Code != testCase.wantStatus {
+			t.Errorf("%s returned %d, want %d: %s", testCase.name, response.Code, testCase.wantStatus, response.Body.String())
+		}
+	}
+
+	folderStore, err := newFolderTokenStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := testTokenRecord("folder")
+	if err := folderStore.Create(record, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := folderStore.Expire(record.Token, time.Now().Add(-time.Second), "test"); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := folderStore.Exists(record.Token); err != nil || exists {
+		t.Errorf("the folder store Exists(expired token) = %t, %v, want false", exists, err)
+	}
+
+	if err := revokeExpiredTokens(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, found, _ := tokenStore.Get(expiredToken)
+		countByToken, _ := challengeStore.CountByToken()
+		if _, hasChallenges := countByToken[expiredToken]; !found && !hasChallenges {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("revokeExpiredTokens did not revoke the expired token and purge its challenges")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if _, found, _ := tokenStore.Get(rotatingToken); !found {
+		t.Error("revokeExpiredTokens revoked a token still in its grace period")
+	}
+}
+
+func TestTokensRotateRejects(t *testing.T) {
+	setupTest(t, "")
+	token := createTestToken(t, "a")
+	testCases := []struct {
+		name       string
+		query      string
+		wantStatus int
+	}{
+		{name: "unknown token", query: "token=" + strings.Repeat("ab", 16), wantStatus: http.StatusNotFound},
+		{name: "missing token", query: "", wantStatus: http.StatusBadRequest},
+		{name: "malformed token", query: "token=not-a-token", wantStatus: http.StatusBadRequest},
+		{name: "negative graceSeconds", query: "token=" + token + "&graceSeconds=-1", wantStatus: http.StatusBadRequest},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			response := serveTestRequest(newTestRequest("POST", "/Tokens/Rotate?"+testCase.query, testAdminToken, ""))
+			if response.Code != testCase.wantStatus {
+				t.Errorf("/Tokens/Rotate?%s returned %d, want %d: %s", testCase.query, response.Code, testCase.wantStatus, response.Body.String())
+			}
+		})
+	}
+	if records, _ := tokenStore.List(); len(records) != 1 {
+		t.Errorf("rejected rotations left %d tokens in the store, want 1", len(records))
+	}
+}
+
+func TestTokensRevokeByName(t *testing.T) {
+	setupTest(t, "")
+	sameName := []string{createTestToken(t, "landing-eu-1"), createTestToken(t, "landing-eu-1")}
+	similarName := createTestToken(t, "landing-eu-10")
+	for _, token := range append(sameName, similarName) {
+		getTestChallenges(t, token, "difficultyLevel=1")
+	}
+
+	// the name is sanitized like on /Tokens/Create
+	response := serveTestRequest(newTestRequest("POST", "/Tokens/Revoke?name=landing_eu/1", testAdminToken, ""))
+	if response.Code != http.StatusOK {
+		t.Fatalf("/Tokens/Revoke?name= returned %d: %s", response.Code, response.Body.String())
+	}
+	output := map[string][]string{}
+	if err := json.Unmarshal(response.Body.Bytes(), &output); err != nil {
+		t.Fatalf("/Tokens/Revoke?name= returned invalid json: %v", err)
+	}
+	sort.Strings(output["revoked"])
+	sort.Strings(sameName)
+	if strings.Join(output["revoked"], ",") != strings.Join(sameName, ",") {
+		t.Errorf("/Tokens/Revoke?name= revoked %v, want %v", output["revoked"], sameName)
+	}
+
+	counts, err := challengeStore.CountByToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range sameName {
+		if _, found, _ := tokenStore.Get(token); found {
+			t.Errorf("token %s is still in the store", token)
+		}
+		if _, has := counts[token]; has {
+			t.Errorf("the challenges of revoked token %s were not purged", token)
+		}
+	}
+	if _, found, _ := tokenStore.Get(similarName); !found || counts[similarName].Count == 0 {
+		t.Error("revoking by name also removed a token whose name only starts the same way")
+	}
+
+	testCases := []struct {
+		name       string
+		query      string
+		wantStatus int
+	}{
+		{name: "already revoked name", query: "name=landing-eu-1", wantStatus: http.StatusNotFound},
+		{name: "prefix of a name", query: "name=landing-eu", wantStatus: http.StatusNotFound},
+		{name: "glob", query: "name=landing-eu-*", wantStatus: http.StatusNotFound},
+		{name: "token and name", query: "name=landing-eu-10&token=" + similarName, wantStatus: http.StatusBadRequest},
+		{name: "neither token nor name", query: "", wantStatus: http.StatusBadRequest},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			response := serveTestRequest(newTestRequest("POST", "/Tokens/Revoke?"+testCase.query, testAdminToken, ""))
+			if response.Code != testCase.wantStatus {
+				t.Errorf("/Tokens/Revoke?%s returned %d, want %d", testCase.query, response.Code, testCase.wantStatus)
+			}
+		})
+	}
+	if _, found, _ := tokenStore.Get(similarName); !found {
+		t.Error("a rejected revoke removed a token")
+	}
+}
+
+// chdirTest runs the rest of the test in directory, where locateAPITokensFolder looks for the tokens folder.
+func chdirTest(t *testing.T, directory string) {
+	t.Helper()
+	oldDirectory, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(directory); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(oldDirectory) })
+}
+
+func TestTokenFolderMigration(t *testing.T) {
+	setupTest(t, "")
+	chdirTest(t, t.TempDir())
+	folder := apiTokensFolderName
+	if err := os.Mkdir(folder, 0700); err != nil {
+		t.Fatal(err)
+	}
+	folderStore, err := newFolderTokenStore(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported := testTokenRecord("imported")
+	if err := folderStore.Create(imported, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	logs := captureLogs(t, "info", "")
+	store, err := openTokenStore("json", RedisConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := store.Get(imported.Token); !found {
+		t.Fatal("the token from the folder was not imported")
+	}
+	if !strings.Contains(logs.String(), "imported the API tokens folder") {
+		t.Errorf("the import was not logged: %q", logs.String())
+	}
+
+	// a token revoked after the import is still in the folder, that alone is no reason to warn
+	if _, err := store.Revoke(imported.Token, "test"); err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name        string
+		change      func()
+		wantWarning bool
+	}{
+		{name: "unchanged folder", change: func() {}, wantWarning: false},
+		{
+			name: "token added to the folder after the import",
+			change: func() {
+				if err := folderStore.Create(testTokenRecord("added-later"), "test"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantWarning: true,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.change()
+			logs.Reset()
+			store, err := openTokenStore("json", RedisConfig{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			warned := strings.Contains(logs.String(), "the API tokens folder was changed after it was imported")
+			if warned != testCase.wantWarning {
+				t.Errorf("warning logged: %t, want %t: %q", warned, testCase.wantWarning, logs.String())
+			}
+			if testCase.wantWarning && !strings.Contains(logs.String(), "unimportedTokens=1") {
+				t.Errorf("the warning doesn't count the new token: %q", logs.String())
+			}
+			// the folder is never imported a second time
+			if records, _ := store.List(); len(records) != 0 {
+				t.Errorf("the json store holds %d tokens, want none", len(records))
+			}
+		})
+	}
+}
+
+func TestValidateTokenFormat(t *testing.T) {
+	testCases := []struct {
+		name      string
+		token     string
+		wantError string
+	}{
+		{name: "valid", token: strings.Repeat("0a", 16)},
+		{name: "uppercase", token: strings.Repeat("0A", 16), wantError: "'0A0A0A...' (32 characters) must be a 32 character hex string"},
+		{name: "too short", token: strings.Repeat("a", 31), wantError: "'aaaaaa...' (31 characters)"},
+		{name: "too long", token: strings.Repeat("a", 33), wantError: "'aaaaaa...' (33 characters)"},
+		{name: "not hex", token: strings.Repeat("g", 32), wantError: "'gggggg...' (32 characters)"},
+		{name: "short enough to echo whole", token: "abc", wantError: "'abc' (3 characters)"},
+		{name: "empty", token: "", wantError: "'' (0 characters)"},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			err := validateTokenFormat(testCase.token)
+			if testCase.wantError == "" {
+				if err != nil {
+					t.Errorf("validateTokenFormat(%q) failed: %v", testCase.token, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), testCase.wantError) {
+				t.Errorf("validateTokenFormat(%q) returned %v, want an error containing %q", testCase.token, err, testCase.wantError)
+			}
+		})
+	}
+}
+
+// rejected tokens are echoed back truncated, responses end up in reverse proxy logs
+func TestRejectedTokensAreTruncated(t *testing.T) {
+	setupTest(t, "")
+	malformed := strings.Repeat("0123456789", 4) + "xyz"
+	unknown := strings.Repeat("ab", 16)
+	testCases := []struct {
+		name          string
+		method        string
+		target        string
+		bearer        string
+		token         string
+		wantStatus    int
+		wantTruncated string
+	}{
+		{name: "malformed API token", method: "POST", target: "/GetChallenges?difficultyLevel=1", bearer: malformed, token: malformed, wantStatus: http.StatusUnauthorized, wantTruncated: "'012345...' (43 characters)"},
+		{name: "unknown API token", method: "POST", target: "/GetChallenges?difficultyLevel=1", bearer: unknown, token: unknown, wantStatus: http.StatusUnauthorized, wantTruncated: "'ababab...' (32 characters)"},
+		{name: "malformed token to revoke", method: "POST", target: "/Tokens/Revoke?token=" + malformed, bearer: testAdminToken, token: malformed, wantStatus: http.StatusBadRequest, wantTruncated: "'012345...' (43 characters)"},
+		{name: "unknown token to rotate", method: "POST", target: "/Tokens/Rotate?token=" + unknown, bearer: testAdminToken, token: unknown, wantStatus: http.StatusNotFound, wantTruncated: "'ababab...' (32 characters)"},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			response := serveTestRequest(newTestRequest(testCase.method, testCase.target, testCase.bearer, ""))
+			body := response.Body.String()
+			if response.Code != testCase.wantStatus {
+				t.Fatalf("%s returned %d, want %d: %s", testCase.target, response.Code, testCase.wantStatus, body)
+			}
+			if strings.Contains(body, testCase.token) || !strings.Contains(body, testCase.wantTruncated) {
+				t.Errorf("the response %q should only contain the truncated token %s", body, testCase.wantTruncated)
+			}
+		})
+	}
+}
+
+// purgeFailingChallengeStore fails every Purge, like a store that became unreachable.
+type purgeFailingChallengeStore struct {
+	ChallengeStore
+}
+
+func (store purgeFailingChallengeStore) Purge(token string) (int, bool, error) {
+	return 0, false, errors.New("store unreachable")
+}
+
+func TestRevokeLogsOnlyATokenPrefix(t *testing.T) {
+	setupTest(t, "")
+	token := createTestToken(t, "a")
+	challengeStore = purgeFailingChallengeStore{ChallengeStore: challengeStore}
+
+	logs := captureLogs(t, "info", "")
+	if removed, err := revokeToken(token, "test"); err != nil || !removed {
+		t.Fatalf("revokeToken returned %t, %v", removed, err)
+	}
+	if !strings.Contains(logs.String(), "failed to purge the challenges of revoked token "+token[:8]+"...") {
+		t.Errorf("the purge failure was not logged with the token prefix: %q", logs.String())
+	}
+	if strings.Contains(logs.String(), token) {
+		t.Errorf("the log contains the full token: %q", logs.String())
+	}
+}
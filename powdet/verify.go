@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"sync"
+	"time"
+
+	errors "git.sequentialread.com/forest/pkg-errors"
+	"golang.org/x/crypto/argon2"
+)
+
+type verifyOutcome int
+
+const (
+	verifyOK verifyOutcome = iota
+	verifyNotFound
+	verifyBadNonce
+	verifyInsufficientDifficulty
+	verifyInternalError
+	verifyBindMismatch
+	verifyBadNonceLength
+	verifyWrongToken
+	verifyStoreUnavailable
+)
+
+const legacyMaxNonceLength = 8
+
+// challenges issued before plen existed always have an 8 byte preimage
+const legacyPreimageLength = 8
+
+var verifyOutcomeNames = map[verifyOutcome]string{
+	verifyOK:                     "ok",
+	verifyNotFound:               "not_found",
+	verifyBadNonce:               "bad_nonce",
+	verifyInsufficientDifficulty: "insufficient_difficulty",
+	verifyInternalError:          "internal_error",
+	verifyBindMismatch:           "bind_mismatch",
+	verifyBadNonceLength:         "bad_nonce_length",
+	verifyWrongToken:             "wrong_token",
+	verifyStoreUnavailable:       "store_unavailable",
+}
+
+func (outcome verifyOutcome) String() string {
+	return verifyOutcomeNames[outcome]
+}
+
+// concurrencyLimiter bounds how many argon2 hashes run at once, since each one allocates argon2_memory_kib.
+// The limit is passed on every acquire so that a config reload takes effect immediately.
+type concurrencyLimiter struct {
+	active int
+	mu     sync.Mutex
+	cond   *sync.Cond
+}
+
+func newConcurrencyLimiter() *concurrencyLimiter {
+	limiter := &concurrencyLimiter{}
+	limiter.cond = sync.NewCond(&limiter.mu)
+	return limiter
+}
+
+func (limiter *concurrencyLimiter) acquire(limit int) {
+	limiter.mu.Lock()
+	for limiter.active >= limit {
+		limiter.cond.Wait()
+	}
+	limiter.active++
+	limiter.mu.Unlock()
+}
+
+func (limiter *concurrencyLimiter) release() {
+	limiter.mu.Lock()
+	limiter.active--
+	limiter.cond.Broadcast()
+	limiter.mu.Unlock()
+}
+
+var argon2Limiter = newConcurrencyLimiter()
+
+// verifyChallenge consumes the challenge issued to token and checks the nonce against it.
+// The challenge is removed even when the nonce turns out to be invalid, so every challenge can only be tried once.
+func verifyChallenge(token, challengeBase64, nonceHex, bind string) verifyOutcome {
+	startedAt := time.Now()
+	outcome := verifyChallengeUncounted(token, challengeBase64, nonceHex, bind)
+	metrics.addForToken("verify_"+outcome.String(), token, 1)
+	auditLog.record("verify", map[string]interface{}{
+		"tokenPrefix": shortTokenPrefix(token),
+		"result":      outcome.String(),
+		"latencyMs":   time.Since(startedAt).Milliseconds(),
+	})
+	return outcome
+}
+
+func verifyChallengeUncounted(token, challengeBase64, nonceHex, bind string) verifyOutcome {
+	consumed, err := challengeStore.Consume(token, challengeBase64)
+	if err != nil {
+		log.Printf("failed to consume challenge %s: %v\n", challengeBase64, err)
+		if isStoreUnavailable(err) {
+			return verifyStoreUnavailable
+		}
+		return verifyInternalError
+	}
+	if !consumed {
+		// challenges are shared between landing workers if one turns up under another token
+		owner, found, err := challengeStore.Owner(challengeBase64)
+		if err != nil {
+			log.Printf("failed to look up the owner of challenge %s: %v\n", challengeBase64, err)
+		}
+		if found && owner != token {
+			slog.Warn("challenge was submitted with another token", "issuedTo", shortTokenPrefix(owner)+"...", "submittedWith", shortTokenPrefix(token)+"...")
+			return verifyWrongToken
+		}
+		return verifyNotFound
+	}
+
+	challenge, err := decodeChallenge(challengeBase64)
+	if err != nil {
+		log.Printf("%v\n", err)
+		return verifyInternalError
+	}
+	outcome := checkChallengeSolution(challenge, challengeBase64, nonceHex, bind)
+	difficultyStats.recordVerified(challenge.DifficultyLevel, outcome == verifyOK, challenge.IssuedAt)
+	return outcome
+}
+
+// decodeChallenge parses a challenge the way /GetChallenges encodes it.
+func decodeChallenge(challengeBase64 string) (Challenge, error) {
+	challengeJSON, err := base64.StdEncoding.DecodeString(challengeBase64)
+	if err != nil {
+		return Challenge{}, errors.Wrapf(err, "challenge %s couldn't be parsed", challengeBase64)
+	}
+	var challenge Challenge
+	err = json.Unmarshal([]byte(challengeJSON), &challenge)
+	if err != nil {
+		return Challenge{}, errors.Wrapf(err, "challenge %s (%s) couldn't be parsed", string(challengeJSON), challengeBase64)
+	}
+	return challenge, nil
+}
+
+// checkChallengeSolution checks the nonce against an already consumed challenge.
+// It touches neither the challenge store nor any stats, so the self test can use it too.
+func checkChallengeSolution(challenge Challenge, challengeBase64, nonceHex, bind string) verifyOutcome {
+	nonceBytes, err := hex.DecodeString(nonceHex)
+	if nonceHex == "" || err != nil {
+		return verifyBadNonce
+	}
+	// challenges issued before nlen existed accept any nonce of up to 8 bytes
+	if challenge.NonceLength == 0 && len(nonceBytes) > legacyMaxNonceLength {
+		return verifyBadNonce
+	}
+	if challenge.NonceLength != 0 && len(nonceBytes) != challenge.NonceLength {
+		return verifyBadNonceLength
+	}
+
+	// challenges issued without ?bind= (e.g. before require_binding was turned on) are not bound to anything
+	if challenge.Binding != "" && subtle.ConstantTimeCompare([]byte(challenge.Binding), []byte(hashBinding(bind))) != 1 {
+		return verifyBindMismatch
+	}
+
+	preimageLength := challenge.PreimageLength
+	if preimageLength == 0 {
+		preimageLength = legacyPreimageLength
+	}
+	preimageBytes, err := base64.StdEncoding.DecodeString(challenge.Preimage)
+	if len(preimageBytes) != preimageLength || err != nil {
+		log.Printf("invalid preimage %s: %v\n", challenge.Preimage, err)
+		return verifyInternalError
+	}
+
+	hash, err := hashChallenge(challenge, nonceBytes, preimageBytes)
+	if err != nil {
+		log.Printf("challenge %s couldn't be hashed: %v\n", challengeBase64, err)
+		return verifyInternalError
+	}
+	meetsDifficulty, err := hashMeetsDifficulty(challenge, hash)
+	if err != nil {
+		log.Printf("challenge %s couldn't be checked: %v\n", challengeBase64, err)
+		return verifyInternalError
+	}
+	if !meetsDifficulty {
+		return verifyInsufficientDifficulty
+	}
+
+	return verifyOK
+}
+
+// hashChallenge hashes nonce and preimage with the algorithm and parameters the challenge embeds.
+func hashChallenge(challenge Challenge, nonceBytes, preimageBytes []byte) ([]byte, error) {
+	switch challenge.Algorithm {
+	case algorithmSHA256:
+		hashArray := sha256.Sum256(append(nonceBytes, preimageBytes...))
+		return hashArray[:], nil
+	case "", algorithmArgon2id:
+		currentConfig, _ := currentConfiguration()
+		argon2Limiter.acquire(currentConfig.Argon2MaxConcurrency)
+		defer argon2Limiter.release()
+		return argon2.IDKey(
+			nonceBytes,
+			preimageBytes,
+			uint32(challenge.Iterations),
+			uint32(challenge.MemoryKiB),
+			uint8(challenge.Parallelism),
+			uint32(challenge.KeyLength),
+		), nil
+	default:
+		return nil, errors.Errorf("unknown algorithm %s", challenge.Algorithm)
+	}
+}
+
+// hashMeetsDifficulty compares the end of the hash the challenge names against its difficulty.
+func hashMeetsDifficulty(challenge Challenge, hash []byte) (bool, error) {
+	hashHex := hex.EncodeToString(hash)
+	if len(challenge.Difficulty) > len(hashHex) {
+		return false, errors.New("the difficulty is longer than the hash")
+	}
+	// the part of the hash that is compared, the trailing hex unless the challenge says otherwise
+	endOfHash := hashHex[len(hashHex)-len(challenge.Difficulty):]
+	if challenge.DifficultyPosition == difficultyPositionHead {
+		endOfHash = hashHex[:len(challenge.Difficulty)]
+	}
+
+	slog.Debug("verify hash comparison", "endOfHash", endOfHash, "difficulty", challenge.Difficulty)
+	return endOfHash <= challenge.Difficulty, nil
+}
+
+// hashBinding turns the caller supplied ?bind= value into what gets embedded in the challenge,
+// so the challenge handed to the browser doesn't carry the raw fingerprint.
+func hashBinding(bind string) string {
+	bindHash := sha256.Sum256([]byte(bind))
+	return hex.EncodeToString(bindHash[:16])
+}
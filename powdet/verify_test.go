@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type testVerifyBatchResult struct {
+	OK     bool   `json:"ok"`
+	Reason string `json:"reason"`
+}
+
+func verifyTestBatch(t *testing.T, token string, entries []map[string]string) (int, []testVerifyBatchResult) {
+	t.Helper()
+	bodyBytes, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := serveTestRequest(newTestRequest("POST", "/VerifyBatch", token, string(bodyBytes)))
+	if response.Code != http.StatusOK {
+		return response.Code, nil
+	}
+	results := []testVerifyBatchResult{}
+	if err := json.Unmarshal(response.Body.Bytes(), &results); err != nil {
+		t.Fatalf("/VerifyBatch returned invalid json: %v", err)
+	}
+	return response.Code, results
+}
+
+func TestVerifyBatchMixedResults(t *testing.T) {
+	setupTest(t, "")
+	token := createTestToken(t, "a")
+	challenges := getTestChallenges(t, token, "difficultyLevel=2")
+	solved := solveTestChallenge(t, challenges[0])
+	reused := solveTestChallenge(t, challenges[1])
+	if code, _ := verifyTestBatch(t, token, []map[string]string{{"challenge": challenges[1], "nonce": reused}}); code != http.StatusOK {
+		t.Fatalf("/VerifyBatch returned %d", code)
+	}
+
+	code, results := verifyTestBatch(t, token, []map[string]string{
+		{"challenge": challenges[0], "nonce": solved},
+		{"challenge": challenges[1], "nonce": reused},
+		{"challenge": challenges[2], "nonce": "zz"},
+		{"challenge": "bm90IGEgY2hhbGxlbmdl", "nonce": solved},
+	})
+	if code != http.StatusOK {
+		t.Fatalf("/VerifyBatch returned %d", code)
+	}
+	want := []testVerifyBatchResult{
+		{OK: true},
+		{OK: false, Reason: "not_found"},
+		{OK: false, Reason: "bad_nonce"},
+		{OK: false, Reason: "not_found"},
+	}
+	if len(results) != len(want) {
+		t.Fatalf("/VerifyBatch returned %d results, want %d", len(results), len(want))
+	}
+	for i := range want {
+		if results[i] != want[i] {
+			t.Errorf("result %d is %+v, want %+v", i, results[i], want[i])
+		}
+	}
+	// the batch counts exactly like the same calls to /Verify would
+	if ok := metricValue("verify_ok"); ok != 2 {
+		t.Errorf("verify_ok is %d, want 2", ok)
+	}
+	if notFound := metricValue("verify_not_found"); notFound != 2 {
+		t.Errorf("verify_not_found is %d, want 2", notFound)
+	}
+}
+
+func TestVerifyBatchMaxSize(t *testing.T) {
+	setupTest(t, `{"verify_batch_max_size": 2}`)
+	token := createTestToken(t, "a")
+	challenges := getTestChallenges(t, token, "difficultyLevel=1")
+
+	testCases := []struct {
+		name       string
+		size       int
+		wantStatus int
+	}{
+		{name: "at the maximum", size: 2, wantStatus: http.StatusOK},
+		{name: "above the maximum", size: 3, wantStatus: http.StatusBadRequest},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			entries := []map[string]string{}
+			for i := 0; i < testCase.size; i++ {
+				entries = append(entries, map[string]string{"challenge": challenges[i], "nonce": "00"})
+			}
+			if code, _ := verifyTestBatch(t, token, entries); code != testCase.wantStatus {
+				t.Errorf("/VerifyBatch with %d entries returned %d, want %d", testCase.size, code, testCase.wantStatus)
+			}
+		})
+	}
+}
+
+func TestVerifyBatchRejectsInvalidBody(t *testing.T) {
+	setupTest(t, "")
+	token := createTestToken(t, "a")
+	response := serveTestRequest(newTestRequest("POST", "/VerifyBatch", token, `{"challenge":"x"}`))
+	if response.Code != http.StatusBadRequest || !strings.Contains(response.Body.String(), "JSON array") {
+		t.Errorf("/VerifyBatch with an object body returned %d %q, want 400", response.Code, response.Body.String())
+	}
+}
+
+func TestAlgorithmsEndToEnd(t *testing.T) {
+	testCases := []struct {
+		query         string
+		wantAlgorithm string
+	}{
+		{query: "", wantAlgorithm: algorithmArgon2id},
+		{query: "&algorithm=argon2id", wantAlgorithm: algorithmArgon2id},
+		{query: "&algorithm=sha256", wantAlgorithm: algorithmSHA256},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.wantAlgorithm+testCase.query, func(t *testing.T) {
+			setupTest(t, `{"allowed_algorithms": ["argon2id", "sha256"]}`)
+			token := createTestToken(t, "a")
+			challenges := getTestChallenges(t, token, "difficultyLevel=4"+testCase.query)
+			challenge := decodeTestChallenge(t, challenges[0])
+			if challenge.Algorithm != testCase.wantAlgorithm {
+				t.Fatalf("the challenge embeds algorithm %q, want %q", challenge.Algorithm, testCase.wantAlgorithm)
+			}
+			nonce := solveTestChallenge(t, challenges[0])
+
+			if testCase.wantAlgorithm == algorithmSHA256 {
+				// check the solved nonce by hand, a browser solver computes exactly this
+				nonceBytes, _ := hex.DecodeString(nonce)
+				preimageBytes, _ := base64.StdEncoding.DecodeString(challenge.Preimage)
+				hash := sha256.Sum256(append(nonceBytes, preimageBytes...))
+				hashHex := hex.EncodeToString(hash[:])
+				if tail := hashHex[len(hashHex)-len(challenge.Difficulty):]; tail > challenge.Difficulty {
+					t.Fatalf("sha256 of the solved nonce ends in %s, which doesn't meet %s", tail, challenge.Difficulty)
+				}
+			}
+
+			testVerifies := []struct {
+				nonce      string
+				wantStatus int
+			}{
+				{nonce: nonce, wantStatus: http.StatusOK},
+				{nonce: nonce, wantStatus: http.StatusNotFound},
+			}
+			for _, testVerify := range testVerifies {
+				response := serveTestRequest(newTestRequest("POST", "/Verify?challenge="+challenges[0]+"&nonce="+testVerify.nonce, token, ""))
+				if response.Code != testVerify.wantStatus {
+					t.Errorf("/Verify returned %d, want %d: %s", response.Code, testVerify.wantStatus, response.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestAlgorithmNotAllowed(t *testing.T) {
+	setupTest(t, "")
+	token := createTestToken(t, "a")
+	for _, algorithm := range []string{"sha256", "md5"} {
+		response := serveTestRequest(newTestRequest("POST", "/GetChallenges?difficultyLevel=1&algorithm="+algorithm, token, ""))
+		if response.Code != http.StatusBadRequest || !strings.Contains(response.Body.String(), "allowed algorithms are: argon2id") {
+			t.Errorf("?algorithm=%s returned %d: %s", algorithm, response.Code, response.Body.String())
+		}
+	}
+}
+
+// challenges issued before the algorithm field existed don't have "a" and must keep verifying as argon2id
+func TestLegacyChallengeWithoutAlgorithm(t *testing.T) {
+	setupTest(t, "")
+	token := createTestToken(t, "a")
+	challenges := getTestChallenges(t, token, "difficultyLevel=1")
+	legacyChallenge := reencodeTestChallenge(t, challenges[0], func(fields map[string]interface{}) { delete(fields, "a") })
+	if _, err := challengeStore.Put(token, []string{legacyChallenge}, testKeepAllBatches); err != nil {
+		t.Fatal(err)
+	}
+
+	nonce := solveTestChallenge(t, legacyChallenge)
+	response := serveTestRequest(newTestRequest("POST", "/Verify?challenge="+legacyChallenge+"&nonce="+nonce, token, ""))
+	if response.Code != http.StatusOK {
+		t.Errorf("/Verify of a challenge without an algorithm returned %d: %s", response.Code, response.Body.String())
+	}
+}
+
+func TestChallengeBinding(t *testing.T) {
+	setupTest(t, "")
+	token := createTestToken(t, "a")
+	bound := getTestChallenges(t, token, "difficultyLevel=1&bind=client-fingerprint")
+	unbound := getTestChallenges(t, token, "difficultyLevel=1")
+
+	challenge := decodeTestChallenge(t, bound[0])
+	if challenge.Binding != hashBinding("client-fingerprint") {
+		t.Fatalf("the challenge embeds binding %q, want the hash of the ?bind= value", challenge.Binding)
+	}
+
+	testCases := []struct {
+		name       string
+		challenge  string
+		bindQuery  string
+		wantStatus int
+	}{
+		{name: "matching binding", challenge: bound[0], bindQuery: "&bind=client-fingerprint", wantStatus: http.StatusOK},
+		{name: "mismatching binding", challenge: bound[1], bindQuery: "&bind=other-fingerprint", wantStatus: http.StatusForbidden},
+		{name: "binding left out", challenge: bound[2], bindQuery: "", wantStatus: http.StatusForbidden},
+		{name: "unbound challenge without binding", challenge: unbound[0], bindQuery: "", wantStatus: http.StatusOK},
+		{name: "unbound challenge with a binding", challenge: unbound[1], bindQuery: "&bind=client-fingerprint", wantStatus: http.StatusOK},
+	}
+	wantMismatches := int64(0)
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			nonce := solveTestChallenge(t, testCase.challenge)
+			response := serveTestRequest(newTestRequest("POST", "/Verify?challenge="+testCase.challenge+"&nonce="+nonce+testCase.bindQuery, token, ""))
+			if response.Code != testCase.wantStatus {
+				t.Errorf("/Verify returned %d, want %d: %s", response.Code, testCase.wantStatus, response.Body.String())
+			}
+		})
+		if testCase.wantStatus == http.StatusForbidden {
+			wantMismatches++
+		}
+	}
+	if mismatches := metricValue("verify_bind_mismatch"); mismatches != wantMismatches {
+		t.Errorf("verify_bind_mismatch is %d, want %d", mismatches, wantMismatches)
+	}
+
+	// the batch endpoint takes the binding per entry
+	nonce := solveTestChallenge(t, bound[3])
+	_, results := verifyTestBatch(t, token, []map[string]string{{"challenge": bound[3], "nonce": nonce, "bind": "client-fingerprint"}})
+	if len(results) != 1 || !results[0].OK {
+		t.Errorf("/VerifyBatch with a matching binding returned %+v", results)
+	}
+}
+
+// challenges issued before require_binding was turned on keep verifying without a binding
+func TestRequireBindingWithLegacyChallenges(t *testing.T) {
+	setupTest(t, "")
+	token := createTestToken(t, "a")
+	legacy := getTestChallenges(t, token, "difficultyLevel=1")
+
+	writeTestConfig(t, `{"require_binding": true}`)
+	reloadConfiguration()
+
+	response := serveTestRequest(newTestRequest("POST", "/GetChallenges?difficultyLevel=1", token, ""))
+	if response.Code != http.StatusBadRequest {
+		t.Errorf("/GetChallenges without ?bind= returned %d with require_binding, want 400", response.Code)
+	}
+	getTestChallenges(t, token, "difficultyLevel=1&bind=client-fingerprint")
+
+	nonce := solveTestChallenge(t, legacy[0])
+	response = serveTestRequest(newTestRequest("POST", "/Verify?challenge="+legacy[0]+"&nonce="+nonce, token, ""))
+	if response.Code != http.StatusOK {
+		t.Errorf("/Verify of a challenge issued before require_binding returned %d: %s", response.Code, response.Body.String())
+	}
+}
+
+// reencodeTestChallenge changes the json fields of a challenge, e.g. to make it look like one issued by an older version.
+func reencodeTestChallenge(t *testing.T, challengeBase64 string, change func(fields map[string]interface{})) string {
+	t.Helper()
+	challengeJSON, err := base64.StdEncoding.DecodeString(challengeBase64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(challengeJSON, &fields); err != nil {
+		t.Fatal(err)
+	}
+	change(fields)
+	changedJSON, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(changedJSON)
+}
+
+func TestNonceLength(t *testing.T) {
+	testCases := []struct {
+		name        string
+		configJSON  string
+		legacy      bool
+		nonce       func(solved string) string
+		wantOutcome verifyOutcome
+	}{
+		{name: "solved", nonce: func(solved string) string { return solved }, wantOutcome: verifyOK},
+		{name: "short", nonce: func(string) string { return "00ff" }, wantOutcome: verifyBadNonceLength},
+		{name: "long", nonce: func(solved string) string { return solved + "00" }, wantOutcome: verifyBadNonceLength},
+		{name: "odd length", nonce: func(solved string) string { return solved[1:] }, wantOutcome: verifyBadNonce},
+		{name: "not hex", nonce: func(string) string { return "zzzzzzzzzzzzzzzz" }, wantOutcome: verifyBadNonce},
+		{name: "empty", nonce: func(string) string { return "" }, wantOutcome: verifyBadNonce},
+		{name: "configured 12 bytes solved", configJSON: `{"nonce_length_bytes": 12}`, nonce: func(solved string) string { return solved }, wantOutcome: verifyOK},
+		{name: "configured 12 bytes given 8", configJSON: `{"nonce_length_bytes": 12}`, nonce: func(solved string) string { return solved[8:] }, wantOutcome: verifyBadNonceLength},
+		{name: "legacy solved with 4 bytes", legacy: true, nonce: func(solved string) string { return solved }, wantOutcome: verifyOK},
+		{name: "legacy longer than 8 bytes", legacy: true, nonce: func(solved string) string { return "0000000000" + solved }, wantOutcome: verifyBadNonce},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			setupTest(t, testCase.configJSON)
+			currentConfig, _ := currentConfiguration()
+			token := createTestToken(t, "a")
+			challengeBase64 := getTestChallenges(t, token, "difficultyLevel=1")[0]
+			if nonceLength := decodeTestChallenge(t, challengeBase64).NonceLength; nonceLength != currentConfig.NonceLengthBytes {
+				t.Fatalf("the challenge embeds nlen %d, want %d", nonceLength, currentConfig.NonceLengthBytes)
+			}
+
+			solved := ""
+			if testCase.legacy {
+				// challenges without nlen accept nonces shorter than 8 bytes, solve with 4
+				solved = solveTestChallenge(t, reencodeTestChallenge(t, challengeBase64, func(fields map[string]interface{}) { fields["nlen"] = 4 }))
+				challengeBase64 = reencodeTestChallenge(t, challengeBase64, func(fields map[string]interface{}) { delete(fields, "nlen") })
+				if _, err := challengeStore.Put(token, []string{challengeBase64}, testKeepAllBatches); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				solved = solveTestChallenge(t, challengeBase64)
+			}
+
+			if outcome := verifyChallenge(token, challengeBase64, testCase.nonce(solved), ""); outcome != testCase.wantOutcome {
+				t.Errorf("verify returned %s, want %s", outcome, testCase.wantOutcome)
+			}
+		})
+	}
+}
+
+func TestPreimageLengthAndDifficultyPosition(t *testing.T) {
+	testCases := []struct {
+		name         string
+		configJSON   string
+		legacy       bool
+		wantLength   int
+		wantPosition string
+	}{
+		{name: "defaults", configJSON: `{"allowed_algorithms": ["sha256"]}`, wantLength: 8, wantPosition: difficultyPositionTail},
+		{name: "head", configJSON: `{"allowed_algorithms": ["sha256"], "difficulty_position": "head"}`, wantLength: 8, wantPosition: difficultyPositionHead},
+		{name: "16 byte preimage", configJSON: `{"allowed_algorithms": ["sha256"], "preimage_length_bytes": 16}`, wantLength: 16, wantPosition: difficultyPositionTail},
+		{name: "16 byte preimage head", configJSON: `{"allowed_algorithms": ["sha256"], "preimage_length_bytes": 16, "difficulty_position": "head"}`, wantLength: 16, wantPosition: difficultyPositionHead},
+		{name: "legacy without plen and dpos", configJSON: `{"allowed_algorithms": ["sha256"]}`, legacy: true, wantLength: 8, wantPosition: difficultyPositionTail},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			setupTest(t, testCase.configJSON)
+			token := createTestToken(t, "a")
+			challengeBase64 := getTestChallenges(t, token, "difficultyLevel=4&algorithm=sha256")[0]
+			challenge := decodeTestChallenge(t, challengeBase64)
+			if testCase.legacy {
+				challengeBase64 = reencodeTestChallenge(t, challengeBase64, func(fields map[string]interface{}) {
+					delete(fields, "plen")
+					delete(fields, "dpos")
+				})
+				if _, err := challengeStore.Put(token, []string{challengeBase64}, testKeepAllBatches); err != nil {
+					t.Fatal(err)
+				}
+			} else if challenge.PreimageLength != testCase.wantLength || challenge.DifficultyPosition != testCase.wantPosition {
+				t.Fatalf("the challenge embeds plen %d and dpos %q, want %d and %q",
+					challenge.PreimageLength, challenge.DifficultyPosition, testCase.wantLength, testCase.wantPosition)
+			}
+			preimageBytes, _ := base64.StdEncoding.DecodeString(challenge.Preimage)
+			if len(preimageBytes) != testCase.wantLength {
+				t.Fatalf("the preimage is %d bytes, want %d", len(preimageBytes), testCase.wantLength)
+			}
+
+			nonce := solveTestChallenge(t, challengeBase64)
+			// check the solved nonce by hand against the end of the hash the challenge names
+			nonceBytes, _ := hex.DecodeString(nonce)
+			hash := sha256.Sum256(append(nonceBytes, preimageBytes...))
+			hashHex := hex.EncodeToString(hash[:])
+			comparedHex := hashHex[len(hashHex)-len(challenge.Difficulty):]
+			if testCase.wantPosition == difficultyPositionHead {
+				comparedHex = hashHex[:len(challenge.Difficulty)]
+			}
+			if comparedHex > challenge.Difficulty {
+				t.Fatalf("the %s of the hash is %s, which doesn't meet %s", testCase.wantPosition, comparedHex, challenge.Difficulty)
+			}
+
+			if outcome := verifyChallenge(token, challengeBase64, nonce, ""); outcome != verifyOK {
+				t.Errorf("verify returned %s, want %s", outcome, verifyOK)
+			}
+		})
+	}
+}
+
+func TestVerifyWithAnotherToken(t *testing.T) {
+	setupTest(t, "")
+	tokenA := createTestToken(t, "a")
+	tokenB := createTestToken(t, "b")
+	challenges := getTestChallenges(t, tokenA, "difficultyLevel=1")
+	logs := captureLogs(t, "warn", "")
+
+	testCases := []struct {
+		name        string
+		token       string
+		challenge   string
+		wantStatus  int
+		wantWrong   int64
+		wantOK      int64
+		wantUnknown int64
+	}{
+		{name: "another token", token: tokenB, challenge: challenges[0], wantStatus: http.StatusForbidden, wantWrong: 1},
+		// the owner keeps the challenge, a submission with another token doesn't use it up
+		{name: "issuing token", token: tokenA, challenge: challenges[0], wantStatus: http.StatusOK, wantWrong: 1, wantOK: 1},
+		{name: "issuing token again", token: tokenA, challenge: challenges[0], wantStatus: http.StatusNotFound, wantWrong: 1, wantOK: 1, wantUnknown: 1},
+		{name: "another token after it was used", token: tokenB, challenge: challenges[0], wantStatus: http.StatusNotFound, wantWrong: 1, wantOK: 1, wantUnknown: 2},
+		{name: "unknown challenge", token: tokenB, challenge: reencodeTestChallenge(t, challenges[1], func(fields map[string]interface{}) { fields["i"] = "AAAAAAAAAAA=" }), wantStatus: http.StatusNotFound, wantWrong: 1, wantOK: 1, wantUnknown: 3},
+	}
+	for _, testCase := range testCases {
+		nonce := solveTestChallenge(t, testCase.challenge)
+		response := serveTestRequest(newTestRequest("POST", "/Verify?challenge="+testCase.challenge+"&nonce="+nonce, testCase.token, ""))
+		if response.Code != testCase.wantStatus {
+			t.Errorf("%s: /Verify returned %d, want %d: %s", testCase.name, response.Code, testCase.wantStatus, response.Body.String())
+		}
+		counters := []struct {
+			name string
+			want int64
+		}{
+			{name: "verify_wrong_token", want: testCase.wantWrong},
+			{name: "verify_ok", want: testCase.wantOK},
+			{name: "verify_not_found", want: testCase.wantUnknown},
+		}
+		for _, counter := range counters {
+			if value := metricValue(counter.name); value != counter.want {
+				t.Errorf("%s: %s is %d, want %d", testCase.name, counter.name, value, counter.want)
+			}
+		}
+	}
+
+	if wrongTokenLogs := strings.Count(logs.String(), "challenge was submitted with another token"); wrongTokenLogs != 1 {
+		t.Errorf("the submission with another token was logged %d times, want once:\n%s", wrongTokenLogs, logs.String())
+	}
+	for _, token := range []string{tokenA, tokenB} {
+		if !strings.Contains(logs.String(), shortTokenPrefix(token)+"...") || strings.Contains(logs.String(), token) {
+			t.Errorf("the log doesn't name token %s by its prefix only:\n%s", shortTokenPrefix(token), logs.String())
+		}
+	}
+}
+
+func TestHashMeetsDifficulty(t *testing.T) {
+	// 00ff...ff80 meets a head difficulty of "00ff" but not a tail one
+	hash := append([]byte{0x00}, bytes.Repeat([]byte{0xff}, 30)...)
+	hash = append(hash, 0x80)
+	testCases := []struct {
+		position   string
+		difficulty string
+		want       bool
+	}{
+		{position: "", difficulty: "00ff", want: false},
+		{position: difficultyPositionTail, difficulty: "00ff", want: false},
+		{position: difficultyPositionTail, difficulty: "ff80", want: true},
+		{position: difficultyPositionHead, difficulty: "00ff", want: true},
+		{position: difficultyPositionHead, difficulty: "00fe", want: false},
+		{position: difficultyPositionHead, difficulty: "01", want: true},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.position+"/"+testCase.difficulty, func(t *testing.T) {
+			challenge := Challenge{Difficulty: testCase.difficulty, DifficultyPosition: testCase.position}
+			meetsDifficulty, err := hashMeetsDifficulty(challenge, hash)
+			if err != nil || meetsDifficulty != testCase.want {
+				t.Errorf("hashMeetsDifficulty() = %t, %v, want %t", meetsDifficulty, err, testCase.want)
+			}
+		})
+	}
+}
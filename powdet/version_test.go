@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"testing"
+)
+
+// setTestBuildInfo pretends the binary was built with -ldflags -X main.build...
+func setTestBuildInfo(t *testing.T) {
+	oldVersion, oldCommit, oldDate := buildVersion, buildCommit, buildDate
+	buildVersion, buildCommit, buildDate = "1.2.3", "abc123", "2026-01-02T03:04:05Z"
+	t.Cleanup(func() { buildVersion, buildCommit, buildDate = oldVersion, oldCommit, oldDate })
+}
+
+func TestVersionEndpoint(t *testing.T) {
+	setupTest(t, "")
+	setTestBuildInfo(t)
+
+	response := serveTestRequest(newTestRequest("GET", "/version", "", ""))
+	if response.Code != http.StatusOK {
+		t.Fatalf("/version returned %d", response.Code)
+	}
+	var info buildInfo
+	if err := json.Unmarshal(response.Body.Bytes(), &info); err != nil {
+		t.Fatalf("/version returned invalid json: %v", err)
+	}
+	want := buildInfo{Version: "1.2.3", Commit: "abc123", BuildDate: "2026-01-02T03:04:05Z", GoVersion: runtime.Version()}
+	if info != want {
+		t.Errorf("/version returned %+v, want %+v", info, want)
+	}
+}
+
+// the compiled-in version is what /healthz and the metrics snapshot report
+func TestVersionInHealthzAndMetrics(t *testing.T) {
+	setupTest(t, "")
+	setTestBuildInfo(t)
+	testCases := []struct {
+		path   string
+		bearer string
+	}{
+		{path: "/healthz"},
+		{path: "/Metrics", bearer: testAdminToken},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.path, func(t *testing.T) {
+			response := serveTestRequest(newTestRequest("GET", testCase.path, testCase.bearer, ""))
+			if response.Code != http.StatusOK {
+				t.Fatalf("%s returned %d", testCase.path, response.Code)
+			}
+			output := map[string]interface{}{}
+			if err := json.Unmarshal(response.Body.Bytes(), &output); err != nil {
+				t.Fatalf("%s returned invalid json: %v", testCase.path, err)
+			}
+			if output["appVersion"] != "1.2.3" || output["instance"] != instanceName() {
+				t.Errorf("%s reports appVersion %v and instance %v, want 1.2.3 and %s", testCase.path, output["appVersion"], output["instance"], instanceName())
+			}
+		})
+	}
+}